@@ -0,0 +1,209 @@
+// Package breaker provides a circuit breaker that stops calling a failing
+// dependency for a while, so that callers bypass it at once instead of each
+// waiting for it to time out, and a go-redis hook applying one to a client.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"k8s-backend/metrics"
+)
+
+// State is the state of a Breaker.
+type State int
+
+const (
+	// Closed lets every call through.
+	Closed State = iota
+	// HalfOpen lets a single probe through to test whether the dependency
+	// is back.
+	HalfOpen
+	// Open rejects every call with ErrOpen.
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// ErrOpen rejects the calls a Breaker does not let through.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Breaker opens after Threshold consecutive failures and rejects calls for
+// Cooldown. It then turns half-open and lets one probe through at a time: a
+// success closes it, a failure opens it for another Cooldown. It is safe for
+// concurrent use.
+type Breaker struct {
+	// Name labels the breaker's metrics, e.g. "redis".
+	Name      string
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+	// cause is the last failure, reported by Check while calls are rejected.
+	cause error
+	// now is time.Now, unless a test sets it.
+	now func() time.Time
+}
+
+func New(name string, threshold int, cooldown time.Duration) *Breaker {
+	metrics.BreakerState.WithLabelValues(name).Set(float64(Closed))
+	return &Breaker{Name: name, Threshold: threshold, Cooldown: cooldown}
+}
+
+// State returns the current state, turning an open breaker half-open once
+// Cooldown has passed.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cooldown()
+	return b.state
+}
+
+// Allow asks to make a call. It returns ErrOpen if the call must not be made,
+// and otherwise a function to report the call's outcome with: nil for a
+// success, context.Canceled for a call abandoned by its caller, which tells
+// nothing about the dependency, and any other error for a failure.
+func (b *Breaker) Allow() (done func(err error), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cooldown()
+	switch {
+	case b.state == Open, b.state == HalfOpen && b.probing:
+		metrics.BreakerRejections.WithLabelValues(b.Name).Inc()
+		return nil, ErrOpen
+	case b.state == HalfOpen:
+		b.probing = true
+		return b.probe, nil
+	default:
+		return b.record, nil
+	}
+}
+
+func (b *Breaker) record(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.cause = err
+	// calls let through before the breaker opened may still fail
+	if b.state == Closed && b.failures >= b.Threshold {
+		b.open()
+	}
+}
+
+func (b *Breaker) probe(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	switch {
+	case errors.Is(err, context.Canceled):
+	case err == nil:
+		b.failures = 0
+		b.set(Closed)
+	default:
+		b.cause = err
+		b.open()
+	}
+}
+
+func (b *Breaker) open() {
+	b.openedAt = b.clock()
+	b.set(Open)
+}
+
+func (b *Breaker) cooldown() {
+	if b.state == Open && b.clock().Sub(b.openedAt) >= b.Cooldown {
+		b.set(HalfOpen)
+	}
+}
+
+func (b *Breaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+func (b *Breaker) set(s State) {
+	if b.state == s {
+		return
+	}
+	b.state = s
+	if s == Open {
+		slog.Warn("circuit breaker opened", "breaker", b.Name, "failures", b.failures, "cooldown", b.Cooldown)
+	} else {
+		slog.Info("circuit breaker "+s.String(), "breaker", b.Name)
+	}
+	metrics.BreakerState.WithLabelValues(b.Name).Set(float64(s))
+	metrics.BreakerTransitions.WithLabelValues(b.Name, s.String()).Inc()
+}
+
+// Error is the failure of a dependency guarded by a breaker, as reported by
+// the health check of Check.
+type Error struct {
+	Name  string
+	State State
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s circuit breaker %s: %v", e.Name, e.State, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Degraded tells health probes the service still runs without the
+// dependency.
+func (e *Error) Degraded() bool {
+	return true
+}
+
+// Check returns a health check running ping through the breaker that reports
+// its failures, along with the breaker's state, as an *Error. A ping the
+// breaker rejects reports the failure that opened it instead.
+func (b *Breaker) Check(ping func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		err := ping(ctx)
+		if err == nil {
+			return nil
+		}
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.cooldown()
+		if errors.Is(err, ErrOpen) && b.cause != nil {
+			err = b.cause
+		}
+		return &Error{Name: b.Name, State: b.state, Err: err}
+	}
+}
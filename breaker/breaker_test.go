@@ -0,0 +1,129 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"k8s-backend/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// testBreaker returns a breaker whose clock only moves with advance.
+func testBreaker(t *testing.T, threshold int) (b *Breaker, advance func(time.Duration)) {
+	t.Helper()
+	now := time.Now()
+	b = New(t.Name(), threshold, time.Minute)
+	b.now = func() time.Time { return now }
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+// call makes a call through b that fails with err, reporting whether it was
+// let through.
+func call(b *Breaker, err error) bool {
+	done, rejected := b.Allow()
+	if rejected != nil {
+		return false
+	}
+	done(err)
+	return true
+}
+
+func TestBreaker(t *testing.T) {
+	b, advance := testBreaker(t, 3)
+	down := errors.New("connection refused")
+
+	// successes reset the count of consecutive failures
+	require.True(t, call(b, down))
+	require.True(t, call(b, down))
+	require.True(t, call(b, nil))
+	require.True(t, call(b, down))
+	require.True(t, call(b, down))
+	require.True(t, call(b, context.Canceled), "cancelled calls are no failures")
+	require.Equal(t, Closed, b.State())
+
+	require.True(t, call(b, down))
+	require.Equal(t, Open, b.State())
+	require.False(t, call(b, nil))
+	_, err := b.Allow()
+	require.ErrorIs(t, err, ErrOpen)
+
+	// one probe at a time once the cooldown is over
+	advance(time.Minute)
+	require.Equal(t, HalfOpen, b.State())
+	done, err := b.Allow()
+	require.NoError(t, err)
+	require.False(t, call(b, nil))
+	done(down)
+	require.Equal(t, Open, b.State(), "a failed probe opens the breaker again")
+
+	advance(30 * time.Second)
+	require.Equal(t, Open, b.State())
+	advance(30 * time.Second)
+	require.True(t, call(b, context.Canceled))
+	require.Equal(t, HalfOpen, b.State(), "a cancelled probe tells nothing")
+	require.True(t, call(b, nil))
+	require.Equal(t, Closed, b.State())
+
+	// it takes Threshold failures to open it again
+	require.True(t, call(b, down))
+	require.True(t, call(b, down))
+	require.Equal(t, Closed, b.State())
+}
+
+func TestBreakerMetrics(t *testing.T) {
+	b, advance := testBreaker(t, 1)
+	state := func() float64 { return testutil.ToFloat64(metrics.BreakerState.WithLabelValues(b.Name)) }
+	rejections := testutil.ToFloat64(metrics.BreakerRejections.WithLabelValues(b.Name))
+	transitions := make(map[State]float64)
+	for _, s := range []State{Open, HalfOpen, Closed} {
+		transitions[s] = testutil.ToFloat64(metrics.BreakerTransitions.WithLabelValues(b.Name, s.String()))
+	}
+
+	require.Equal(t, float64(Closed), state())
+	call(b, errors.New("timeout"))
+	require.Equal(t, float64(Open), state())
+	call(b, nil)
+	call(b, nil)
+	require.Equal(t, float64(2), testutil.ToFloat64(metrics.BreakerRejections.WithLabelValues(b.Name))-rejections)
+
+	advance(time.Minute)
+	call(b, nil)
+	require.Equal(t, float64(Closed), state())
+	for _, s := range []State{Open, HalfOpen, Closed} {
+		require.Equal(t, float64(1), testutil.ToFloat64(metrics.BreakerTransitions.WithLabelValues(b.Name, s.String()))-transitions[s], s.String())
+	}
+}
+
+func TestBreakerCheck(t *testing.T) {
+	b, _ := testBreaker(t, 1)
+	down := errors.New("connection refused")
+	var pingErr error
+	check := b.Check(func(context.Context) error {
+		done, err := b.Allow()
+		if err != nil {
+			return err
+		}
+		done(pingErr)
+		return pingErr
+	})
+
+	require.NoError(t, check(t.Context()))
+
+	pingErr = down
+	err := check(t.Context())
+	var cbErr *Error
+	require.ErrorAs(t, err, &cbErr)
+	require.True(t, cbErr.Degraded())
+	require.Equal(t, Open, cbErr.State)
+	require.ErrorIs(t, err, down)
+
+	// rejected pings report what opened the breaker
+	pingErr = nil
+	err = check(t.Context())
+	require.ErrorIs(t, err, down)
+	require.EqualError(t, err, t.Name()+" circuit breaker open: connection refused")
+}
@@ -0,0 +1,85 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisHook returns a go-redis hook sending every command and pipeline of a
+// client through b. Rejected ones fail with ErrOpen without reaching Redis.
+// Replies, error replies included, count as successes: only a Redis that
+// cannot be reached in time is a failure.
+func RedisHook(b *Breaker) redis.Hook {
+	return redisHook{b}
+}
+
+type redisHook struct {
+	b *Breaker
+}
+
+// admitted marks the context of a call the breaker let through. The commands
+// go-redis sends to set up a new connection for it, such as HELLO, run with
+// that context and through the hook again: they are part of the call.
+type admitted struct{}
+
+func (h redisHook) allow(ctx context.Context) (context.Context, func(error), error) {
+	if ctx.Value(admitted{}) != nil {
+		return ctx, func(error) {}, nil
+	}
+	done, err := h.b.Allow()
+	if err != nil {
+		return ctx, nil, err
+	}
+	return context.WithValue(ctx, admitted{}, true), done, nil
+}
+
+func (h redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, done, err := h.allow(ctx)
+		if err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		err = next(ctx, cmd)
+		done(outcome(err))
+		return err
+	}
+}
+
+func (h redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, done, err := h.allow(ctx)
+		if err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		err = next(ctx, cmds)
+		if err == nil {
+			for _, cmd := range cmds {
+				if cmdErr := outcome(cmd.Err()); cmdErr != nil {
+					err = cmdErr
+					break
+				}
+			}
+		}
+		done(outcome(err))
+		return err
+	}
+}
+
+// outcome returns err unless it is a reply from Redis.
+func outcome(err error) error {
+	var reply redis.Error
+	if errors.Is(err, redis.Nil) || errors.As(err, &reply) {
+		return nil
+	}
+	return err
+}
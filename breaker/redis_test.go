@@ -0,0 +1,53 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisHook(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	t.Cleanup(func() { client.Close() })
+	b, advance := testBreaker(t, 2)
+	client.AddHook(RedisHook(b))
+	ctx := t.Context()
+
+	// misses and error replies are answers from a working Redis
+	for range 3 {
+		require.ErrorIs(t, client.Get(ctx, "missing").Err(), redis.Nil)
+		require.NoError(t, mr.Set("text", "a"))
+		require.Error(t, client.Incr(ctx, "text").Err())
+	}
+	require.Equal(t, Closed, b.State())
+
+	mr.Close()
+	require.Error(t, client.Get(ctx, "key").Err())
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Get(ctx, "key")
+		return nil
+	})
+	require.Error(t, err)
+	require.Equal(t, Open, b.State())
+
+	// calls fail at once while open
+	cmd := client.Get(ctx, "key")
+	require.ErrorIs(t, cmd.Err(), ErrOpen)
+	_, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "key", "v", 0)
+		return nil
+	})
+	require.ErrorIs(t, err, ErrOpen)
+
+	// the probe after the cooldown closes it once Redis is back
+	require.NoError(t, mr.Restart())
+	advance(time.Minute)
+	require.NoError(t, client.Set(ctx, "key", "v", 0).Err())
+	require.Equal(t, Closed, b.State())
+	require.False(t, errors.Is(client.Get(ctx, "key").Err(), ErrOpen))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"k8s-backend/config"
+	db "k8s-backend/database"
+	"k8s-backend/database/migrate"
+	svc "k8s-backend/services"
+	"text/tabwriter"
+	"time"
+)
+
+// runCommand runs the maintenance command in args, the command line after the
+// configuration flags, instead of the server:
+//
+//	migrate up [-to version] [-dry-run]  apply pending schema migrations
+//	migrate down [-steps n] [-dry-run]   revert the last applied migrations
+//	migrate status                       list migrations and when they were applied
+//	seed                                 insert the sample books that are missing
+func runCommand(ctx context.Context, cfg *config.Config, args []string, out io.Writer) error {
+	switch args[0] {
+	case "migrate":
+		if len(args) < 2 {
+			return errors.New("migrate needs an action: up, down or status")
+		}
+		return runMigrate(ctx, cfg, args[1], args[2:], out)
+	case "seed":
+		books := db.New(cfg, svc.SeedBooks)
+		if err := books.Initialize(); err != nil {
+			return errors.Join(err, books.Close())
+		}
+		return errors.Join(books.Seed(ctx), books.Close())
+	default:
+		return fmt.Errorf("unknown command %q: want migrate or seed", args[0])
+	}
+}
+
+func runMigrate(ctx context.Context, cfg *config.Config, action string, args []string, out io.Writer) (err error) {
+	fs := flag.NewFlagSet("migrate "+action, flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "print the SQL instead of running it")
+	var to, steps *int
+	switch action {
+	case "up":
+		to = fs.Int("to", 0, "stop at this version, 0 for the latest")
+	case "down":
+		steps = fs.Int("steps", 1, "number of migrations to revert")
+	case "status":
+	default:
+		return fmt.Errorf("unknown migrate action %q: want up, down or status", action)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	mig, err := db.OpenMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, mig.DB.Close()) }()
+	mig.DryRun, mig.Out = *dryRun, out
+
+	var done []migrate.Migration
+	switch action {
+	case "up":
+		done, err = mig.Up(ctx, *to)
+	case "down":
+		done, err = mig.Down(ctx, *steps)
+	case "status":
+		return printStatus(ctx, mig, out)
+	}
+
+	verb := map[string]string{"up": "applied", "down": "reverted"}[action]
+	if *dryRun {
+		verb = "would be " + verb
+	}
+	for _, m := range done {
+		fmt.Fprintf(out, "%s %s\n", verb, m)
+	}
+	if err == nil && len(done) == 0 {
+		fmt.Fprintln(out, "nothing to do")
+	}
+	return err
+}
+
+func printStatus(ctx context.Context, mig *migrate.Migrator, out io.Writer) error {
+	statuses, err := mig.Status(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, s := range statuses {
+		applied := "pending"
+		if !s.AppliedAt.IsZero() {
+			applied = s.AppliedAt.Local().Format(time.RFC3339)
+		}
+		if s.Version > mig.Latest() {
+			applied += " (unknown to this binary)"
+		}
+		fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s-backend/config"
+	db "k8s-backend/database"
+	m "k8s-backend/model"
+	svc "k8s-backend/services"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateCommands(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database.Driver = "sqlite"
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "books.db")
+
+	run := func(args ...string) string {
+		t.Helper()
+		var out strings.Builder
+		require.NoError(t, runCommand(t.Context(), cfg, args, &out))
+		return out.String()
+	}
+
+	require.Contains(t, run("migrate", "status"), "0001     create_books  pending")
+	require.Contains(t, run("migrate", "up", "-dry-run"), "CREATE TABLE IF NOT EXISTS books")
+	require.Contains(t, run("migrate", "status"), "pending")
+
+	require.Equal(t, "applied 0001_create_books\n", run("migrate", "up"))
+	require.Equal(t, "nothing to do\n", run("migrate", "up"))
+	require.NotContains(t, run("migrate", "status"), "pending")
+
+	// seeding twice inserts the books once
+	run("seed")
+	run("seed")
+	books := db.New[m.Book](cfg, nil)
+	require.NoError(t, books.Initialize())
+	n, err := books.Count(t.Context(), nil, db.CountExact)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(svc.SeedBooks)), n)
+	require.NoError(t, books.Close())
+
+	require.Equal(t, "reverted 0001_create_books\n", run("migrate", "down"))
+
+	for _, args := range [][]string{{"migrate"}, {"migrate", "sideways"}, {"migrate", "up", "extra"}, {"unknown"}} {
+		require.Error(t, runCommand(t.Context(), cfg, args, &strings.Builder{}), args)
+	}
+}
@@ -0,0 +1,694 @@
+// Package config loads the typed runtime configuration shared by the server,
+// the services and the database backends.
+//
+// Values are resolved in increasing order of precedence:
+//
+//	defaults < config file (YAML or TOML) < environment variables < CLI flags
+//
+// Every setting has a dotted key (e.g. "postgres.host") which maps to the
+// file path postgres.host, the environment variable K8S_BACKEND_POSTGRES_HOST
+// and the flag -postgres.host.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is prepended to every environment variable read by Load.
+const EnvPrefix = "K8S_BACKEND_"
+
+type Config struct {
+	Log        Log
+	Server     Server
+	Tracing    Tracing
+	RateLimit  RateLimit
+	Pagination Pagination
+	Database   Database
+	Postgres   Postgres
+	SQLite     SQLite
+	Redis      Redis
+}
+
+type Log struct {
+	// Format is "json" or "text".
+	Format string
+	// Level is debug, info, warn or error; debug includes every SQL statement.
+	Level string
+}
+
+type Server struct {
+	Addr      string
+	PprofAddr string
+	// ShutdownDelay is how long /readyz fails before the listener closes, giving
+	// endpoints controllers time to stop routing traffic to the pod.
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds how long in-flight requests are drained once
+	// ShutdownDelay is over; the pod's termination grace period must cover
+	// both.
+	ShutdownTimeout time.Duration
+	// HealthCheckTimeout bounds each dependency check run by /readyz and /startupz.
+	HealthCheckTimeout time.Duration
+}
+
+type Tracing struct {
+	// Exporter is "none", "stdout" or "otlp" (OTLP over HTTP).
+	Exporter    string
+	ServiceName string
+	// Endpoint is the OTLP collector host:port; Insecure disables TLS.
+	Endpoint string
+	Insecure bool
+	// SampleRatio is the fraction of new traces recorded; sampled parents are always honoured.
+	SampleRatio float64
+}
+
+// RateLimit is the default policy applied to routes without their own.
+type RateLimit struct {
+	// Backend is "memory" (per replica) or "redis" (shared by all replicas).
+	Backend string
+	// Algorithm is "tokenbucket" or "slidingwindow".
+	Algorithm string
+	// Capacity is the burst size; Rate is the sustained interval per request.
+	Capacity int
+	Rate     time.Duration
+	// KeyBy selects how callers are told apart: "ip", "apikey" or "user".
+	KeyBy        string
+	APIKeyHeader string
+	// IdleTTL evicts per-key state that hasn't been used for this long.
+	IdleTTL time.Duration
+}
+
+type Pagination struct {
+	// CursorSecret signs the cursors of list endpoints and must be shared by
+	// all replicas; when empty each process signs with a random key.
+	CursorSecret string
+	// MaxLimit caps the page size clients may ask for.
+	MaxLimit int
+	// MaxAge is how long clients and CDNs may reuse a page, advertised with
+	// Cache-Control. Nothing evicts their copies, so keep it short.
+	MaxAge time.Duration
+}
+
+type Database struct {
+	// Driver selects the backend: "postgres", or "sqlite" for an embedded
+	// database in a single file that needs no server.
+	Driver string
+	// AutoMigrate applies pending schema migrations on start. Without it the
+	// service refuses to start on an outdated schema, for deployments that
+	// run `migrate up` as a step of their own.
+	AutoMigrate bool
+	// Seed inserts the sample books on start; `seed` does it on demand.
+	Seed bool
+}
+
+type Postgres struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	DBName   string
+	SSLMode  string
+	// SlowQueryThreshold logs statements slower than this as warnings.
+	SlowQueryThreshold time.Duration
+	// QueryTimeout bounds each Database[T] operation unless the caller's
+	// context carries an earlier deadline.
+	QueryTimeout time.Duration
+	// MaxOpenConns caps the connections of the pool, 0 for no limit, and
+	// MaxIdleConns how many of them stay open while idle.
+	MaxOpenConns int
+	MaxIdleConns int
+	// ConnMaxLifetime and ConnMaxIdleTime close connections older, or idle
+	// for longer, than this; 0 keeps them forever.
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// PrepareStatements caches a prepared statement per distinct query on
+	// each connection.
+	PrepareStatements bool
+}
+
+// DSN returns the libpq connection string understood by the gorm postgres driver.
+func (p Postgres) DSN() string {
+	return fmt.Sprintf(
+		"host=%s user=%s password=%s dbname=%s port=%d sslmode=%s",
+		p.Host, p.User, p.Password, p.DBName, p.Port, p.SSLMode,
+	)
+}
+
+type SQLite struct {
+	// Path is the database file, created if missing; ":memory:" keeps the
+	// database in memory until the process exits.
+	Path string
+	// SlowQueryThreshold logs statements slower than this as warnings.
+	SlowQueryThreshold time.Duration
+	// QueryTimeout bounds each Database[T] operation unless the caller's
+	// context carries an earlier deadline.
+	QueryTimeout time.Duration
+}
+
+type Redis struct {
+	Addr     string
+	Password string
+	DB       int
+	// TTL is how long cached records live; updates and deletes evict them
+	// before.
+	TTL time.Duration
+	// NegativeTTL is how long a missing record is cached as such, 0 to not.
+	NegativeTTL time.Duration
+	// RefreshBeta makes hot entries refresh early in the background; 0
+	// disables it, larger values refresh earlier.
+	RefreshBeta float64
+	// LocalSize is how many records each replica also keeps in process, 0
+	// for none, and LocalTTL for how long at most: it bounds how stale they
+	// get should an invalidation from another replica be lost.
+	LocalSize int
+	LocalTTL  time.Duration
+	// ListTTL is how long list results are cached, 0 to not; writes evict
+	// the ones they change before.
+	ListTTL time.Duration
+	// BreakerThreshold is how many consecutive failures open the circuit
+	// breaker, bypassing Redis for BreakerCooldown; 0 disables it.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// Options returns the go-redis client options for this configuration.
+func (r Redis) Options() *redis.Options {
+	return &redis.Options{
+		Addr:     r.Addr,
+		Password: r.Password,
+		DB:       r.DB,
+	}
+}
+
+// Default returns the configuration used when nothing else is provided.
+// It matches a local development setup (Postgres and Redis on localhost).
+func Default() *Config {
+	return &Config{
+		Log: Log{
+			Format: "json",
+			Level:  "info",
+		},
+		Server: Server{
+			Addr:               ":8081",
+			PprofAddr:          "localhost:6060",
+			ShutdownDelay:      5 * time.Second,
+			ShutdownTimeout:    20 * time.Second,
+			HealthCheckTimeout: 2 * time.Second,
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			ServiceName: "k8s-backend",
+			Endpoint:    "localhost:4318",
+			SampleRatio: 1,
+		},
+		RateLimit: RateLimit{
+			Backend:      "memory",
+			Algorithm:    "tokenbucket",
+			Capacity:     5,
+			Rate:         time.Second,
+			KeyBy:        "ip",
+			APIKeyHeader: "X-API-Key",
+			IdleTTL:      10 * time.Minute,
+		},
+		Pagination: Pagination{
+			MaxLimit: 100,
+			MaxAge:   5 * time.Second,
+		},
+		Database: Database{
+			Driver:      "postgres",
+			AutoMigrate: true,
+			Seed:        true,
+		},
+		Postgres: Postgres{
+			Host:               "localhost",
+			Port:               5432,
+			User:               "postgres",
+			Password:           "postgres",
+			DBName:             "postgres",
+			SSLMode:            "disable",
+			SlowQueryThreshold: 200 * time.Millisecond,
+			QueryTimeout:       5 * time.Second,
+			MaxOpenConns:       20,
+			MaxIdleConns:       10,
+			ConnMaxLifetime:    30 * time.Minute,
+			ConnMaxIdleTime:    5 * time.Minute,
+			PrepareStatements:  true,
+		},
+		SQLite: SQLite{
+			Path:               "k8s-backend.db",
+			SlowQueryThreshold: 200 * time.Millisecond,
+			QueryTimeout:       5 * time.Second,
+		},
+		Redis: Redis{
+			Addr:             "localhost:6379",
+			TTL:              24 * time.Hour,
+			NegativeTTL:      30 * time.Second,
+			RefreshBeta:      1,
+			LocalSize:        10000,
+			LocalTTL:         10 * time.Second,
+			ListTTL:          time.Minute,
+			BreakerThreshold: 5,
+			BreakerCooldown:  10 * time.Second,
+		},
+	}
+}
+
+// Load resolves the configuration from defaults, the optional config file,
+// the environment and the given command line arguments (without the program
+// name), then validates the result.
+func Load(args []string) (*Config, error) {
+	return load(args, os.LookupEnv)
+}
+
+// LoadCommand is Load for a command line of the form
+// [flags] [command [arguments]]: it also returns what follows the flags.
+func LoadCommand(args []string) (*Config, []string, error) {
+	return loadCommand(args, os.LookupEnv)
+}
+
+func load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg, _, err := loadCommand(args, lookupEnv)
+	return cfg, err
+}
+
+func loadCommand(args []string, lookupEnv func(string) (string, bool)) (*Config, []string, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet("k8s-backend", flag.ContinueOnError)
+	path, _ := lookupEnv(EnvPrefix + "CONFIG")
+	fs.StringVar(&path, "config", path, "path to a YAML or TOML config file")
+
+	// flags are applied last, so only record what was explicitly set
+	overrides := make(map[string]string)
+	for _, s := range settings {
+		record := func(v string) error {
+			overrides[s.key] = v
+			return nil
+		}
+		if _, ok := s.value.(*bool); ok {
+			fs.BoolFunc(s.key, s.usage, record) // allow -tracing.insecure without a value
+			continue
+		}
+		fs.Func(s.key, s.usage, record)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := apply(settings, values, "config file "+path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	env := make(map[string]string)
+	for _, s := range settings {
+		if v, ok := lookupEnv(envName(s.key)); ok {
+			env[s.key] = v
+		}
+	}
+	if err := apply(settings, env, "environment"); err != nil {
+		return nil, nil, err
+	}
+
+	if err := apply(settings, overrides, "flags"); err != nil {
+		return nil, nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+
+	switch c.Log.Format {
+	case "json", "text":
+	default:
+		errs = append(errs, fmt.Errorf("log.format is invalid: %q", c.Log.Format))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level is invalid: %q", c.Log.Level))
+	}
+
+	if err := validateAddr(c.Server.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("server.addr: %w", err))
+	}
+	if c.Server.PprofAddr != "" {
+		if err := validateAddr(c.Server.PprofAddr); err != nil {
+			errs = append(errs, fmt.Errorf("server.pprofaddr: %w", err))
+		}
+	}
+	if c.Server.ShutdownDelay < 0 {
+		errs = append(errs, fmt.Errorf("server.shutdowndelay must be >= 0, got %s", c.Server.ShutdownDelay))
+	}
+	if c.Server.HealthCheckTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server.healthchecktimeout must be > 0, got %s", c.Server.HealthCheckTimeout))
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server.shutdowntimeout must be > 0, got %s", c.Server.ShutdownTimeout))
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.Endpoint == "" {
+			errs = append(errs, errors.New("tracing.endpoint must be set for the otlp exporter"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter is invalid: %q", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sampleratio must be between 0 and 1, got %v", c.Tracing.SampleRatio))
+	}
+
+	switch c.RateLimit.Backend {
+	case "memory", "redis":
+	default:
+		errs = append(errs, fmt.Errorf("ratelimit.backend is invalid: %q", c.RateLimit.Backend))
+	}
+	switch c.RateLimit.Algorithm {
+	case "tokenbucket", "slidingwindow":
+	default:
+		errs = append(errs, fmt.Errorf("ratelimit.algorithm is invalid: %q", c.RateLimit.Algorithm))
+	}
+	if c.RateLimit.Capacity <= 0 {
+		errs = append(errs, fmt.Errorf("ratelimit.capacity must be > 0, got %d", c.RateLimit.Capacity))
+	}
+	if c.RateLimit.Rate <= 0 {
+		errs = append(errs, fmt.Errorf("ratelimit.rate must be > 0, got %s", c.RateLimit.Rate))
+	}
+	switch c.RateLimit.KeyBy {
+	case "ip", "user":
+	case "apikey":
+		if c.RateLimit.APIKeyHeader == "" {
+			errs = append(errs, errors.New("ratelimit.apikeyheader must be set when keying by apikey"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("ratelimit.keyby is invalid: %q", c.RateLimit.KeyBy))
+	}
+	if c.RateLimit.IdleTTL <= 0 {
+		errs = append(errs, fmt.Errorf("ratelimit.idlettl must be > 0, got %s", c.RateLimit.IdleTTL))
+	}
+
+	if c.Pagination.MaxLimit <= 0 {
+		errs = append(errs, fmt.Errorf("pagination.maxlimit must be > 0, got %d", c.Pagination.MaxLimit))
+	}
+	if c.Pagination.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("pagination.maxage must be >= 0, got %s", c.Pagination.MaxAge))
+	}
+
+	switch c.Database.Driver {
+	case "postgres":
+		errs = append(errs, c.Postgres.validate()...)
+	case "sqlite":
+		if c.SQLite.Path == "" {
+			errs = append(errs, errors.New("sqlite.path must be set"))
+		}
+		if c.SQLite.QueryTimeout < 0 {
+			errs = append(errs, fmt.Errorf("sqlite.querytimeout must be >= 0, got %s", c.SQLite.QueryTimeout))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("database.driver is invalid: %q", c.Database.Driver))
+	}
+
+	if err := validateAddr(c.Redis.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("redis.addr: %w", err))
+	}
+	if c.Redis.DB < 0 {
+		errs = append(errs, fmt.Errorf("redis.db must be >= 0, got %d", c.Redis.DB))
+	}
+	if c.Redis.TTL <= 0 {
+		errs = append(errs, fmt.Errorf("redis.ttl must be > 0, got %s", c.Redis.TTL))
+	}
+	if c.Redis.NegativeTTL < 0 {
+		errs = append(errs, fmt.Errorf("redis.negativettl must be >= 0, got %s", c.Redis.NegativeTTL))
+	}
+	if c.Redis.RefreshBeta < 0 {
+		errs = append(errs, fmt.Errorf("redis.refreshbeta must be >= 0, got %g", c.Redis.RefreshBeta))
+	}
+	if c.Redis.LocalSize < 0 {
+		errs = append(errs, fmt.Errorf("redis.localsize must be >= 0, got %d", c.Redis.LocalSize))
+	}
+	if c.Redis.LocalTTL < 0 {
+		errs = append(errs, fmt.Errorf("redis.localttl must be >= 0, got %s", c.Redis.LocalTTL))
+	}
+	if c.Redis.ListTTL < 0 {
+		errs = append(errs, fmt.Errorf("redis.listttl must be >= 0, got %s", c.Redis.ListTTL))
+	}
+	if c.Redis.BreakerThreshold < 0 {
+		errs = append(errs, fmt.Errorf("redis.breakerthreshold must be >= 0, got %d", c.Redis.BreakerThreshold))
+	}
+	if c.Redis.BreakerThreshold > 0 && c.Redis.BreakerCooldown <= 0 {
+		errs = append(errs, fmt.Errorf("redis.breakercooldown must be > 0, got %s", c.Redis.BreakerCooldown))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// validate is only called when Postgres is the selected driver.
+func (p Postgres) validate() []error {
+	var errs []error
+
+	if p.Host == "" {
+		errs = append(errs, errors.New("postgres.host must be set"))
+	}
+	if p.Port <= 0 || p.Port > 65535 {
+		errs = append(errs, fmt.Errorf("postgres.port must be between 1 and 65535, got %d", p.Port))
+	}
+	if p.User == "" {
+		errs = append(errs, errors.New("postgres.user must be set"))
+	}
+	if p.DBName == "" {
+		errs = append(errs, errors.New("postgres.dbname must be set"))
+	}
+	switch p.SSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		errs = append(errs, fmt.Errorf("postgres.sslmode is invalid: %q", p.SSLMode))
+	}
+
+	if p.QueryTimeout < 0 {
+		errs = append(errs, fmt.Errorf("postgres.querytimeout must be >= 0, got %s", p.QueryTimeout))
+	}
+	if p.MaxOpenConns < 0 {
+		errs = append(errs, fmt.Errorf("postgres.maxopenconns must be >= 0, got %d", p.MaxOpenConns))
+	}
+	if p.MaxIdleConns < 0 {
+		errs = append(errs, fmt.Errorf("postgres.maxidleconns must be >= 0, got %d", p.MaxIdleConns))
+	} else if p.MaxOpenConns > 0 && p.MaxIdleConns > p.MaxOpenConns {
+		errs = append(errs, fmt.Errorf("postgres.maxidleconns must not exceed postgres.maxopenconns (%d), got %d", p.MaxOpenConns, p.MaxIdleConns))
+	}
+	if p.ConnMaxLifetime < 0 {
+		errs = append(errs, fmt.Errorf("postgres.connmaxlifetime must be >= 0, got %s", p.ConnMaxLifetime))
+	}
+	if p.ConnMaxIdleTime < 0 {
+		errs = append(errs, fmt.Errorf("postgres.connmaxidletime must be >= 0, got %s", p.ConnMaxIdleTime))
+	}
+	return errs
+}
+
+func validateAddr(addr string) error {
+	if addr == "" {
+		return errors.New("address must be set")
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// setting binds a dotted key to the config field it populates.
+type setting struct {
+	key   string
+	usage string
+	value any // *string, *int, *bool, *float64 or *time.Duration
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"log.format", "log output format: json or text", &c.Log.Format},
+		{"log.level", "minimum log level: debug, info, warn or error", &c.Log.Level},
+		{"server.addr", "HTTP listen address", &c.Server.Addr},
+		{"server.pprofaddr", "pprof listen address, empty to disable", &c.Server.PprofAddr},
+		{"server.shutdowndelay", "time /readyz fails before the listener closes on shutdown", &c.Server.ShutdownDelay},
+		{"server.shutdowntimeout", "time allowed to drain in-flight requests on shutdown", &c.Server.ShutdownTimeout},
+		{"server.healthchecktimeout", "timeout for each readiness dependency check", &c.Server.HealthCheckTimeout},
+		{"tracing.exporter", "trace exporter: none, stdout or otlp", &c.Tracing.Exporter},
+		{"tracing.servicename", "service.name resource attribute", &c.Tracing.ServiceName},
+		{"tracing.endpoint", "OTLP/HTTP collector host:port", &c.Tracing.Endpoint},
+		{"tracing.insecure", "disable TLS to the OTLP collector", &c.Tracing.Insecure},
+		{"tracing.sampleratio", "fraction of new traces to sample", &c.Tracing.SampleRatio},
+		{"ratelimit.backend", "rate limit state: memory (per replica) or redis (shared)", &c.RateLimit.Backend},
+		{"ratelimit.algorithm", "rate limit algorithm: tokenbucket or slidingwindow", &c.RateLimit.Algorithm},
+		{"ratelimit.capacity", "rate limit burst size per caller", &c.RateLimit.Capacity},
+		{"ratelimit.rate", "sustained interval between requests per caller", &c.RateLimit.Rate},
+		{"ratelimit.keyby", "rate limit caller key: ip, apikey or user", &c.RateLimit.KeyBy},
+		{"ratelimit.apikeyheader", "header carrying the API key when keying by apikey", &c.RateLimit.APIKeyHeader},
+		{"ratelimit.idlettl", "evict rate limit state idle for this long", &c.RateLimit.IdleTTL},
+		{"pagination.cursorsecret", "secret signing list cursors, shared by all replicas", &c.Pagination.CursorSecret},
+		{"pagination.maxlimit", "largest page size clients may request", &c.Pagination.MaxLimit},
+		{"pagination.maxage", "how long clients and CDNs may reuse a page, 0 to disable", &c.Pagination.MaxAge},
+		{"database.driver", "database backend: postgres or sqlite", &c.Database.Driver},
+		{"database.automigrate", "apply pending schema migrations on start", &c.Database.AutoMigrate},
+		{"database.seed", "insert the sample books on start", &c.Database.Seed},
+		{"postgres.host", "Postgres host", &c.Postgres.Host},
+		{"postgres.port", "Postgres port", &c.Postgres.Port},
+		{"postgres.user", "Postgres user", &c.Postgres.User},
+		{"postgres.password", "Postgres password", &c.Postgres.Password},
+		{"postgres.dbname", "Postgres database name", &c.Postgres.DBName},
+		{"postgres.sslmode", "Postgres sslmode", &c.Postgres.SSLMode},
+		{"postgres.slowquerythreshold", "log statements slower than this as warnings", &c.Postgres.SlowQueryThreshold},
+		{"postgres.querytimeout", "default timeout per database operation, 0 to disable", &c.Postgres.QueryTimeout},
+		{"postgres.maxopenconns", "maximum open Postgres connections, 0 for no limit", &c.Postgres.MaxOpenConns},
+		{"postgres.maxidleconns", "maximum idle Postgres connections kept in the pool", &c.Postgres.MaxIdleConns},
+		{"postgres.connmaxlifetime", "close Postgres connections older than this, 0 to keep them", &c.Postgres.ConnMaxLifetime},
+		{"postgres.connmaxidletime", "close Postgres connections idle for this long, 0 to keep them", &c.Postgres.ConnMaxIdleTime},
+		{"postgres.preparestatements", "cache prepared statements on each Postgres connection", &c.Postgres.PrepareStatements},
+		{"sqlite.path", "SQLite database file, :memory: to keep it in memory", &c.SQLite.Path},
+		{"sqlite.slowquerythreshold", "log SQLite statements slower than this as warnings", &c.SQLite.SlowQueryThreshold},
+		{"sqlite.querytimeout", "default timeout per SQLite operation, 0 to disable", &c.SQLite.QueryTimeout},
+		{"redis.addr", "Redis address", &c.Redis.Addr},
+		{"redis.password", "Redis password", &c.Redis.Password},
+		{"redis.db", "Redis database number", &c.Redis.DB},
+		{"redis.ttl", "lifetime of cached records", &c.Redis.TTL},
+		{"redis.negativettl", "lifetime of cached lookups of missing records, 0 to disable", &c.Redis.NegativeTTL},
+		{"redis.refreshbeta", "eagerness to refresh hot cache entries before they expire, 0 to disable", &c.Redis.RefreshBeta},
+		{"redis.localsize", "records each replica also caches in process, 0 to disable", &c.Redis.LocalSize},
+		{"redis.localttl", "lifetime of records cached in process", &c.Redis.LocalTTL},
+		{"redis.listttl", "lifetime of cached list results, 0 to disable", &c.Redis.ListTTL},
+		{"redis.breakerthreshold", "consecutive Redis failures that open the circuit breaker, 0 to disable", &c.Redis.BreakerThreshold},
+		{"redis.breakercooldown", "how long an open circuit breaker bypasses Redis before probing it", &c.Redis.BreakerCooldown},
+	}
+}
+
+func (s setting) set(raw string) error {
+	switch p := s.value.(type) {
+	case *string:
+		*p = raw
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s must be an integer: %q", s.key, raw)
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s must be a boolean: %q", s.key, raw)
+		}
+		*p = b
+	case *float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number: %q", s.key, raw)
+		}
+		*p = f
+	case *time.Duration:
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s must be a duration such as 10s: %q", s.key, raw)
+		}
+		*p = d
+	default:
+		return fmt.Errorf("%s has unsupported type %T", s.key, p)
+	}
+	return nil
+}
+
+func apply(settings []setting, values map[string]string, source string) error {
+	index := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		index[s.key] = s
+	}
+
+	// deterministic error reporting
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s, ok := index[k]
+		if !ok {
+			return fmt.Errorf("%s: unknown setting %q", source, k)
+		}
+		if err := s.set(values[k]); err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// readFile decodes a YAML or TOML file, chosen by extension, into dotted keys.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	tree := make(map[string]any)
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %q (want .yaml, .yml or .toml)", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	flatten("", tree, values)
+	return values, nil
+}
+
+func flatten(prefix string, tree map[string]any, out map[string]string) {
+	for k, v := range tree {
+		key := strings.ToLower(k)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if sub, ok := v.(map[string]any); ok {
+			flatten(key, sub, out)
+			continue
+		}
+		out[key] = fmt.Sprint(v)
+	}
+}
+
+func envName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := vars[k]
+		return v, ok
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := load(nil, env(nil))
+	require.NoError(t, err)
+	require.Equal(t, Default(), cfg)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	yml := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(yml, []byte(`
+server:
+  addr: ":9000"
+  shutdowntimeout: 45s
+postgres:
+  host: db.internal
+  port: 6543
+redis:
+  addr: cache.internal:6379
+`), 0o600))
+
+	cfg, err := load(
+		[]string{"-config", yml, "-postgres.host", "flag-host"},
+		env(map[string]string{
+			"K8S_BACKEND_POSTGRES_HOST": "env-host",
+			"K8S_BACKEND_POSTGRES_PORT": "7654",
+		}),
+	)
+	require.NoError(t, err)
+	require.Equal(t, ":9000", cfg.Server.Addr) // file
+	require.Equal(t, 45*time.Second, cfg.Server.ShutdownTimeout)
+	require.Equal(t, 7654, cfg.Postgres.Port)        // env beats file
+	require.Equal(t, "flag-host", cfg.Postgres.Host) // flag beats env
+	require.Equal(t, "cache.internal:6379", cfg.Redis.Addr)
+	require.Equal(t, "localhost:6060", cfg.Server.PprofAddr) // default
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[postgres]
+host = "toml-host"
+port = 5433
+
+[redis]
+db = 2
+
+[tracing]
+exporter = "otlp"
+insecure = true
+sampleratio = 0.25
+`), 0o600))
+
+	cfg, err := load(nil, env(map[string]string{"K8S_BACKEND_CONFIG": path}))
+	require.NoError(t, err)
+	require.Equal(t, "toml-host", cfg.Postgres.Host)
+	require.Equal(t, 5433, cfg.Postgres.Port)
+	require.Equal(t, 2, cfg.Redis.DB)
+	require.Equal(t, "otlp", cfg.Tracing.Exporter)
+	require.True(t, cfg.Tracing.Insecure)
+	require.Equal(t, 0.25, cfg.Tracing.SampleRatio)
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.yaml")
+	require.NoError(t, os.WriteFile(unknown, []byte("postgres:\n  hostname: x\n"), 0o600))
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{name: "Unknown file key", args: []string{"-config", unknown}},
+		{name: "Missing file", args: []string{"-config", filepath.Join(dir, "missing.yaml")}},
+		{name: "Unsupported extension", args: []string{"-config", filepath.Join(dir, "config.json")}},
+		{name: "Non-numeric port", env: map[string]string{"K8S_BACKEND_POSTGRES_PORT": "abc"}},
+		{name: "Port out of range", args: []string{"-postgres.port", "70000"}},
+		{name: "Invalid sslmode", args: []string{"-postgres.sslmode", "sometimes"}},
+		{name: "Invalid server addr", args: []string{"-server.addr", "8081"}},
+		{name: "Unknown flag", args: []string{"-nope", "1"}},
+		{name: "Invalid boolean", args: []string{"-tracing.insecure=maybe"}},
+		{name: "Sample ratio out of range", args: []string{"-tracing.sampleratio", "2"}},
+		{name: "Invalid duration", args: []string{"-server.shutdowntimeout", "soon"}},
+		{name: "Zero shutdown timeout", args: []string{"-server.shutdowntimeout", "0s"}},
+		{name: "Unknown database driver", args: []string{"-database.driver", "mysql"}},
+		{name: "Zero redis ttl", args: []string{"-redis.ttl", "0s"}},
+		{name: "Negative refresh beta", args: []string{"-redis.refreshbeta", "-1"}},
+		{name: "Negative local cache size", args: []string{"-redis.localsize", "-1"}},
+		{name: "Negative list ttl", args: []string{"-redis.listttl", "-1s"}},
+		{name: "Zero breaker cooldown", args: []string{"-redis.breakercooldown", "0s"}},
+		{name: "Negative page max age", args: []string{"-pagination.maxage", "-1s"}},
+		{name: "Negative max open conns", args: []string{"-postgres.maxopenconns", "-1"}},
+		{name: "More idle than open conns", args: []string{"-postgres.maxopenconns", "5", "-postgres.maxidleconns", "10"}},
+		{name: "Negative conn max lifetime", args: []string{"-postgres.connmaxlifetime", "-1m"}},
+		{name: "Empty sqlite path", args: []string{"-database.driver", "sqlite", "-sqlite.path", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(tt.args, env(tt.env))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLoadSQLiteSkipsPostgres(t *testing.T) {
+	// Postgres settings are irrelevant, so not validated, with SQLite
+	cfg, err := load([]string{"-database.driver", "sqlite", "-postgres.sslmode", "sometimes"}, env(nil))
+	require.NoError(t, err)
+	require.Equal(t, "sqlite", cfg.Database.Driver)
+	require.Equal(t, "k8s-backend.db", cfg.SQLite.Path)
+}
+
+func TestLoadDisabledBreaker(t *testing.T) {
+	// without a breaker, its cooldown is irrelevant
+	cfg, err := load([]string{"-redis.breakerthreshold", "0", "-redis.breakercooldown", "0s"}, env(nil))
+	require.NoError(t, err)
+	require.Zero(t, cfg.Redis.BreakerThreshold)
+}
+
+func TestLoadCommand(t *testing.T) {
+	cfg, args, err := loadCommand([]string{"-database.driver", "sqlite", "migrate", "up", "-dry-run"}, env(nil))
+	require.NoError(t, err)
+	require.Equal(t, "sqlite", cfg.Database.Driver)
+	require.Equal(t, []string{"migrate", "up", "-dry-run"}, args)
+}
+
+func TestPostgresDSN(t *testing.T) {
+	require.Equal(t,
+		"host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable",
+		Default().Postgres.DSN(),
+	)
+}
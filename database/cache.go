@@ -0,0 +1,502 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	m "k8s-backend/model"
+)
+
+// Cache is an in-memory Database[T] for tests and local development. It
+// follows Postgres[T]: integer primary keys are assigned on Insert, Update
+// applies only the given fields, GetAll filters, orders and paginates like the
+// SQL backend, and unique constraints from the gorm tags are enforced.
+// Records are copied in and out, so callers never share memory with it.
+//
+// Models without a primary key, which Postgres[T] stores without one, are
+// keyed by the id passed to Insert instead.
+type Cache[T any] struct {
+	// Data holds the records keyed by primary key.
+	Data         map[string]*T
+	InitElements []T
+	sync.Mutex
+
+	nextID int64
+}
+
+func (c *Cache[T]) Initialize() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.Data == nil {
+		c.Data = make(map[string]*T)
+	}
+	_, err := columnsOf[T]()
+	return err
+}
+
+// Seed, like Postgres[T], inserts the i-th element unless its id is taken.
+func (c *Cache[T]) Seed(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return err
+	}
+	for i, e := range c.InitElements {
+		if _, ok := c.Data[fmt.Sprint(i+1)]; ok {
+			continue
+		}
+		if _, err := c.insert(cols, fmt.Sprint(i+1), &e); err != nil {
+			return fmt.Errorf("seeding: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *Cache[T]) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	clear(c.Data)
+	return nil
+}
+
+func (c *Cache[T]) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (c *Cache[T]) Get(ctx context.Context, id string) (*T, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := memTxFrom(ctx); err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return nil, err
+	}
+	key, err := primaryKey(cols, id)
+	if err != nil {
+		return nil, err
+	}
+
+	element := c.Data[key]
+	if element == nil {
+		return nil, fmt.Errorf("%w: id %s", ErrNotFound, id)
+	}
+	return clone(element), nil
+}
+
+func (c *Cache[T]) GetAll(ctx context.Context, f *m.Filters[T]) ([]*T, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := memTxFrom(ctx); err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*T
+	for _, v := range c.Data {
+		ok, err := matches(cols, v, f.Where)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			records = append(records, v)
+		}
+	}
+
+	records, err = page(cols, records, f)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range records {
+		records[i] = clone(r)
+	}
+	return records, nil
+}
+
+// Count always counts exactly, there is no cheaper estimate in memory.
+func (c *Cache[T]) Count(ctx context.Context, where []m.Condition, _ CountMode) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if _, err := memTxFrom(ctx); err != nil {
+		return 0, err
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, v := range c.Data {
+		ok, err := matches(cols, v, where)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Insert stores a copy of element. As with Postgres[T] the id argument is
+// ignored when T has a primary key: a zero integer primary key is assigned
+// the next id and written back to element.
+func (c *Cache[T]) Insert(ctx context.Context, id string, element *T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx, err := c.writeTx(ctx)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return err
+	}
+	key, err := c.insert(cols, id, element)
+	if err != nil {
+		return err
+	}
+	tx.record(c.restore(map[string]*T{key: nil}))
+	return nil
+}
+
+// insert stores element and returns its key.
+func (c *Cache[T]) insert(cols *columnSet, id string, element *T) (string, error) {
+	if c.Data == nil {
+		c.Data = make(map[string]*T)
+	}
+	record := clone(element)
+
+	if cols.primaryKey == nil {
+		if id == "" {
+			return "", fmt.Errorf("%w: id must be set, %s has no primary key", ErrValidation, reflect.TypeFor[T]())
+		}
+		if err := c.checkUnique(cols, id, record, ""); err != nil {
+			return "", err
+		}
+		c.Data[id] = record
+		return id, nil
+	}
+
+	pk := reflect.ValueOf(record).Elem().FieldByName(cols.primaryKey.Field)
+
+	if pk.IsZero() {
+		// skip ids taken by records put into Data directly
+		for c.Data[fmt.Sprint(c.nextID+1)] != nil {
+			c.nextID++
+		}
+		switch kindOf(pk.Type()) {
+		case reflect.Int:
+			pk.SetInt(c.nextID + 1)
+		case reflect.Uint:
+			pk.SetUint(uint64(c.nextID + 1))
+		default:
+			return "", fmt.Errorf("%w: %s must be set", ErrValidation, cols.primaryKey.Name)
+		}
+	}
+	key := fmt.Sprint(pk.Interface())
+	if err := c.checkUnique(cols, key, record, ""); err != nil {
+		return "", err
+	}
+
+	// unlike a serial column, explicit ids move the sequence on so that
+	// assigned ids never collide with them
+	switch kindOf(pk.Type()) {
+	case reflect.Int:
+		c.nextID = max(c.nextID, pk.Int())
+	case reflect.Uint:
+		c.nextID = max(c.nextID, int64(pk.Uint()))
+	}
+
+	c.Data[key] = record
+	reflect.ValueOf(element).Elem().FieldByName(cols.primaryKey.Field).Set(pk)
+	return key, nil
+}
+
+// Update sets the given fields, named by column or Go field name as gorm
+// accepts them, on the record with the given id. Like the SQL backends, it
+// rejects the primary key and create-only fields.
+func (c *Cache[T]) Update(ctx context.Context, id string, fields map[string]any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx, err := c.writeTx(ctx)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return err
+	}
+	key, err := primaryKey(cols, id)
+	if err != nil {
+		return err
+	}
+	existing := c.Data[key]
+	if existing == nil {
+		return fmt.Errorf("%w: id %s", ErrNotFound, id)
+	}
+
+	record := clone(existing)
+	v := reflect.ValueOf(record).Elem()
+	for name, value := range fields {
+		col, err := updatableColumn(cols, name)
+		if err != nil {
+			return err
+		}
+		if err := assign(v.FieldByName(col.Field), value); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrValidation, name, err)
+		}
+	}
+
+	if err := c.checkUnique(cols, key, record, key); err != nil {
+		return err
+	}
+	tx.record(c.restore(map[string]*T{key: existing}))
+	c.Data[key] = record
+	return nil
+}
+
+func (c *Cache[T]) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx, err := c.writeTx(ctx)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return err
+	}
+	key, err := primaryKey(cols, id)
+	if err != nil {
+		return err
+	}
+	if c.Data[key] == nil {
+		return fmt.Errorf("%w: id %s", ErrNotFound, id)
+	}
+	tx.record(c.restore(map[string]*T{key: c.Data[key]}))
+	delete(c.Data, key)
+	return nil
+}
+
+// WithTx runs fn as a transaction over every Cache[T] that calls made with
+// tx.Context() write to, rolling their writes back if fn fails. In-memory
+// transactions run one at a time, so they are serializable whatever the
+// isolation level asked for and never need retrying; calls made outside of a
+// transaction may see uncommitted writes though.
+func (c *Cache[T]) WithTx(ctx context.Context, opts *TxOptions, fn func(tx Tx) error) error {
+	tx, err := memTxFrom(ctx)
+	if err != nil {
+		return err
+	}
+	if tx != nil {
+		return tx.Savepoint(fn)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	memTxLock.Lock()
+	defer memTxLock.Unlock()
+
+	tx = &memTx{readOnly: opts != nil && opts.ReadOnly}
+	tx.ctx = context.WithValue(ctx, txKey{}, Tx(tx))
+	defer func() {
+		if p := recover(); p != nil {
+			tx.rollbackTo(0)
+			panic(p)
+		}
+	}()
+	if err := fn(tx); err != nil {
+		tx.rollbackTo(0)
+		return err
+	}
+	for _, fn := range tx.committed {
+		fn()
+	}
+	return nil
+}
+
+// writeTx returns the transaction ctx carries, if any, for a write.
+func (c *Cache[T]) writeTx(ctx context.Context) (*memTx, error) {
+	tx, err := memTxFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := writable(ctx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// restore returns a function putting back the records under the keys of prev,
+// removing those that are nil.
+func (c *Cache[T]) restore(prev map[string]*T) func() {
+	return func() {
+		c.Lock()
+		defer c.Unlock()
+		for k, v := range prev {
+			if v == nil {
+				delete(c.Data, k)
+			} else {
+				c.Data[k] = v
+			}
+		}
+	}
+}
+
+// checkUnique reports ErrConflict if record, to be stored under key, collides
+// with a stored record other than the one under self on its key or a unique
+// constraint.
+func (c *Cache[T]) checkUnique(cols *columnSet, key string, record *T, self string) error {
+	v := reflect.ValueOf(record).Elem()
+	if _, taken := c.Data[key]; taken && key != self {
+		name := "id"
+		if cols.primaryKey != nil {
+			name = cols.primaryKey.DBName
+		}
+		return fmt.Errorf("%w: Key (%s)=(%s) already exists", ErrConflict, name, key)
+	}
+
+	for k, other := range c.Data {
+		if k == self {
+			continue
+		}
+		o := reflect.ValueOf(other).Elem()
+	constraints:
+		for _, unique := range cols.uniques {
+			for _, field := range unique {
+				if compareValue(v.FieldByName(field), o.FieldByName(field)) != 0 {
+					continue constraints
+				}
+			}
+			names := make([]string, len(unique))
+			values := make([]string, len(unique))
+			for i, field := range unique {
+				names[i] = field
+				if col, ok := lookupColumn(cols, field); ok {
+					names[i] = col.DBName
+				}
+				values[i] = fmt.Sprint(v.FieldByName(field).Interface())
+			}
+			// worded like the Postgres detail, "Key (title)=(QM) already exists."
+			return fmt.Errorf("%w: Key (%s)=(%s) already exists", ErrConflict,
+				strings.Join(names, ", "), strings.Join(values, ", "))
+		}
+	}
+	return nil
+}
+
+// primaryKey converts id to the map key of the record it names. Like a
+// Postgres query on an integer column, a malformed id is a validation error.
+func primaryKey(cols *columnSet, id string) (string, error) {
+	if cols.primaryKey == nil {
+		return id, nil
+	}
+	v, err := parseValue(cols.primaryKey.Type, id)
+	if err != nil {
+		return "", fmt.Errorf("%w: id: %v", ErrValidation, err)
+	}
+	return fmt.Sprint(v), nil
+}
+
+// updatableColumn resolves a field of an update, named by column or Go field
+// name, to a column Update may set.
+func updatableColumn(cols *columnSet, name string) (Column, error) {
+	col, ok := lookupColumn(cols, name)
+	switch {
+	case !ok:
+		return Column{}, fmt.Errorf("%w: unknown column %q", ErrValidation, name)
+	case !col.Updatable:
+		return Column{}, fmt.Errorf("%w: %s cannot be updated", ErrValidation, name)
+	}
+	return col, nil
+}
+
+// lookupColumn finds a column by its database or Go field name.
+func lookupColumn(cols *columnSet, name string) (Column, bool) {
+	for _, col := range cols.ordered {
+		if col.DBName == name || col.Field == name {
+			return col, true
+		}
+	}
+	return Column{}, false
+}
+
+// assign sets field to value, converting between numeric types as decoded
+// JSON requires. nil sets the zero value.
+func assign(field reflect.Value, value any) error {
+	if value == nil {
+		field.SetZero()
+		return nil
+	}
+
+	rv := reflect.ValueOf(value)
+	target := field.Type()
+	if target.Kind() == reflect.Pointer {
+		elem := reflect.New(target.Elem())
+		if err := assign(elem.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+
+	from, to := kindOf(rv.Type()), kindOf(target)
+	numeric := func(k reflect.Kind) bool {
+		return k == reflect.Int || k == reflect.Uint || k == reflect.Float64
+	}
+	if from != to && !(numeric(from) && numeric(to)) || !rv.Type().ConvertibleTo(target) {
+		return fmt.Errorf("cannot assign %T to %s", value, target)
+	}
+	converted := rv.Convert(target)
+	// like the SQL backends, refuse to truncate 1.7 to 1 or wrap -1 around
+	if rv.Kind() != target.Kind() && (to == reflect.Int || to == reflect.Uint) && !converted.Convert(rv.Type()).Equal(rv) {
+		return fmt.Errorf("%v does not fit in %s", value, target)
+	}
+	field.Set(converted)
+	return nil
+}
+
+// clone returns a shallow copy of record.
+func clone[T any](record *T) *T {
+	c := *record
+	return &c
+}
@@ -0,0 +1,436 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"strconv"
+	"time"
+
+	"k8s-backend/breaker"
+	"k8s-backend/logging"
+	"k8s-backend/metrics"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// CachedDatabase keeps the records of the wrapped Database[T] in Redis, as
+// JSON under <Name>:<id>. Get reads through the cache, Insert writes through
+// it, and Update and Delete evict the record. Transactions bypass the cache
+// and evict what they wrote once committed, so it never holds uncommitted
+// data.
+//
+// Hot keys are protected from stampedes: concurrent misses on a key share a
+// single database read, and an entry may be refreshed in the background
+// shortly before it expires (see RefreshBeta), so that it rarely expires
+// under load. Lookups of missing records are cached too, for NegativeTTL.
+//
+// With ListTTL set, the results of GetAll and Count are cached as well and
+// writes evict the ones they may have changed.
+//
+// With LocalSize set, records are also kept in process, in front of Redis.
+// Writes then broadcast the keys they evict on the <Name>:invalidations
+// channel, so that every replica drops them from its own copy.
+//
+// Each record also has a generation, a counter under {<Name>:<id>}:gen that
+// evictions increment. A load only caches what it read if the generation has
+// not changed since it started, so that a read racing with a write cannot
+// cache the record as it was before it.
+//
+// Redis failures are soft: they are logged and counted, and the call is
+// served by the database as if the cache were empty. Give Client a
+// breaker.RedisHook to bypass Redis at once while it is down. An eviction that fails
+// leaves the record stale until TTL expires, or LocalTTL for a lost
+// broadcast.
+type CachedDatabase[T any] struct {
+	Database[T]
+	Client redis.UniversalClient
+	// Name prefixes the keys and labels the cache metrics, e.g. "book".
+	Name string
+	TTL  time.Duration
+	// NegativeTTL is how long a record is remembered as missing; 0 disables
+	// negative caching.
+	NegativeTTL time.Duration
+	// RefreshBeta scales the probabilistic early refresh: an entry is
+	// refreshed ahead of expiry with a probability growing as expiry nears and
+	// the slower the record was to read. 1 is the usual setting, larger values
+	// refresh earlier, 0 disables it.
+	RefreshBeta float64
+	// LocalSize is how many records are kept in process, 0 for none, and
+	// LocalTTL for how long at most.
+	LocalSize int
+	LocalTTL  time.Duration
+	// ListTTL is how long the results of GetAll and Count are cached, 0 for
+	// not at all. Writes evict the ones they may change; see listKey.
+	ListTTL time.Duration
+
+	loads         singleflight.Group
+	local         *lru[cacheEntry[T]]
+	invalidations *redis.PubSub
+	done          chan struct{}
+}
+
+// NewCached wraps db in a CachedDatabase without negative caching, early
+// refresh or in-process cache.
+func NewCached[T any](db Database[T], client redis.UniversalClient, name string, ttl time.Duration) *CachedDatabase[T] {
+	return &CachedDatabase[T]{Database: db, Client: client, Name: name, TTL: ttl}
+}
+
+// cacheEntry is what is stored under a key.
+type cacheEntry[T any] struct {
+	// Record is nil for a record known to be missing.
+	Record *T `json:"record,omitempty"`
+	// Delta is how long the record took to read and Expiry when the entry
+	// expires; they drive the early refresh.
+	Delta  time.Duration `json:"delta,omitempty"`
+	Expiry time.Time     `json:"expiry"`
+}
+
+// record returns a copy of the cached record, or ErrNotFound for a record
+// known to be missing.
+func (e cacheEntry[T]) record(id string) (*T, error) {
+	if e.Record == nil {
+		return nil, fmt.Errorf("%w: id %s", ErrNotFound, id)
+	}
+	record := *e.Record
+	return &record, nil
+}
+
+// refreshDue tells whether to refresh the entry ahead of its expiry, following
+// "Optimal Probabilistic Cache Stampede Prevention" (Vattani et al.).
+func (e *cacheEntry[T]) refreshDue(now time.Time, beta float64) bool {
+	if beta <= 0 || e.Delta <= 0 {
+		return false
+	}
+	// -ln of (0, 1] is exponentially distributed, mostly below 1
+	gap := time.Duration(float64(e.Delta) * beta * -math.Log(1-rand.Float64()))
+	return !now.Add(gap).Before(e.Expiry)
+}
+
+// Initialize initializes the wrapped database and, with an in-process cache,
+// subscribes to the invalidations of the other replicas.
+func (c *CachedDatabase[T]) Initialize() error {
+	if err := c.Database.Initialize(); err != nil {
+		return err
+	}
+	if c.LocalSize <= 0 || c.LocalTTL <= 0 {
+		return nil
+	}
+
+	c.local = newLRU[cacheEntry[T]](c.LocalSize)
+	c.invalidations = c.Client.Subscribe(context.Background(), c.channel())
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		for msg := range c.invalidations.ChannelWithSubscriptions() {
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				// invalidations may have been missed while disconnected
+				c.local.clear()
+			case *redis.Message:
+				c.loads.Forget(msg.Payload)
+				c.local.remove(msg.Payload)
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *CachedDatabase[T]) Close() error {
+	if c.invalidations != nil {
+		err := c.invalidations.Close()
+		<-c.done
+		c.invalidations = nil
+		if err != nil {
+			return errors.Join(err, c.Database.Close())
+		}
+	}
+	return c.Database.Close()
+}
+
+func (c *CachedDatabase[T]) channel() string {
+	return c.Name + ":invalidations"
+}
+
+// key returns the cache key of the record with the given id, normalized
+// like the primary key so that "01" and "1" share an entry.
+func (c *CachedDatabase[T]) key(id string) (string, error) {
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return "", err
+	}
+	pk, err := primaryKey(cols, id)
+	if err != nil {
+		return "", err
+	}
+	return c.Name + ":" + pk, nil
+}
+
+// softFail records a cache error that the call carries on without. Calls an
+// open circuit breaker kept from Redis are only counted: the breaker logs
+// the outage.
+func (c *CachedDatabase[T]) softFail(ctx context.Context, op string, err error) {
+	if errors.Is(err, breaker.ErrOpen) {
+		metrics.CacheRequests.WithLabelValues(c.Name, metrics.CacheBypass).Inc()
+		return
+	}
+	metrics.CacheRequests.WithLabelValues(c.Name, metrics.CacheError).Inc()
+	logging.FromContext(ctx).Warn("cache unavailable, using the database", "cache", c.Name, "op", op, "error", err)
+}
+
+func (c *CachedDatabase[T]) Get(ctx context.Context, id string) (*T, error) {
+	key, err := c.key(id)
+	if err != nil || txFrom(ctx) != nil {
+		// a malformed id fails in the database alike; a transaction must
+		// see its own writes
+		return c.Database.Get(ctx, id)
+	}
+
+	if entry, ok := c.fromLocal(key); ok {
+		return entry.record(id)
+	}
+
+	data, err := c.Client.Get(ctx, key).Bytes()
+	switch {
+	case err == nil:
+		var entry cacheEntry[T]
+		if err := json.Unmarshal(data, &entry); err != nil {
+			c.softFail(ctx, "decode", fmt.Errorf("decoding %s: %w", key, err))
+			break
+		}
+		if entry.refreshDue(time.Now(), c.RefreshBeta) {
+			metrics.CacheEarlyRefreshes.WithLabelValues(c.Name).Inc()
+			// nobody waits for it, and callers arriving meanwhile join it
+			c.loads.DoChan(key, func() (any, error) {
+				return c.load(context.WithoutCancel(ctx), id, key)
+			})
+		}
+		c.toLocal(key, entry)
+		if entry.Record == nil {
+			metrics.CacheRequests.WithLabelValues(c.Name, metrics.CacheNegativeHit).Inc()
+		} else {
+			metrics.CacheRequests.WithLabelValues(c.Name, metrics.CacheHit).Inc()
+		}
+		return entry.record(id)
+	case errors.Is(err, redis.Nil):
+		metrics.CacheRequests.WithLabelValues(c.Name, metrics.CacheMiss).Inc()
+	default:
+		c.softFail(ctx, "get", err)
+	}
+
+	// concurrent misses on the key wait for the first one's read; that read
+	// is not cancelled with its caller's context, as the others need it
+	var leader bool
+	loaded := c.loads.DoChan(key, func() (any, error) {
+		leader = true
+		return c.load(context.WithoutCancel(ctx), id, key)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-loaded:
+		if !leader {
+			metrics.CacheCoalesced.WithLabelValues(c.Name).Inc()
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		// each caller gets a copy of its own
+		record := res.Val.(T)
+		return &record, nil
+	}
+}
+
+// load reads the record from the database and caches it, or caches that it is
+// missing.
+func (c *CachedDatabase[T]) load(ctx context.Context, id, key string) (T, error) {
+	gen, err := c.Client.Get(ctx, generationKey(key)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		c.softFail(ctx, "get", err)
+	}
+	start := time.Now()
+	record, err := c.Database.Get(ctx, id)
+	switch {
+	case err == nil:
+		c.set(ctx, key, gen, &cacheEntry[T]{Record: record, Delta: time.Since(start)}, c.TTL)
+		return *record, nil
+	case errors.Is(err, ErrNotFound) && c.NegativeTTL > 0:
+		c.set(ctx, key, gen, &cacheEntry[T]{Delta: time.Since(start)}, c.NegativeTTL)
+	}
+	var zero T
+	return zero, err
+}
+
+func (c *CachedDatabase[T]) Insert(ctx context.Context, id string, element *T) error {
+	if err := c.Database.Insert(ctx, id, element); err != nil {
+		return err
+	}
+	c.invalidateLists(ctx, "all")
+
+	// the primary key is only known once inserted
+	if cols, err := columnsOf[T](); err == nil && cols.primaryKey != nil {
+		id = fmt.Sprint(reflect.ValueOf(element).Elem().FieldByName(cols.primaryKey.Field).Interface())
+	}
+	key, err := c.key(id)
+	if err != nil {
+		return nil
+	}
+	if txFrom(ctx) != nil {
+		// the record may still be rolled back: evict the negative entry
+		// once it no longer is
+		afterCommit(ctx, func() { c.evict(context.WithoutCancel(ctx), key) })
+		return nil
+	}
+	// other replicas, and loads under way, may remember the record as
+	// missing
+	gen := c.evict(ctx, key)
+	// the caller keeps element and may go on changing it
+	record := *element
+	c.set(ctx, key, gen, &cacheEntry[T]{Record: &record}, c.TTL)
+	return nil
+}
+
+func (c *CachedDatabase[T]) Update(ctx context.Context, id string, fields map[string]any) error {
+	if err := c.Database.Update(ctx, id, fields); err != nil {
+		return err
+	}
+	c.invalidateLists(ctx, updateTags[T](id, fields)...)
+	c.evictAfterCommit(ctx, id)
+	return nil
+}
+
+func (c *CachedDatabase[T]) Delete(ctx context.Context, id string) error {
+	if err := c.Database.Delete(ctx, id); err != nil {
+		return err
+	}
+	c.invalidateLists(ctx, "all")
+	c.evictAfterCommit(ctx, id)
+	return nil
+}
+
+// generationKey returns the key of the generation of the record under key,
+// in the same Redis Cluster slot.
+func generationKey(key string) string {
+	return "{" + key + "}:gen"
+}
+
+// setEntry stores an entry unless the record was evicted since it was read.
+//
+// KEYS[1] record key, KEYS[2] its generation
+// ARGV[1] generation the record was read at, ARGV[2] entry, ARGV[3] TTL (ms)
+// returns 1 if stored, 0 if the generation changed
+var setEntry = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '') ~= ARGV[1] then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// evictEntry deletes an entry and increments the record's generation, which
+// outlives any load under way.
+//
+// KEYS[1] record key, KEYS[2] its generation
+// ARGV[1] TTL of the generation (ms)
+// returns the new generation
+var evictEntry = redis.NewScript(`
+redis.call('DEL', KEYS[1])
+local gen = redis.call('INCR', KEYS[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[1])
+return gen
+`)
+
+// set caches entry unless the record was evicted since gen, the generation
+// it was read at.
+func (c *CachedDatabase[T]) set(ctx context.Context, key, gen string, entry *cacheEntry[T], ttl time.Duration) {
+	entry.Expiry = time.Now().Add(ttl)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		c.softFail(ctx, "encode", fmt.Errorf("encoding %s: %w", key, err))
+		return
+	}
+	stored, err := setEntry.Run(ctx, c.Client, []string{key, generationKey(key)}, gen, data, ttl.Milliseconds()).Bool()
+	if err != nil {
+		// the record may have been evicted meanwhile, and without Redis
+		// no invalidation would reach this replica
+		c.softFail(ctx, "set", err)
+		return
+	}
+	if stored {
+		c.toLocal(key, *entry)
+	}
+}
+
+// evict removes the record from the caches of every replica and keeps the
+// loads under way from caching it again. It returns the record's new
+// generation.
+func (c *CachedDatabase[T]) evict(ctx context.Context, key string) string {
+	// later calls must not join a load that started before
+	c.loads.Forget(key)
+	gen, err := evictEntry.Run(ctx, c.Client, []string{key, generationKey(key)}, c.TTL.Milliseconds()).Int64()
+	if err != nil {
+		// 0 is no generation: nothing read meanwhile is cached in Redis
+		c.softFail(ctx, "del", err)
+	}
+	c.broadcast(ctx, key)
+	return strconv.FormatInt(gen, 10)
+}
+
+// broadcast has the other replicas drop key from their in-process caches.
+func (c *CachedDatabase[T]) broadcast(ctx context.Context, key string) {
+	if c.local == nil {
+		return
+	}
+	c.local.remove(key)
+	if err := c.Client.Publish(ctx, c.channel(), key).Err(); err != nil {
+		c.softFail(ctx, "publish", err)
+	}
+}
+
+func (c *CachedDatabase[T]) fromLocal(key string) (cacheEntry[T], bool) {
+	if c.local == nil {
+		return cacheEntry[T]{}, false
+	}
+	entry, ok := c.local.get(key, time.Now())
+	switch {
+	case !ok:
+		metrics.CacheRequests.WithLabelValues(c.Name+".local", metrics.CacheMiss).Inc()
+	case entry.Record == nil:
+		metrics.CacheRequests.WithLabelValues(c.Name+".local", metrics.CacheNegativeHit).Inc()
+	default:
+		metrics.CacheRequests.WithLabelValues(c.Name+".local", metrics.CacheHit).Inc()
+	}
+	return entry, ok
+}
+
+// toLocal keeps entry in process for LocalTTL, or until it expires in Redis
+// if sooner.
+func (c *CachedDatabase[T]) toLocal(key string, entry cacheEntry[T]) {
+	if c.local == nil {
+		return
+	}
+	expiry := time.Now().Add(c.LocalTTL)
+	if entry.Expiry.Before(expiry) {
+		expiry = entry.Expiry
+	}
+	c.local.add(key, entry, expiry)
+}
+
+// evictAfterCommit evicts the record now and, in a transaction, once more
+// after the commit, dropping what a concurrent Get cached from the data the
+// transaction was changing.
+func (c *CachedDatabase[T]) evictAfterCommit(ctx context.Context, id string) {
+	key, err := c.key(id)
+	if err != nil {
+		return
+	}
+	c.evict(ctx, key)
+	if txFrom(ctx) != nil {
+		afterCommit(ctx, func() { c.evict(context.WithoutCancel(ctx), key) })
+	}
+}
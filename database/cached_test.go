@@ -0,0 +1,420 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s-backend/metrics"
+	m "k8s-backend/model"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+// countedGets counts the reads reaching the database and, once they are
+// done, holds them until release is closed, if set. It counts listings in
+// lists.
+type countedGets struct {
+	Database[m.Book]
+	calls   atomic.Int32
+	lists   atomic.Int32
+	release chan struct{}
+}
+
+func (c *countedGets) GetAll(ctx context.Context, f *m.Filters[m.Book]) ([]*m.Book, error) {
+	books, err := c.Database.GetAll(ctx, f)
+	c.lists.Add(1)
+	if c.release != nil {
+		<-c.release
+	}
+	return books, err
+}
+
+func (c *countedGets) Get(ctx context.Context, id string) (*m.Book, error) {
+	book, err := c.Database.Get(ctx, id)
+	c.calls.Add(1)
+	if c.release != nil {
+		<-c.release
+	}
+	return book, err
+}
+
+func cachedBooks(t *testing.T) (*CachedDatabase[m.Book], *countedGets, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	backend := &countedGets{Database: seededBooks(t)}
+	return NewCached[m.Book](backend, client, "book", time.Hour), backend, mr
+}
+
+// cached returns the entry under key, nil if there is none.
+func cached(t *testing.T, mr *miniredis.Miniredis, key string) *cacheEntry[m.Book] {
+	t.Helper()
+	if !mr.Exists(key) {
+		return nil
+	}
+	data, err := mr.Get(key)
+	require.NoError(t, err)
+	var entry cacheEntry[m.Book]
+	require.NoError(t, json.Unmarshal([]byte(data), &entry))
+	return &entry
+}
+
+func setCached(t *testing.T, mr *miniredis.Miniredis, key string, entry cacheEntry[m.Book]) {
+	t.Helper()
+	data, err := json.Marshal(entry)
+	require.NoError(t, err)
+	require.NoError(t, mr.Set(key, string(data)))
+}
+
+func TestCachedReadsThrough(t *testing.T) {
+	c, backend, mr := cachedBooks(t)
+	ctx := t.Context()
+
+	book, err := c.Get(ctx, "01")
+	require.NoError(t, err)
+	require.Equal(t, "QM", book.Title)
+	// ids are normalized like primary keys
+	entry := cached(t, mr, "book:1")
+	require.NotNil(t, entry)
+	require.Equal(t, "QM", entry.Record.Title)
+	require.Equal(t, time.Hour, mr.TTL("book:1"))
+
+	// served from Redis from now on
+	setCached(t, mr, "book:1", cacheEntry[m.Book]{Record: &m.Book{Id: 1, Title: "cached"}, Expiry: time.Now().Add(time.Hour)})
+	book, err = c.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, "cached", book.Title)
+	require.Equal(t, int32(1), backend.calls.Load())
+
+	// an entry that cannot be decoded is a miss
+	require.NoError(t, mr.Set("book:1", "{"))
+	book, err = c.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, "QM", book.Title)
+
+	_, err = c.Get(ctx, "x")
+	require.ErrorIs(t, err, ErrValidation)
+}
+
+func TestCachedWritesEvict(t *testing.T) {
+	c, _, mr := cachedBooks(t)
+	ctx := t.Context()
+
+	book := &m.Book{Title: "SR", Author: "Einstein"}
+	require.NoError(t, c.Insert(ctx, "", book))
+	require.Equal(t, book, cached(t, mr, "book:4").Record)
+
+	_, err := c.Get(ctx, "2")
+	require.NoError(t, err)
+	require.NoError(t, c.Update(ctx, "2", map[string]any{"price": 1.5}))
+	require.False(t, mr.Exists("book:2"))
+	book, err = c.Get(ctx, "2")
+	require.NoError(t, err)
+	require.Equal(t, 1.5, book.Price)
+
+	require.NoError(t, c.Delete(ctx, "2"))
+	require.False(t, mr.Exists("book:2"))
+	_, err = c.Get(ctx, "2")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCachedTransactions(t *testing.T) {
+	c, _, mr := cachedBooks(t)
+	ctx := t.Context()
+
+	// neither a rolled back insert nor the data a transaction read is cached
+	err := c.WithTx(ctx, nil, func(tx Tx) error {
+		if err := c.Insert(tx.Context(), "", &m.Book{Title: "SR"}); err != nil {
+			return err
+		}
+		if _, err := c.Get(tx.Context(), "1"); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	require.EqualError(t, err, "abort")
+	require.Empty(t, mr.Keys())
+
+	// an update evicts again on commit what was cached meanwhile
+	err = c.WithTx(ctx, nil, func(tx Tx) error {
+		if err := c.Update(tx.Context(), "1", map[string]any{"price": 2.0}); err != nil {
+			return err
+		}
+		setCached(t, mr, "book:1", cacheEntry[m.Book]{Record: &m.Book{Id: 1, Title: "QM", Price: 10.99}, Expiry: time.Now().Add(time.Hour)})
+		return nil
+	})
+	require.NoError(t, err)
+	book, err := c.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, 2.0, book.Price)
+}
+
+func TestCachedSurvivesRedisOutage(t *testing.T) {
+	c, _, mr := cachedBooks(t)
+	ctx := t.Context()
+	mr.Close()
+
+	book, err := c.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, "QM", book.Title)
+	require.NoError(t, c.Insert(ctx, "", &m.Book{Title: "SR"}))
+	require.NoError(t, c.Update(ctx, "1", map[string]any{"price": 2.0}))
+	require.NoError(t, c.Delete(ctx, "1"))
+}
+
+func TestCachedCoalescesMisses(t *testing.T) {
+	c, backend, _ := cachedBooks(t)
+	backend.release = make(chan struct{})
+	misses := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("book", metrics.CacheMiss))
+	coalesced := testutil.ToFloat64(metrics.CacheCoalesced.WithLabelValues("book"))
+
+	const callers = 8
+	var wg sync.WaitGroup
+	books := make([]*m.Book, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			book, err := c.Get(t.Context(), "1")
+			if err != nil {
+				t.Errorf("Get: %v", err)
+			}
+			books[i] = book
+		}()
+	}
+
+	// let every caller miss and join the read before it completes
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("book", metrics.CacheMiss))-misses == callers
+	}, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), backend.calls.Load())
+	require.Equal(t, float64(callers-1), testutil.ToFloat64(metrics.CacheCoalesced.WithLabelValues("book"))-coalesced)
+	// callers do not share the record
+	books[0].Title = "changed"
+	require.Equal(t, "QM", books[1].Title)
+}
+
+func TestCachedLoadsRacingWrites(t *testing.T) {
+	c, backend, mr := cachedBooks(t)
+	ctx := t.Context()
+	get := func() <-chan *m.Book {
+		got := make(chan *m.Book, 1)
+		go func() {
+			book, err := c.Get(ctx, "1")
+			if err != nil {
+				t.Errorf("Get: %v", err)
+			}
+			got <- book
+		}()
+		return got
+	}
+	read := func(n int32) {
+		require.Eventually(t, func() bool { return backend.calls.Load() == n }, time.Second, time.Millisecond)
+	}
+
+	// a Get reads the record, then an update commits before it caches it
+	backend.release = make(chan struct{})
+	stale := get()
+	read(1)
+	require.NoError(t, c.Update(ctx, "1", map[string]any{"price": 2.0}))
+	close(backend.release)
+	require.Equal(t, 10.99, (<-stale).Price)
+	require.Nil(t, cached(t, mr, "book:1"))
+	book, err := c.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, 2.0, book.Price)
+	require.Equal(t, 2.0, cached(t, mr, "book:1").Record.Price)
+
+	// a Get after the update reads again instead of joining the stale read
+	backend.release = make(chan struct{})
+	require.NoError(t, c.Update(ctx, "1", map[string]any{"price": 3.0}))
+	stale = get()
+	read(3)
+	require.NoError(t, c.Update(ctx, "1", map[string]any{"price": 4.0}))
+	fresh := get()
+	read(4)
+	close(backend.release)
+	require.Equal(t, 3.0, (<-stale).Price)
+	require.Equal(t, 4.0, (<-fresh).Price)
+	require.Equal(t, 4.0, cached(t, mr, "book:1").Record.Price)
+}
+
+func TestCachedRemembersMissingRecords(t *testing.T) {
+	c, backend, mr := cachedBooks(t)
+	c.NegativeTTL = time.Minute
+	ctx := t.Context()
+
+	for range 3 {
+		_, err := c.Get(ctx, "42")
+		require.ErrorIs(t, err, ErrNotFound)
+	}
+	require.Equal(t, int32(1), backend.calls.Load())
+	require.Nil(t, cached(t, mr, "book:42").Record)
+	require.Equal(t, time.Minute, mr.TTL("book:42"))
+
+	// inserting the record replaces the negative entry
+	require.NoError(t, c.Insert(ctx, "", &m.Book{Id: 42, Title: "SR"}))
+	book, err := c.Get(ctx, "42")
+	require.NoError(t, err)
+	require.Equal(t, "SR", book.Title)
+
+	// without NegativeTTL, nothing is remembered
+	c.NegativeTTL = 0
+	_, err = c.Get(ctx, "43")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.False(t, mr.Exists("book:43"))
+}
+
+func TestCachedRefreshesEarly(t *testing.T) {
+	c, backend, mr := cachedBooks(t)
+	c.RefreshBeta = 1
+
+	// an entry that was slow to read and is about to expire
+	setCached(t, mr, "book:1", cacheEntry[m.Book]{
+		Record: &m.Book{Id: 1, Title: "stale"},
+		Delta:  time.Hour,
+		Expiry: time.Now().Add(time.Second),
+	})
+
+	book, err := c.Get(t.Context(), "1")
+	require.NoError(t, err)
+	require.Equal(t, "stale", book.Title, "the caller does not wait for the refresh")
+	require.Eventually(t, func() bool {
+		entry := cached(t, mr, "book:1")
+		return entry != nil && entry.Record.Title == "QM"
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int32(1), backend.calls.Load())
+}
+
+func TestRefreshDue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		entry cacheEntry[m.Book]
+		beta  float64
+		want  bool
+	}{
+		{"Far from expiry", cacheEntry[m.Book]{Delta: time.Millisecond, Expiry: now.Add(time.Hour)}, 1, false},
+		{"Expired", cacheEntry[m.Book]{Delta: time.Millisecond, Expiry: now}, 1, true},
+		{"Slow read close to expiry", cacheEntry[m.Book]{Delta: time.Hour, Expiry: now.Add(time.Millisecond)}, 1, true},
+		{"Disabled", cacheEntry[m.Book]{Delta: time.Hour, Expiry: now}, 0, false},
+		{"Written through", cacheEntry[m.Book]{Expiry: now}, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.entry.refreshDue(now, tt.beta))
+		})
+	}
+}
+
+// replica returns a CachedDatabase with an in-process cache, as run by one
+// replica of the service: its own Redis client and in-process cache, and the
+// database and Redis server shared with the other replicas.
+func replica(t *testing.T, backend Database[m.Book], mr *miniredis.Miniredis) *CachedDatabase[m.Book] {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	c := &CachedDatabase[m.Book]{
+		Database:    backend,
+		Client:      client,
+		Name:        "book",
+		TTL:         time.Hour,
+		NegativeTTL: time.Minute,
+		LocalSize:   10,
+		LocalTTL:    time.Hour,
+	}
+	require.NoError(t, c.Initialize())
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCachedInProcess(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backend := &countedGets{Database: seededBooks(t)}
+	a := replica(t, backend, mr)
+	ctx := t.Context()
+
+	book, err := a.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, "QM", book.Title)
+	inserted := &m.Book{Title: "SR"}
+	require.NoError(t, a.Insert(ctx, "", inserted))
+
+	// served in process, without Redis
+	mr.Close()
+	book, err = a.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, "QM", book.Title)
+	require.Equal(t, int32(1), backend.calls.Load())
+
+	// a caller changing its copy does not change the cached one
+	book.Title = "changed"
+	book, err = a.Get(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, "QM", book.Title)
+
+	// nor does one changing the record it inserted
+	inserted.Title = "changed"
+	book, err = a.Get(ctx, "4")
+	require.NoError(t, err)
+	require.Equal(t, "SR", book.Title)
+	require.Equal(t, int32(1), backend.calls.Load())
+
+	// what cannot be checked against evictions is not kept in process
+	_, err = a.Get(ctx, "2")
+	require.NoError(t, err)
+	_, err = a.Get(ctx, "2")
+	require.NoError(t, err)
+	require.Equal(t, int32(3), backend.calls.Load())
+}
+
+func TestCachedInvalidatesReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	backend := seededBooks(t)
+	replicas := []*CachedDatabase[m.Book]{replica(t, backend, mr), replica(t, backend, mr), replica(t, backend, mr)}
+	ctx := t.Context()
+
+	// every replica caches book 1 and that book 42 is missing
+	for _, r := range replicas {
+		_, err := r.Get(ctx, "1")
+		require.NoError(t, err)
+		_, err = r.Get(ctx, "42")
+		require.ErrorIs(t, err, ErrNotFound)
+		require.Equal(t, 2, r.local.len())
+	}
+
+	// writes on one replica evict the entries of all of them
+	require.NoError(t, replicas[0].Update(ctx, "1", map[string]any{"price": 2.0}))
+	require.NoError(t, replicas[1].Insert(ctx, "", &m.Book{Id: 42, Title: "SR"}))
+	for i, r := range replicas {
+		require.Eventually(t, func() bool {
+			book, err := r.Get(ctx, "1")
+			if err != nil || book.Price != 2.0 {
+				return false
+			}
+			book, err = r.Get(ctx, "42")
+			return err == nil && book.Title == "SR"
+		}, time.Second, time.Millisecond, "replica %d", i)
+	}
+
+	require.NoError(t, replicas[2].Delete(ctx, "1"))
+	for i, r := range replicas {
+		require.Eventually(t, func() bool {
+			_, err := r.Get(ctx, "1")
+			return errors.Is(err, ErrNotFound)
+		}, time.Second, time.Millisecond, "replica %d", i)
+	}
+}
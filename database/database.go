@@ -1,13 +1,13 @@
 package database
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"log/slog"
-	"reflect"
-	"strings"
-	"sync"
 
+	"k8s-backend/config"
+	"k8s-backend/database/migrate"
+	"k8s-backend/metrics"
 	m "k8s-backend/model"
 
 	"gorm.io/driver/postgres"
@@ -16,228 +16,186 @@ import (
 
 type Database[T any] interface {
 	Initialize() error
-	Close()
-	Get(id string) (*T, error)
-	GetAll(f *m.Filters[T]) ([]*T, error)
-	Insert(id string, element *T) error
-	Update(id string, fields map[string]any) error
-	Delete(id string) error
-}
-
-type Postgres[T any] struct {
-	DB           *gorm.DB
-	InitElements []T
-	sync.Mutex
-}
-
-func (p *Postgres[T]) Initialize() error {
-	dsn := "host=localhost user=carloslara password=postgres dbname=postgres port=5432 sslmode=disable"
-
-	var err error
-	p.DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	Close() error
+	Ping(ctx context.Context) error
+	Get(ctx context.Context, id string) (*T, error)
+	GetAll(ctx context.Context, f *m.Filters[T]) ([]*T, error)
+	Count(ctx context.Context, where []m.Condition, mode CountMode) (int64, error)
+	Insert(ctx context.Context, id string, element *T) error
+	// Update sets fields, named by column or Go field name, on the record
+	// id. Unknown columns, the primary key and fields tagged
+	// gorm:"<-:create" fail with ErrValidation.
+	Update(ctx context.Context, id string, fields map[string]any) error
+	Delete(ctx context.Context, id string) error
+	// Seed inserts the backend's InitElements that are missing: the i-th one
+	// unless a record with id i+1 exists. It is idempotent, so every replica
+	// may run it on start.
+	Seed(ctx context.Context) error
+	// WithTx runs fn as one atomic unit of work, see Tx. It commits when fn
+	// returns nil and rolls back otherwise, retrying fn on serialization
+	// failures as opts allow. Called with the context of a transaction the
+	// backend can join, it runs fn in a savepoint of that transaction.
+	WithTx(ctx context.Context, opts *TxOptions, fn func(tx Tx) error) error
+}
+
+// New returns the instrumented backend selected by cfg.Database.Driver,
+// which Seed fills with initElements.
+func New[T any](cfg *config.Config, initElements []T) Database[T] {
+	manual := !cfg.Database.AutoMigrate
+	switch cfg.Database.Driver {
+	case "sqlite":
+		return Instrument[T]("sqlite", &SQLite[T]{Config: cfg.SQLite, InitElements: initElements, ManualMigrations: manual})
+	default:
+		return Instrument[T]("postgres", &Postgres[T]{Config: cfg.Postgres, InitElements: initElements, ManualMigrations: manual})
+	}
+}
+
+// OpenMigrator opens a connection to the database selected by
+// cfg.Database.Driver for a migrate.Migrator. Close its DB when done.
+func OpenMigrator(cfg *config.Config) (*migrate.Migrator, error) {
+	var (
+		db  *gorm.DB
+		err error
+	)
+	switch cfg.Database.Driver {
+	case "sqlite":
+		db, err = openSQLite(cfg.SQLite)
+	default:
+		db, err = openPostgres(cfg.Postgres)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if err = p.DB.AutoMigrate(new(T)); err != nil {
-		return err
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
 	}
-
-	for i, e := range p.InitElements {
-		var existing T
-		result := p.DB.First(&existing, i+1)
-		if result.RowsAffected == 0 {
-			if err := p.DB.Create(&e).Error; err != nil {
-				return err
-			}
-		}
+	mig, err := migrate.New(sqlDB, db.Dialector.Name())
+	if err != nil {
+		return nil, errors.Join(err, sqlDB.Close())
 	}
-
-	slog.Info("Database connection established")
-
-	return nil
+	return mig, nil
 }
 
-func (p *Postgres[T]) Close() {
-	sqlDB, err := p.DB.DB()
+// Postgres is a Database[T] on a Postgres server. It is safe for concurrent
+// use: each call borrows a connection from the pool, sized by Config.
+type Postgres[T any] struct {
+	// DB, when set before Initialize, is the connection of another backend,
+	// shared so that transactions can span both. Close leaves it open.
+	DB           *gorm.DB
+	Config       config.Postgres
+	InitElements []T
+	// ManualMigrations makes Initialize check that the schema is up to date
+	// instead of migrating it, when `migrate up` runs as a deployment step.
+	ManualMigrations bool
+	// Migrations create and evolve the table of T, for a model the embedded
+	// migrations do not cover; nil runs the embedded ones. Initialize fails
+	// if T's table is still missing after migrating.
+	Migrations []migrate.Migration
+
+	shared       bool
+	unexportPool func()
+}
+
+// openPostgres connects to the database and sizes the connection pool.
+func openPostgres(cfg config.Postgres) (*gorm.DB, error) {
+	db, err := gorm.Open(postgres.Open(cfg.DSN()), &gorm.Config{
+		Logger:      NewGormLogger(cfg.SlowQueryThreshold),
+		PrepareStmt: cfg.PrepareStatements,
+	})
 	if err != nil {
-		slog.Error(err.Error())
-	}
-	if err := sqlDB.Close(); err != nil {
-		slog.Error(err.Error())
+		return nil, err
 	}
-}
-
-func (p *Postgres[T]) Get(id string) (*T, error) {
-	p.Lock()
-	defer p.Unlock()
-
-	var record T
-	if err := p.DB.First(&record, id).Error; err != nil {
+	sqlDB, err := db.DB()
+	if err != nil {
 		return nil, err
 	}
-	return &record, nil
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+	return db, nil
 }
 
-func (p *Postgres[T]) GetAll(f *m.Filters[T]) ([]*T, error) {
-	p.Lock()
-	defer p.Unlock()
-
-	t := reflect.TypeOf(*f.Model)
-	v := reflect.ValueOf(*f.Model)
-
-	if t.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("invalid model: %v", t.Kind().String())
-	}
-
-	query := p.DB.Model(new(T))
-	query = query.Order(f.SortBy + " " + f.Order)
-
-	for i := range t.NumField() {
-		field := t.Field(i)
-		value := v.Field(i)
-
-		if !value.CanInterface() {
-			continue
+func (p *Postgres[T]) Initialize() error {
+	if p.DB != nil {
+		p.shared = true
+	} else {
+		var err error
+		if p.DB, err = openPostgres(p.Config); err != nil {
+			return err
 		}
-		fieldValue := value.Interface()
-
-		switch f := fieldValue.(type) {
-		case string:
-			if f != "" {
-				query = query.Where(fmt.Sprintf("LOWER(%s) ILIKE ?", field.Name), "%"+strings.ToLower(f)+"%")
-			}
-		case float64:
-			if f > 0 {
-				query = query.Where(fmt.Sprintf("%s >= ?", field.Name), f)
-			}
-		case int:
-			if column := strings.ToLower(field.Name); column != "id" {
-				query = query.Where(fmt.Sprintf("%s >= ?", column), f)
-			}
-		default:
-			return nil, fmt.Errorf("model field data type not supported: %v", f)
+		sqlDB, err := p.DB.DB()
+		if err != nil {
+			return err
 		}
-	}
 
-	query = query.Debug() // Enable SQL logging
-
-	var records []*T
-	if err := query.Limit(f.Limit).Offset(f.Offset).Find(&records).Error; err != nil {
-		return nil, fmt.Errorf("error finding records: %w", err)
+		// a shared pool is exported by the backend that opened it
+		table, err := tableOf[T]()
+		if err != nil {
+			return err
+		}
+		p.unexportPool = metrics.RegisterDBPool("postgres."+table, sqlDB.Stats)
 	}
 
-	return records, nil
-}
-
-func (p *Postgres[T]) Insert(_ string, element *T) error {
-	p.Lock()
-	defer p.Unlock()
-
-	// GORM handles primary key auto-increment
-	if err := p.DB.Create(element).Error; err != nil {
+	if err := migrateSchema[T](context.Background(), p.DB, p.ManualMigrations, p.Migrations); err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (p *Postgres[T]) Update(id string, fields map[string]any) error {
-	p.Lock()
-	defer p.Unlock()
+	slog.Info("Database connection established")
 
-	// `db.Model(&Post{}).Where("id = ?", id).Updates(updates)` updates the fields in the database.
-	// `updates` contains the fields and values to be updated for the post with the specified ID.
-	if err := p.DB.Model(new(T)).Where("id = ?", id).Updates(fields).Error; err != nil {
-		return err
-	}
 	return nil
 }
 
-func (p *Postgres[T]) Delete(id string) error {
-	p.Lock()
-	defer p.Unlock()
+func (p *Postgres[T]) store() *sqlStore[T] {
+	return &sqlStore[T]{db: p.DB, timeout: p.Config.QueryTimeout, translate: postgresError}
+}
 
-	if err := p.DB.Delete(new(T), id).Error; err != nil {
-		return err
+func (p *Postgres[T]) Close() error {
+	if p.shared {
+		return nil
 	}
-	return nil
+	if p.unexportPool != nil {
+		p.unexportPool()
+	}
+	return p.store().close()
 }
 
-type Cache[T any] struct {
-	Data map[string]*T
-	sync.Mutex
+func (p *Postgres[T]) Seed(ctx context.Context) error {
+	return p.store().seed(ctx, p.InitElements)
 }
 
-func (c *Cache[T]) Initialize() error {
-	c.Data = map[string]*T{
-		"0": new(T),
-		"1": new(T),
-		"2": new(T),
-	}
-	return nil
+func (p *Postgres[T]) Ping(ctx context.Context) error {
+	return p.store().Ping(ctx)
 }
 
-func (c *Cache[T]) Close() {
-	clear(c.Data)
+func (p *Postgres[T]) Get(ctx context.Context, id string) (*T, error) {
+	return p.store().Get(ctx, id)
 }
 
-func (c *Cache[T]) Get(id string) (*T, error) {
-	c.Lock()
-	defer c.Unlock()
-	element := c.Data[id]
-	if element == nil {
-		return nil, errors.New("record not found")
-	}
-	return element, nil
+func (p *Postgres[T]) GetAll(ctx context.Context, f *m.Filters[T]) ([]*T, error) {
+	return p.store().GetAll(ctx, f)
 }
 
-func (c *Cache[T]) GetAll(f *m.Filters[T]) ([]*T, error) {
-	c.Lock()
-	defer c.Unlock()
-
-	var records []*T
-	skipped := 0
+// Count counts the records matching where. CountEstimate returns the
+// planner's row estimate, computed from table statistics, instead of
+// scanning; it is only as fresh as the last ANALYZE.
+func (p *Postgres[T]) Count(ctx context.Context, where []m.Condition, mode CountMode) (int64, error) {
+	return p.store().Count(ctx, where, mode)
+}
 
-	for _, v := range c.Data {
-		if skipped < f.Offset {
-			skipped++
-			continue
-		}
-		if len(records) == f.Limit {
-			break
-		}
-		records = append(records, v)
-	}
-	return records, nil
+func (p *Postgres[T]) Insert(ctx context.Context, id string, element *T) error {
+	return p.store().Insert(ctx, id, element)
 }
 
-func (c *Cache[T]) Insert(id string, element *T) error {
-	c.Lock()
-	defer c.Unlock()
-	if e := c.Data[id]; e == nil {
-		c.Data[id] = element
-		return nil
-	}
-	return fmt.Errorf("%s already exists", id)
+func (p *Postgres[T]) Update(ctx context.Context, id string, fields map[string]any) error {
+	return p.store().Update(ctx, id, fields)
 }
 
-func (c *Cache[T]) Update(id string, fields map[string]any) error {
-	c.Lock()
-	defer c.Unlock()
-	if e := c.Data[id]; e == nil {
-		return fmt.Errorf("%s does not exist", id)
-	}
-	c.Data[id] = new(T) // mock
-	return nil
+func (p *Postgres[T]) Delete(ctx context.Context, id string) error {
+	return p.store().Delete(ctx, id)
 }
 
-func (c *Cache[T]) Delete(id string) error {
-	c.Lock()
-	defer c.Unlock()
-	if e := c.Data[id]; e == nil {
-		return fmt.Errorf("%s does not exist", id)
-	}
-	delete(c.Data, id)
-	return nil
+func (p *Postgres[T]) WithTx(ctx context.Context, opts *TxOptions, fn func(tx Tx) error) error {
+	return p.store().WithTx(ctx, opts, fn)
 }
@@ -0,0 +1,284 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"k8s-backend/config"
+	"k8s-backend/database/migrate"
+	m "k8s-backend/model"
+
+	"github.com/glebarez/sqlite"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func seededBooks(t *testing.T) *Cache[m.Book] {
+	t.Helper()
+	c := &Cache[m.Book]{InitElements: []m.Book{
+		{Title: "QM", Author: "Bohr", Price: 10.99},
+		{Title: "QFT", Author: "Dirac", Price: 11.99},
+		{Title: "GR", Author: "Einstein", Price: 12.99},
+	}}
+	require.NoError(t, c.Initialize())
+	require.NoError(t, c.Seed(t.Context()))
+	return c
+}
+
+func TestCacheHonoursCancellation(t *testing.T) {
+	c := seededBooks(t)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	_, err := c.Get(ctx, "1")
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = c.GetAll(ctx, &m.Filters[m.Book]{Limit: 10})
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, c.Insert(ctx, "", &m.Book{Title: "SR"}), context.Canceled)
+	require.ErrorIs(t, c.Update(ctx, "1", map[string]any{"title": "QED"}), context.Canceled)
+	require.ErrorIs(t, c.Delete(ctx, "1"), context.Canceled)
+
+	// nothing was applied
+	book, err := c.Get(t.Context(), "1")
+	require.NoError(t, err)
+	require.Equal(t, "QM", book.Title)
+	_, err = c.Get(t.Context(), "4")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCacheSentinelErrors(t *testing.T) {
+	c := seededBooks(t)
+	ctx := t.Context()
+
+	_, err := c.Get(ctx, "42")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = c.Get(ctx, "abc")
+	require.ErrorIs(t, err, ErrValidation)
+	require.ErrorIs(t, c.Update(ctx, "42", map[string]any{"title": "QED"}), ErrNotFound)
+	require.ErrorIs(t, c.Delete(ctx, "42"), ErrNotFound)
+	require.ErrorIs(t, c.Insert(ctx, "", &m.Book{Title: "QM"}), ErrConflict)
+	require.ErrorIs(t, c.Insert(ctx, "", &m.Book{Id: 2, Title: "SR"}), ErrConflict)
+	require.ErrorIs(t, c.Update(ctx, "1", map[string]any{"title": "QFT"}), ErrConflict)
+	require.ErrorIs(t, c.Update(ctx, "1", map[string]any{"isbn": "123"}), ErrValidation)
+	require.ErrorIs(t, c.Update(ctx, "1", map[string]any{"price": "cheap"}), ErrValidation)
+	require.ErrorIs(t, c.Update(ctx, "1", map[string]any{"id": float64(7)}), ErrValidation)
+
+	// as the SQL backends, whole numbers only for integer columns
+	shelves := &Cache[shelf]{InitElements: []shelf{{Books: 3}}}
+	require.NoError(t, shelves.Initialize())
+	require.NoError(t, shelves.Seed(ctx))
+	require.ErrorIs(t, shelves.Update(ctx, "1", map[string]any{"books": 1.7}), ErrValidation)
+	require.ErrorIs(t, shelves.Update(ctx, "1", map[string]any{"books": -1.0}), ErrValidation)
+	require.NoError(t, shelves.Update(ctx, "1", map[string]any{"books": float64(7)}))
+}
+
+// shelf has an integer column besides its primary key.
+type shelf struct {
+	Id    int `gorm:"primaryKey"`
+	Books uint
+}
+
+func TestCacheInsertAssignsIDs(t *testing.T) {
+	c := seededBooks(t)
+	ctx := t.Context()
+
+	book := &m.Book{Title: "SR", Author: "Einstein"}
+	require.NoError(t, c.Insert(ctx, "", book))
+	require.Equal(t, 4, book.Id)
+
+	// explicit ids are kept and later ids continue after them
+	require.NoError(t, c.Insert(ctx, "", &m.Book{Id: 10, Title: "QED"}))
+	next := &m.Book{Title: "QCD"}
+	require.NoError(t, c.Insert(ctx, "", next))
+	require.Equal(t, 11, next.Id)
+
+	// the stored record is a copy
+	book.Title = "changed"
+	stored, err := c.Get(ctx, "4")
+	require.NoError(t, err)
+	require.Equal(t, "SR", stored.Title)
+	stored.Title = "changed"
+	stored, err = c.Get(ctx, "4")
+	require.NoError(t, err)
+	require.Equal(t, "SR", stored.Title)
+}
+
+func TestCacheUpdateIsPartial(t *testing.T) {
+	c := seededBooks(t)
+	ctx := t.Context()
+
+	// as decoded from a JSON request body
+	require.NoError(t, c.Update(ctx, "2", map[string]any{"price": float64(9), "Author": "P. Dirac"}))
+
+	book, err := c.Get(ctx, "2")
+	require.NoError(t, err)
+	require.Equal(t, m.Book{Id: 2, Title: "QFT", Author: "P. Dirac", Price: 9}, *book)
+}
+
+func TestCacheSeedingIsIdempotent(t *testing.T) {
+	c := seededBooks(t)
+	require.NoError(t, c.Delete(t.Context(), "3"))
+	require.NoError(t, c.Seed(t.Context()))
+
+	n, err := c.Count(t.Context(), nil, CountExact)
+	require.NoError(t, err)
+	// like Postgres[T], only the missing id is seeded again
+	require.Equal(t, int64(3), n)
+}
+
+func TestSQLiteSeedingIsIdempotent(t *testing.T) {
+	cfg := config.SQLite{Path: filepath.Join(t.TempDir(), "books.db")}
+	books := seededBooks(t).InitElements
+
+	s := &SQLite[m.Book]{Config: cfg, InitElements: books}
+	require.NoError(t, s.Initialize())
+	require.NoError(t, s.Seed(t.Context()))
+	require.NoError(t, s.Delete(t.Context(), "3"))
+	require.NoError(t, s.Update(t.Context(), "1", map[string]any{"price": 1.0}))
+	require.NoError(t, s.Close())
+
+	// a restart seeds the missing id again and leaves the others alone
+	s = &SQLite[m.Book]{Config: cfg, InitElements: books}
+	require.NoError(t, s.Initialize())
+	defer s.Close()
+	require.NoError(t, s.Seed(t.Context()))
+
+	all, err := s.GetAll(t.Context(), &m.Filters[m.Book]{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	require.Equal(t, 1.0, all[0].Price)
+	require.Equal(t, "GR", all[2].Title)
+}
+
+func TestSQLiteInitializeDoesNotSeed(t *testing.T) {
+	s := &SQLite[m.Book]{InitElements: seededBooks(t).InitElements}
+	require.NoError(t, s.Initialize())
+	defer s.Close()
+
+	n, err := s.Count(t.Context(), nil, CountExact)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	require.NoError(t, s.Seed(t.Context()))
+	n, err = s.Count(t.Context(), nil, CountExact)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+}
+
+func TestSQLiteAdoptsAutoMigratedSchema(t *testing.T) {
+	cfg := config.SQLite{Path: filepath.Join(t.TempDir(), "books.db")}
+
+	// a database set up by AutoMigrate, before versioned migrations
+	db, err := openSQLite(cfg)
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(new(m.Book)))
+	require.NoError(t, db.Create(&m.Book{Title: "QM", Author: "Bohr"}).Error)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	require.NoError(t, sqlDB.Close())
+
+	s := &SQLite[m.Book]{Config: cfg}
+	require.NoError(t, s.Initialize())
+	defer s.Close()
+
+	book, err := s.Get(t.Context(), "1")
+	require.NoError(t, err)
+	require.Equal(t, "QM", book.Title)
+	require.ErrorIs(t, s.Insert(t.Context(), "", &m.Book{Title: "QM"}), ErrConflict)
+
+	sqlDB, err = s.DB.DB()
+	require.NoError(t, err)
+	mig, err := migrate.New(sqlDB, "sqlite")
+	require.NoError(t, err)
+	pending, err := mig.Pending(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, pending)
+}
+
+func TestManualMigrations(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database.Driver = "sqlite"
+	cfg.Database.AutoMigrate = false
+	cfg.SQLite.Path = filepath.Join(t.TempDir(), "books.db")
+
+	// the schema is left to a migrate step that has not run yet
+	s := New[m.Book](cfg, nil)
+	require.ErrorIs(t, s.Initialize(), ErrUnavailable)
+	require.NoError(t, s.Close())
+
+	mig, err := OpenMigrator(cfg)
+	require.NoError(t, err)
+	defer mig.DB.Close()
+	applied, err := mig.Up(t.Context(), 0)
+	require.NoError(t, err)
+	require.NotEmpty(t, applied)
+
+	s = New[m.Book](cfg, nil)
+	require.NoError(t, s.Initialize())
+	defer s.Close()
+	require.NoError(t, s.Insert(t.Context(), "", &m.Book{Title: "QM"}))
+}
+
+func TestPostgresError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"Record not found", gorm.ErrRecordNotFound, ErrNotFound},
+		{"Unique violation", &pgconn.PgError{Code: "23505", Detail: "Key (title)=(QM) already exists."}, ErrConflict},
+		{"Not null violation", &pgconn.PgError{Code: "23502"}, ErrValidation},
+		{"Invalid input syntax", &pgconn.PgError{Code: "22P02"}, ErrValidation},
+		{"Admin shutdown", &pgconn.PgError{Code: "57P01"}, ErrUnavailable},
+		{"Serialization failure", &pgconn.PgError{Code: "40001"}, ErrSerialization},
+		{"Deadlock", &pgconn.PgError{Code: "40P01"}, ErrSerialization},
+		{"Read-only transaction", &pgconn.PgError{Code: "25006"}, ErrValidation},
+		{"Connection refused", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrUnavailable},
+		{"Query timeout", context.DeadlineExceeded, ErrUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorIs(t, postgresError(tt.err), tt.want)
+		})
+	}
+
+	require.NoError(t, postgresError(nil))
+	require.Equal(t, context.Canceled, postgresError(context.Canceled))
+
+	// server faults are not the client's, whatever their class
+	for _, code := range []string{
+		"42P01", // undefined_table
+		"42501", // insufficient_privilege
+		"42601", // syntax_error
+		"23P01", // exclusion_violation
+	} {
+		err := postgresError(&pgconn.PgError{Code: code})
+		require.False(t, errors.Is(err, ErrValidation), code)
+	}
+}
+
+func TestSQLiteError(t *testing.T) {
+	s := &SQLite[m.Book]{}
+	require.NoError(t, s.Initialize())
+	defer s.Close()
+
+	require.ErrorIs(t, sqliteError(s.DB.Exec("SELECT isbn FROM books").Error), ErrValidation)
+	err := sqliteError(s.DB.Exec("SELECT * FROM shelves").Error)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrValidation), "a missing table is a server fault")
+
+	// a database file that cannot be written to
+	path := filepath.Join(t.TempDir(), "books.db")
+	rw, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, rw.Exec("CREATE TABLE books (title text)").Error)
+	ro, err := gorm.Open(sqlite.Open("file:"+path+"?mode=ro"), &gorm.Config{})
+	require.NoError(t, err)
+	require.ErrorIs(t, sqliteError(ro.Exec("INSERT INTO books (title) VALUES ('QM')").Error), ErrUnavailable)
+}
@@ -0,0 +1,516 @@
+// Package databasetest is the conformance suite for database.Database
+// implementations. A backend is only accepted once it passes Run, which
+// checks that it agrees with the others on ids, errors, filters, ordering and
+// pagination, so services behave the same whichever one they are given.
+package databasetest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"k8s-backend/database"
+	m "k8s-backend/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Books are stored by every test, in this order, before it runs. Titles and
+// authors exercise case folding and LIKE wildcards; prices tie so that the
+// primary key has to break them.
+var Books = []m.Book{
+	{Title: "Quantum Mechanics", Author: "Bohr", Price: 10.99, CreatedAt: "2024-01-01"},
+	{Title: "Quantum Field Theory", Author: "Dirac", Price: 11.99, CreatedAt: "2024-01-02"},
+	{Title: "General Relativity", Author: "Einstein", Price: 12.99, CreatedAt: "2024-01-03"},
+	{Title: "Special Relativity", Author: "Einstein", Price: 8.5, CreatedAt: "2024-01-04"},
+	{Title: "100% Physics", Author: "Feynman", Price: 10.99, CreatedAt: "2024-01-05"},
+	{Title: "statistical_mechanics", Author: "Boltzmann", Price: 20, CreatedAt: "2024-01-06"},
+}
+
+// Run runs the suite. open returns a new, empty database that has not been
+// initialized; every test initializes its own and closes it when done.
+func Run(t *testing.T, open func(t *testing.T) database.Database[m.Book]) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db database.Database[m.Book], ids []string)
+	}{
+		{"CRUD", testCRUD},
+		{"Errors", testErrors},
+		{"Cancellation", testCancellation},
+		{"Filters", testFilters},
+		{"Sort", testSort},
+		{"Pagination", testPagination},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"Transactions", testTransactions},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := open(t)
+			require.NoError(t, db.Initialize())
+			t.Cleanup(func() { require.NoError(t, db.Close()) })
+
+			ids := make([]string, len(Books))
+			for i, b := range Books {
+				require.NoError(t, db.Insert(t.Context(), "", &b))
+				require.NotZero(t, b.Id, "Insert must assign the primary key")
+				ids[i] = fmt.Sprint(b.Id)
+			}
+			tt.test(t, db, ids)
+		})
+	}
+}
+
+func testCRUD(t *testing.T, db database.Database[m.Book], ids []string) {
+	ctx := t.Context()
+	require.NoError(t, db.Ping(ctx))
+
+	book := &m.Book{Title: "Thermodynamics", Author: "Fermi", Price: 7.25, CreatedAt: "2024-02-01"}
+	require.NoError(t, db.Insert(ctx, "", book))
+	require.NotContains(t, ids, fmt.Sprint(book.Id), "Insert must assign an unused primary key")
+	id := fmt.Sprint(book.Id)
+
+	got, err := db.Get(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, *book, *got)
+
+	// records are not shared with the caller
+	got.Title = "changed"
+	got, err = db.Get(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, "Thermodynamics", got.Title)
+
+	// as decoded from a JSON request body, only the given fields change
+	require.NoError(t, db.Update(ctx, id, map[string]any{"price": float64(9), "author": "E. Fermi"}))
+	got, err = db.Get(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, m.Book{Id: book.Id, Title: "Thermodynamics", Author: "E. Fermi", Price: 9, CreatedAt: "2024-02-01"}, *got)
+
+	require.NoError(t, db.Delete(ctx, id))
+	_, err = db.Get(ctx, id)
+	require.ErrorIs(t, err, database.ErrNotFound)
+
+	// the other records are untouched
+	n, err := db.Count(ctx, nil, database.CountExact)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(Books)), n)
+}
+
+func testErrors(t *testing.T, db database.Database[m.Book], ids []string) {
+	ctx := t.Context()
+	first, _ := db.Get(ctx, ids[0])
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"Get missing", func() error { _, err := db.Get(ctx, "9999"); return err }, database.ErrNotFound},
+		{"Get malformed id", func() error { _, err := db.Get(ctx, "abc"); return err }, database.ErrValidation},
+		{"Update missing", func() error { return db.Update(ctx, "9999", map[string]any{"price": 1.0}) }, database.ErrNotFound},
+		{"Delete missing", func() error { return db.Delete(ctx, "9999") }, database.ErrNotFound},
+		{"Insert duplicate title", func() error { return db.Insert(ctx, "", &m.Book{Title: Books[1].Title}) }, database.ErrConflict},
+		{"Insert taken id", func() error { return db.Insert(ctx, "", &m.Book{Id: first.Id, Title: "Optics"}) }, database.ErrConflict},
+		{"Update to duplicate title", func() error { return db.Update(ctx, ids[0], map[string]any{"title": Books[1].Title}) }, database.ErrConflict},
+		{"Update unknown column", func() error { return db.Update(ctx, ids[0], map[string]any{"isbn": "123"}) }, database.ErrValidation},
+		{"Update id", func() error { return db.Update(ctx, ids[0], map[string]any{"id": 9999}) }, database.ErrValidation},
+		{"Update id by field name", func() error { return db.Update(ctx, ids[0], map[string]any{"Id": 9999}) }, database.ErrValidation},
+		{"Update created_at", func() error { return db.Update(ctx, ids[0], map[string]any{"created_at": "2000-01-01"}) }, database.ErrValidation},
+		{"Update unknown column with SQL", func() error {
+			return db.Update(ctx, ids[0], map[string]any{"title = 'x' --": "y"})
+		}, database.ErrValidation},
+		{"Filter unknown field", func() error {
+			_, err := db.GetAll(ctx, &m.Filters[m.Book]{Limit: 10, Where: []m.Condition{{Field: "isbn", Op: m.OpEq, Values: []any{"123"}}}})
+			return err
+		}, database.ErrValidation},
+		{"Filter wrong type", func() error {
+			_, err := db.GetAll(ctx, &m.Filters[m.Book]{Limit: 10, Where: []m.Condition{{Field: "price", Op: m.OpContains, Values: []any{"1"}}}})
+			return err
+		}, database.ErrValidation},
+		{"Sort unknown field", func() error {
+			_, err := db.GetAll(ctx, &m.Filters[m.Book]{Limit: 10, Sort: []m.SortField{{Field: "isbn"}}})
+			return err
+		}, database.ErrValidation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorIs(t, tt.call(), tt.want)
+		})
+	}
+
+	// failed writes leave the records as they were
+	got, err := db.Get(ctx, ids[0])
+	require.NoError(t, err)
+	require.Equal(t, first, got)
+	n, err := db.Count(ctx, nil, database.CountExact)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(Books)), n)
+}
+
+func testCancellation(t *testing.T, db database.Database[m.Book], ids []string) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	_, err := db.Get(ctx, ids[0])
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = db.GetAll(ctx, &m.Filters[m.Book]{Limit: 10})
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, db.Insert(ctx, "", &m.Book{Title: "Optics"}), context.Canceled)
+	require.ErrorIs(t, db.Update(ctx, ids[0], map[string]any{"title": "Optics"}), context.Canceled)
+	require.ErrorIs(t, db.Delete(ctx, ids[0]), context.Canceled)
+
+	// nothing was applied
+	book, err := db.Get(t.Context(), ids[0])
+	require.NoError(t, err)
+	require.Equal(t, Books[0].Title, book.Title)
+	n, err := db.Count(t.Context(), nil, database.CountExact)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(Books)), n)
+}
+
+func testFilters(t *testing.T, db database.Database[m.Book], _ []string) {
+	tests := []struct {
+		name  string
+		where []m.Condition
+		want  []string
+	}{
+		{"No conditions", nil, titles(0, 1, 2, 3, 4, 5)},
+		{"Eq", []m.Condition{{Field: "author", Op: m.OpEq, Values: []any{"Einstein"}}}, titles(2, 3)},
+		{"Ne", []m.Condition{{Field: "author", Op: m.OpNe, Values: []any{"Einstein"}}}, titles(0, 1, 4, 5)},
+		{"Lt", []m.Condition{{Field: "price", Op: m.OpLt, Values: []any{10.99}}}, titles(3)},
+		{"Lte", []m.Condition{{Field: "price", Op: m.OpLte, Values: []any{10.99}}}, titles(0, 3, 4)},
+		{"Gt", []m.Condition{{Field: "price", Op: m.OpGt, Values: []any{12.99}}}, titles(5)},
+		{"Gte", []m.Condition{{Field: "price", Op: m.OpGte, Values: []any{12.99}}}, titles(2, 5)},
+		// whatever the database's collation, every upper case letter comes
+		// before every lower case one
+		{"Strings compare byte by byte", []m.Condition{{Field: "title", Op: m.OpLt, Values: []any{"a"}}}, titles(0, 1, 2, 3, 4)},
+		{"In", []m.Condition{{Field: "author", Op: m.OpIn, Values: []any{"Bohr", "Dirac", "Pauli"}}}, titles(0, 1)},
+		{"Between is inclusive", []m.Condition{{Field: "price", Op: m.OpBetween, Values: []any{10.99, 12.99}}}, titles(0, 1, 2, 4)},
+		{"Prefix", []m.Condition{{Field: "title", Op: m.OpPrefix, Values: []any{"Quantum"}}}, titles(0, 1)},
+		{"Prefix is case-sensitive", []m.Condition{{Field: "title", Op: m.OpPrefix, Values: []any{"quantum"}}}, nil},
+		{"Contains ignores case", []m.Condition{{Field: "title", Op: m.OpContains, Values: []any{"RELATIVITY"}}}, titles(2, 3)},
+		{"Contains matches % literally", []m.Condition{{Field: "title", Op: m.OpContains, Values: []any{"%"}}}, titles(4)},
+		{"Contains matches _ literally", []m.Condition{{Field: "title", Op: m.OpContains, Values: []any{"_"}}}, titles(5)},
+		{"Prefix matches % literally", []m.Condition{{Field: "title", Op: m.OpPrefix, Values: []any{"%"}}}, nil},
+		{"Is not null", []m.Condition{{Field: "title", Op: m.OpIsNull, Values: []any{false}}}, titles(0, 1, 2, 3, 4, 5)},
+		{"Is null", []m.Condition{{Field: "title", Op: m.OpIsNull, Values: []any{true}}}, nil},
+		{"Conditions combine with AND", []m.Condition{
+			{Field: "author", Op: m.OpEq, Values: []any{"Einstein"}},
+			{Field: "price", Op: m.OpGt, Values: []any{10.0}},
+		}, titles(2)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			books, err := db.GetAll(t.Context(), &m.Filters[m.Book]{Where: tt.where, Limit: 100})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, bookTitles(books))
+
+			n, err := db.Count(t.Context(), tt.where, database.CountExact)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(tt.want)), n)
+		})
+	}
+}
+
+func testSort(t *testing.T, db database.Database[m.Book], _ []string) {
+	tests := []struct {
+		name string
+		sort []m.SortField
+		want []string
+	}{
+		{"Primary key by default", nil, titles(0, 1, 2, 3, 4, 5)},
+		{"Ascending, ties by primary key", []m.SortField{{Field: "price"}}, titles(3, 0, 4, 1, 2, 5)},
+		{"Descending, ties by primary key", []m.SortField{{Field: "price", Desc: true}}, titles(5, 2, 1, 0, 4, 3)},
+		{"Mixed directions", []m.SortField{{Field: "author"}, {Field: "title", Desc: true}}, titles(0, 5, 1, 3, 2, 4)},
+		{"Primary key descending", []m.SortField{{Field: "id", Desc: true}}, titles(5, 4, 3, 2, 1, 0)},
+		{"Strings in byte order", []m.SortField{{Field: "title"}}, titles(4, 2, 1, 0, 3, 5)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			books, err := db.GetAll(t.Context(), &m.Filters[m.Book]{Sort: tt.sort, Limit: 100})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, bookTitles(books))
+		})
+	}
+}
+
+func testPagination(t *testing.T, db database.Database[m.Book], _ []string) {
+	ctx := t.Context()
+	sort := []m.SortField{{Field: "price", Desc: true}}
+	all := titles(5, 2, 1, 0, 4, 3)
+
+	t.Run("Limit and offset", func(t *testing.T) {
+		books, err := db.GetAll(ctx, &m.Filters[m.Book]{Sort: sort, Limit: 2, Offset: 3})
+		require.NoError(t, err)
+		require.Equal(t, all[3:5], bookTitles(books))
+
+		books, err = db.GetAll(ctx, &m.Filters[m.Book]{Sort: sort, Limit: 2, Offset: 10})
+		require.NoError(t, err)
+		require.Empty(t, books)
+	})
+
+	t.Run("Keyset walks both ways", func(t *testing.T) {
+		f := &m.Filters[m.Book]{Sort: sort, Limit: 4}
+		var forward []string
+		var last *database.Page[m.Book]
+		for {
+			p, err := database.GetPage(ctx, db, f)
+			require.NoError(t, err)
+			forward = append(forward, bookTitles(p.Items)...)
+			last = p
+			if p.Next == nil {
+				break
+			}
+			f.Cursor = p.Next
+		}
+		require.Equal(t, all, forward)
+
+		var backward []string
+		for cur := last.Prev; cur != nil; {
+			p, err := database.GetPage(ctx, db, &m.Filters[m.Book]{Sort: sort, Limit: 4, Cursor: cur})
+			require.NoError(t, err)
+			backward = append(bookTitles(p.Items), backward...)
+			cur = p.Prev
+		}
+		require.Equal(t, all[:len(all)-len(last.Items)], backward)
+	})
+
+	t.Run("Keyset with filters", func(t *testing.T) {
+		where := []m.Condition{{Field: "price", Op: m.OpLte, Values: []any{12.0}}}
+		p, err := database.GetPage(ctx, db, &m.Filters[m.Book]{Sort: sort, Where: where, Limit: 2})
+		require.NoError(t, err)
+		require.Equal(t, titles(1, 0), bookTitles(p.Items))
+		require.Nil(t, p.Prev)
+
+		p, err = database.GetPage(ctx, db, &m.Filters[m.Book]{Sort: sort, Where: where, Limit: 2, Cursor: p.Next})
+		require.NoError(t, err)
+		require.Equal(t, titles(4, 3), bookTitles(p.Items))
+		require.Nil(t, p.Next)
+	})
+}
+
+func testConcurrentWriters(t *testing.T, db database.Database[m.Book], ids []string) {
+	ctx := t.Context()
+	const writers, inserts = 8, 10
+
+	var wg sync.WaitGroup
+	assigned := make(chan int, writers*inserts)
+	conflicts := make(chan error, writers)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range inserts {
+				book := &m.Book{Title: fmt.Sprintf("Volume %d.%d", w, i), Price: float64(i)}
+				if err := db.Insert(ctx, "", book); err != nil {
+					t.Errorf("Insert: %v", err)
+					return
+				}
+				assigned <- book.Id
+			}
+			if err := db.Update(ctx, ids[0], map[string]any{"price": float64(w)}); err != nil {
+				t.Errorf("Update: %v", err)
+			}
+			// all writers race for one title, exactly one may get it
+			conflicts <- db.Insert(ctx, "", &m.Book{Title: "Contested"})
+		}()
+	}
+	wg.Wait()
+	close(assigned)
+	close(conflicts)
+
+	seen := make(map[int]bool)
+	for id := range assigned {
+		require.False(t, seen[id], "id %d assigned twice", id)
+		seen[id] = true
+	}
+	require.Len(t, seen, writers*inserts)
+
+	var won int
+	for err := range conflicts {
+		if err == nil {
+			won++
+			continue
+		}
+		require.ErrorIs(t, err, database.ErrConflict)
+	}
+	require.Equal(t, 1, won)
+
+	n, err := db.Count(ctx, nil, database.CountExact)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(Books)+writers*inserts+1), n)
+}
+
+func testTransactions(t *testing.T, db database.Database[m.Book], ids []string) {
+	ctx := t.Context()
+	errAbort := errors.New("abort")
+
+	t.Run("Commit", func(t *testing.T) {
+		err := db.WithTx(ctx, nil, func(tx database.Tx) error {
+			book := &m.Book{Title: "Optics", Author: "Newton"}
+			if err := db.Insert(tx.Context(), "", book); err != nil {
+				return err
+			}
+			// the transaction sees its own writes
+			got, err := db.Get(tx.Context(), fmt.Sprint(book.Id))
+			if err != nil {
+				return err
+			}
+			require.Equal(t, "Newton", got.Author)
+			return db.Update(tx.Context(), ids[0], map[string]any{"price": 1.5})
+		})
+		require.NoError(t, err)
+
+		got, err := db.Get(ctx, ids[0])
+		require.NoError(t, err)
+		require.Equal(t, 1.5, got.Price)
+		requireTitles(t, db, []m.Condition{{Field: "title", Op: m.OpEq, Values: []any{"Optics"}}}, []string{"Optics"})
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		before, err := db.GetAll(ctx, &m.Filters[m.Book]{Limit: 100})
+		require.NoError(t, err)
+
+		err = db.WithTx(ctx, nil, func(tx database.Tx) error {
+			require.NoError(t, db.Insert(tx.Context(), "", &m.Book{Title: "Principia"}))
+			require.NoError(t, db.Update(tx.Context(), ids[1], map[string]any{"title": "QFT", "price": 99.0}))
+			require.NoError(t, db.Delete(tx.Context(), ids[2]))
+			return errAbort
+		})
+		require.ErrorIs(t, err, errAbort)
+
+		after, err := db.GetAll(ctx, &m.Filters[m.Book]{Limit: 100})
+		require.NoError(t, err)
+		require.Equal(t, before, after)
+	})
+
+	t.Run("Savepoint", func(t *testing.T) {
+		err := db.WithTx(ctx, nil, func(tx database.Tx) error {
+			if err := db.Insert(tx.Context(), "", &m.Book{Title: "Opticks"}); err != nil {
+				return err
+			}
+			// a failed statement only rolls back to the savepoint
+			err := tx.Savepoint(func(tx database.Tx) error {
+				if err := db.Insert(tx.Context(), "", &m.Book{Title: "Lost"}); err != nil {
+					return err
+				}
+				return db.Insert(tx.Context(), "", &m.Book{Title: Books[0].Title})
+			})
+			require.ErrorIs(t, err, database.ErrConflict)
+
+			// WithTx within a transaction is a savepoint as well
+			err = db.WithTx(tx.Context(), nil, func(tx database.Tx) error {
+				if err := db.Delete(tx.Context(), ids[3]); err != nil {
+					return err
+				}
+				return errAbort
+			})
+			require.ErrorIs(t, err, errAbort)
+			return db.Insert(tx.Context(), "", &m.Book{Title: "Arithmetica"})
+		})
+		require.NoError(t, err)
+
+		requireTitles(t, db, []m.Condition{{Field: "title", Op: m.OpIn, Values: []any{"Opticks", "Lost", "Arithmetica"}}},
+			[]string{"Opticks", "Arithmetica"})
+		_, err = db.Get(ctx, ids[3])
+		require.NoError(t, err)
+	})
+
+	t.Run("Read-only", func(t *testing.T) {
+		err := db.WithTx(ctx, &database.TxOptions{ReadOnly: true}, func(tx database.Tx) error {
+			if _, err := db.Get(tx.Context(), ids[0]); err != nil {
+				return err
+			}
+			return db.Delete(tx.Context(), ids[0])
+		})
+		require.ErrorIs(t, err, database.ErrValidation)
+		_, err = db.Get(ctx, ids[0])
+		require.NoError(t, err)
+	})
+
+	t.Run("Isolation level", func(t *testing.T) {
+		opts := &database.TxOptions{Isolation: sql.LevelSerializable}
+		err := db.WithTx(ctx, opts, func(tx database.Tx) error {
+			return db.Update(tx.Context(), ids[4], map[string]any{"price": 2.5})
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("Concurrent transfers", func(t *testing.T) {
+		// move price from one book to the other; the sum is invariant
+		transfer := func(from, to string) error {
+			return db.WithTx(ctx, &database.TxOptions{Isolation: sql.LevelSerializable, Retries: 20}, func(tx database.Tx) error {
+				a, err := db.Get(tx.Context(), from)
+				if err != nil {
+					return err
+				}
+				b, err := db.Get(tx.Context(), to)
+				if err != nil {
+					return err
+				}
+				if err := db.Update(tx.Context(), from, map[string]any{"price": a.Price - 1}); err != nil {
+					return err
+				}
+				return db.Update(tx.Context(), to, map[string]any{"price": b.Price + 1})
+			})
+		}
+
+		before := priceSum(t, db, ids[5], ids[4])
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				from, to := ids[5], ids[4]
+				if i%2 == 1 {
+					from, to = to, from
+				}
+				if err := transfer(from, to); err != nil {
+					t.Errorf("transfer: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		require.InDelta(t, before, priceSum(t, db, ids[5], ids[4]), 1e-9)
+	})
+}
+
+func priceSum(t *testing.T, db database.Database[m.Book], ids ...string) float64 {
+	var sum float64
+	for _, id := range ids {
+		b, err := db.Get(t.Context(), id)
+		require.NoError(t, err)
+		sum += b.Price
+	}
+	return sum
+}
+
+func requireTitles(t *testing.T, db database.Database[m.Book], where []m.Condition, want []string) {
+	t.Helper()
+	books, err := db.GetAll(t.Context(), &m.Filters[m.Book]{Where: where, Limit: 100})
+	require.NoError(t, err)
+	require.Equal(t, want, bookTitles(books))
+}
+
+// titles returns the titles of the Books at the given indexes.
+func titles(indexes ...int) []string {
+	var out []string
+	for _, i := range indexes {
+		out = append(out, Books[i].Title)
+	}
+	return out
+}
+
+func bookTitles(books []*m.Book) []string {
+	var out []string
+	for _, b := range books {
+		out = append(out, b.Title)
+	}
+	return out
+}
@@ -0,0 +1,56 @@
+package databasetest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s-backend/config"
+	"k8s-backend/database"
+	"k8s-backend/database/migrate"
+	m "k8s-backend/model"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestCache(t *testing.T) {
+	Run(t, func(t *testing.T) database.Database[m.Book] {
+		return &database.Cache[m.Book]{}
+	})
+}
+
+func TestSQLiteInMemory(t *testing.T) {
+	Run(t, func(t *testing.T) database.Database[m.Book] {
+		return &database.SQLite[m.Book]{}
+	})
+}
+
+func TestSQLiteFile(t *testing.T) {
+	Run(t, func(t *testing.T) database.Database[m.Book] {
+		return &database.SQLite[m.Book]{Config: config.SQLite{Path: filepath.Join(t.TempDir(), "books.db")}}
+	})
+}
+
+// TestPostgres runs against the database configured like the server, through
+// K8S_BACKEND_POSTGRES_* variables, when K8S_BACKEND_TEST_POSTGRES is set.
+// It drops the books and schema_migrations tables.
+func TestPostgres(t *testing.T) {
+	if os.Getenv("K8S_BACKEND_TEST_POSTGRES") == "" {
+		t.Skip("set K8S_BACKEND_TEST_POSTGRES to run against Postgres")
+	}
+	cfg, err := config.Load(nil)
+	require.NoError(t, err)
+
+	Run(t, func(t *testing.T) database.Database[m.Book] {
+		db, err := gorm.Open(postgres.Open(cfg.Postgres.DSN()))
+		require.NoError(t, err)
+		require.NoError(t, db.Migrator().DropTable(new(m.Book), migrate.Table))
+		sqlDB, err := db.DB()
+		require.NoError(t, err)
+		require.NoError(t, sqlDB.Close())
+
+		return &database.Postgres[m.Book]{Config: cfg.Postgres}
+	})
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	gosqlite "github.com/glebarez/go-sqlite"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Sentinel errors returned by every Database[T] implementation. Backends wrap
+// them around the underlying cause, so match with errors.Is.
+var (
+	ErrNotFound    = errors.New("record not found")
+	ErrConflict    = errors.New("record conflicts with an existing one")
+	ErrValidation  = errors.New("invalid record")
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// clientErrors are the SQLSTATEs caused by the values a client sent. Others,
+// such as an undefined table or a missing privilege, are server faults whose
+// message must not reach clients.
+var clientErrors = map[string]bool{
+	"22001": true, // string_data_right_truncation
+	"22003": true, // numeric_value_out_of_range
+	"22007": true, // invalid_datetime_format
+	"22008": true, // datetime_field_overflow
+	"22P02": true, // invalid_text_representation
+	"23502": true, // not_null_violation
+	"23503": true, // foreign_key_violation
+	"23514": true, // check_violation
+	"42703": true, // undefined_column
+	"42804": true, // datatype_mismatch
+}
+
+// postgresError maps driver and gorm errors onto the sentinel errors.
+func postgresError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if mapped, ok := gormError(err); ok {
+		return mapped
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "23505": // unique_violation
+			return fmt.Errorf("%w: %s", ErrConflict, pgErr.Detail)
+		case pgErr.Code == "40001", // serialization_failure
+			pgErr.Code == "40P01": // deadlock_detected
+			return fmt.Errorf("%w: %w", ErrSerialization, err)
+		case pgErr.Code == "25006": // read_only_sql_transaction
+			return fmt.Errorf("%w: %w", ErrValidation, err)
+		case clientErrors[pgErr.Code]:
+			return fmt.Errorf("%w: %w", ErrValidation, err)
+		case strings.HasPrefix(pgErr.Code, "08"), // connection exception
+			strings.HasPrefix(pgErr.Code, "53"), // insufficient resources
+			strings.HasPrefix(pgErr.Code, "57"): // operator intervention, e.g. admin shutdown
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+		return err
+	}
+
+	var connErr *pgconn.ConnectError
+	var netErr net.Error
+	if errors.As(err, &connErr) || errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	return err
+}
+
+// sqliteError maps SQLite driver and gorm errors onto the sentinel errors.
+func sqliteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if mapped, ok := gormError(err); ok {
+		return mapped
+	}
+
+	var liteErr *gosqlite.Error
+	if errors.As(err, &liteErr) {
+		// extended result codes carry the primary one in the low byte
+		code := liteErr.Code()
+		switch {
+		case code == sqlite3.SQLITE_BUSY_SNAPSHOT:
+			return fmt.Errorf("%w: %w", ErrSerialization, err)
+		case code == sqlite3.SQLITE_CONSTRAINT_UNIQUE,
+			code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return fmt.Errorf("%w: %w", ErrConflict, err)
+		case code&0xff == sqlite3.SQLITE_CONSTRAINT, // NOT NULL, CHECK...
+			code&0xff == sqlite3.SQLITE_MISMATCH,
+			code&0xff == sqlite3.SQLITE_TOOBIG,
+			// SQLITE_ERROR is also a missing table or a syntax error: server
+			// faults
+			code == sqlite3.SQLITE_ERROR && strings.Contains(liteErr.Error(), "no such column"):
+			return fmt.Errorf("%w: %w", ErrValidation, err)
+		case code&0xff == sqlite3.SQLITE_READONLY,
+			code&0xff == sqlite3.SQLITE_BUSY,
+			code&0xff == sqlite3.SQLITE_LOCKED,
+			code&0xff == sqlite3.SQLITE_IOERR,
+			code&0xff == sqlite3.SQLITE_FULL,
+			code&0xff == sqlite3.SQLITE_CANTOPEN:
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+	}
+	return err
+}
+
+// gormError maps the errors gorm and database/sql report for every driver,
+// and reports whether err was one of them.
+func gormError(err error) (error, bool) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return fmt.Errorf("%w: %w", ErrNotFound, err), true
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return fmt.Errorf("%w: %w", ErrConflict, err), true
+	case errors.Is(err, context.Canceled):
+		return err, true // the caller gave up; not the database's fault
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, gorm.ErrInvalidDB):
+		return fmt.Errorf("%w: %w", ErrUnavailable, err), true
+	case errors.Is(err, gorm.ErrInvalidData),
+		errors.Is(err, gorm.ErrInvalidField),
+		errors.Is(err, gorm.ErrInvalidValue),
+		errors.Is(err, gorm.ErrPrimaryKeyRequired):
+		return fmt.Errorf("%w: %w", ErrValidation, err), true
+	}
+	return nil, false
+}
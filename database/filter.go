@@ -0,0 +1,347 @@
+package database
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	m "k8s-backend/model"
+)
+
+// QueryError reports an invalid sort or filter query parameter. It wraps
+// ErrValidation.
+type QueryError struct {
+	// Param is the query parameter as the client sent it, e.g. "price[lte]".
+	Param   string
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("invalid query parameter %s: %s", e.Param, e.Message)
+}
+
+func (e *QueryError) Unwrap() error {
+	return ErrValidation
+}
+
+// ParseWhere parses filter query parameters of the form field[op]=value into
+// conditions on T, e.g. price[lte]=20&author[in]=Bohr,Dirac. A bare field=value
+// means contains for strings and gte for numbers, as the list endpoints always
+// did, and eq for anything else. Every parameter must name a column of T;
+// callers remove the parameters they handle themselves (limit, sort...) first.
+func ParseWhere[T any](params url.Values) ([]m.Condition, error) {
+	cols, err := Columns[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	// sorted so the conditions, and the SQL built from them, are stable
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var where []m.Condition
+	for _, key := range keys {
+		name, op, explicit := parseFilterKey(key)
+		col, ok := cols[name]
+		if !ok {
+			return nil, &QueryError{Param: key, Message: "is not a supported query parameter"}
+		}
+		if !explicit {
+			op = defaultOperator(col.Type)
+		}
+
+		for _, raw := range params[key] {
+			c, err := parseCondition(col, op, raw)
+			if err != nil {
+				return nil, &QueryError{Param: key, Message: err.Error()}
+			}
+			where = append(where, c)
+		}
+	}
+	return where, nil
+}
+
+// parseFilterKey splits "price[lte]" into "price" and "lte".
+func parseFilterKey(key string) (name string, op m.Operator, explicit bool) {
+	name, rest, found := strings.Cut(key, "[")
+	if !found || !strings.HasSuffix(rest, "]") {
+		return key, "", false
+	}
+	return name, m.Operator(strings.TrimSuffix(rest, "]")), true
+}
+
+func defaultOperator(t reflect.Type) m.Operator {
+	switch kindOf(t) {
+	case reflect.String:
+		return m.OpContains
+	case reflect.Int, reflect.Uint, reflect.Float64:
+		return m.OpGte
+	default:
+		return m.OpEq
+	}
+}
+
+func parseCondition(col Column, op m.Operator, raw string) (m.Condition, error) {
+	c := m.Condition{Field: col.Name, Op: op}
+
+	var parts []string
+	switch op {
+	case m.OpIn:
+		parts = strings.Split(raw, ",")
+	case m.OpBetween:
+		parts = strings.Split(raw, ",")
+		if len(parts) != 2 {
+			return c, fmt.Errorf("between takes two comma separated values")
+		}
+	case m.OpIsNull:
+		null, err := strconv.ParseBool(raw)
+		if err != nil {
+			return c, fmt.Errorf("isnull takes true or false")
+		}
+		c.Values = []any{null}
+		return c, validateCondition(col, c)
+	default:
+		parts = []string{raw}
+	}
+
+	for _, p := range parts {
+		v, err := parseValue(col.Type, strings.TrimSpace(p))
+		if err != nil {
+			return c, err
+		}
+		c.Values = append(c.Values, v)
+	}
+	return c, validateCondition(col, c)
+}
+
+// parseValue converts raw into a value of type t.
+func parseValue(t reflect.Type, raw string) (any, error) {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var v reflect.Value
+	switch kindOf(t) {
+	case reflect.String:
+		v = reflect.ValueOf(raw)
+	case reflect.Int:
+		n, err := strconv.ParseInt(raw, 10, t.Bits())
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", raw)
+		}
+		v = reflect.ValueOf(n)
+	case reflect.Uint:
+		n, err := strconv.ParseUint(raw, 10, t.Bits())
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a non-negative integer", raw)
+		}
+		v = reflect.ValueOf(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, t.Bits())
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", raw)
+		}
+		v = reflect.ValueOf(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", raw)
+		}
+		v = reflect.ValueOf(b)
+	default:
+		return nil, fmt.Errorf("field of type %s cannot be filtered on", t)
+	}
+	return v.Convert(t).Interface(), nil
+}
+
+// validateCondition checks that the operator applies to the column's type and
+// has the right number of values.
+func validateCondition(col Column, c m.Condition) error {
+	kind := kindOf(col.Type)
+	if kind == reflect.Invalid {
+		return fmt.Errorf("field of type %s cannot be filtered on", col.Type)
+	}
+
+	want := 1
+	switch c.Op {
+	case m.OpEq, m.OpNe:
+	case m.OpLt, m.OpLte, m.OpGt, m.OpGte:
+		if kind == reflect.Bool {
+			return fmt.Errorf("%s does not apply to booleans", c.Op)
+		}
+	case m.OpBetween:
+		if kind == reflect.Bool {
+			return fmt.Errorf("%s does not apply to booleans", c.Op)
+		}
+		want = 2
+	case m.OpIn:
+		if len(c.Values) == 0 {
+			return fmt.Errorf("in takes at least one value")
+		}
+		want = len(c.Values)
+	case m.OpPrefix, m.OpContains:
+		if kind != reflect.String {
+			return fmt.Errorf("%s only applies to text", c.Op)
+		}
+	case m.OpIsNull:
+		if len(c.Values) != 1 {
+			return fmt.Errorf("isnull takes one value")
+		}
+		if _, ok := c.Values[0].(bool); !ok {
+			return fmt.Errorf("isnull takes true or false")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown operator %q", c.Op)
+	}
+
+	if len(c.Values) != want {
+		return fmt.Errorf("%s takes %d value(s), got %d", c.Op, want, len(c.Values))
+	}
+	for _, v := range c.Values {
+		if kindOf(reflect.TypeOf(v)) != kind {
+			return fmt.Errorf("value %v does not match the field type %s", v, col.Type)
+		}
+	}
+	return nil
+}
+
+// kindOf folds the kinds filters distinguish: every signed integer is Int,
+// every unsigned one Uint and both floats Float64. It returns Invalid for
+// types that cannot be filtered on.
+func kindOf(t reflect.Type) reflect.Kind {
+	if t == nil {
+		return reflect.Invalid
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool:
+		return t.Kind()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.Int
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflect.Uint
+	case reflect.Float32, reflect.Float64:
+		return reflect.Float64
+	default:
+		return reflect.Invalid
+	}
+}
+
+// matches reports whether record satisfies every condition. It is the
+// in-memory counterpart of applyWhere.
+func matches[T any](cols *columnSet, record *T, where []m.Condition) (bool, error) {
+	v := reflect.ValueOf(record).Elem()
+	for _, c := range where {
+		col, ok := cols.byName[c.Field]
+		if !ok {
+			return false, fmt.Errorf("%w: cannot filter on unknown field %q", ErrValidation, c.Field)
+		}
+		if err := validateCondition(col, c); err != nil {
+			return false, fmt.Errorf("%w: %s: %v", ErrValidation, c.Field, err)
+		}
+
+		field := v.FieldByName(col.Field)
+		if field.Kind() == reflect.Pointer {
+			if c.Op == m.OpIsNull {
+				if field.IsNil() != c.Values[0].(bool) {
+					return false, nil
+				}
+				continue
+			}
+			if field.IsNil() {
+				// as in SQL, NULL satisfies no comparison
+				return false, nil
+			}
+			field = field.Elem()
+		}
+		if !matchCondition(field, c) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func matchCondition(field reflect.Value, c m.Condition) bool {
+	compare := func(i int) int { return compareValue(field, reflect.ValueOf(c.Values[i])) }
+
+	switch c.Op {
+	case m.OpEq:
+		return compare(0) == 0
+	case m.OpNe:
+		return compare(0) != 0
+	case m.OpLt:
+		return compare(0) < 0
+	case m.OpLte:
+		return compare(0) <= 0
+	case m.OpGt:
+		return compare(0) > 0
+	case m.OpGte:
+		return compare(0) >= 0
+	case m.OpBetween:
+		return compare(0) >= 0 && compare(1) <= 0
+	case m.OpIn:
+		for i := range c.Values {
+			if compare(i) == 0 {
+				return true
+			}
+		}
+		return false
+	case m.OpPrefix:
+		return strings.HasPrefix(field.String(), c.Values[0].(string))
+	case m.OpContains:
+		return strings.Contains(strings.ToLower(field.String()), strings.ToLower(c.Values[0].(string)))
+	case m.OpIsNull:
+		// a non-pointer field is never NULL
+		return !c.Values[0].(bool)
+	}
+	return false
+}
+
+// compareValue compares two values of the same folded kind. Pointers are
+// dereferenced and, as in Postgres, nil sorts after every value.
+func compareValue(a, b reflect.Value) int {
+	if a.Kind() == reflect.Pointer || b.Kind() == reflect.Pointer {
+		aNil := a.Kind() == reflect.Pointer && a.IsNil()
+		bNil := b.Kind() == reflect.Pointer && b.IsNil()
+		switch {
+		case aNil && bNil:
+			return 0
+		case aNil:
+			return 1
+		case bNil:
+			return -1
+		}
+		return compareValue(reflect.Indirect(a), reflect.Indirect(b))
+	}
+
+	switch kindOf(a.Type()) {
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Int:
+		return cmp.Compare(a.Int(), b.Int())
+	case reflect.Uint:
+		return cmp.Compare(a.Uint(), b.Uint())
+	case reflect.Float64:
+		return cmp.Compare(a.Float(), b.Float())
+	case reflect.Bool:
+		switch {
+		case a.Bool() == b.Bool():
+			return 0
+		case b.Bool():
+			return -1
+		default:
+			return 1
+		}
+	}
+	return 0
+}
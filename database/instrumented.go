@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"k8s-backend/metrics"
+	m "k8s-backend/model"
+	"k8s-backend/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Instrumented records a span, latency and error counts for every call to
+// the wrapped Database[T], labelled with Backend.
+type Instrumented[T any] struct {
+	Database[T]
+	Backend string
+}
+
+func Instrument[T any](backend string, db Database[T]) *Instrumented[T] {
+	return &Instrumented[T]{Database: db, Backend: backend}
+}
+
+func (i *Instrumented[T]) start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span, time.Time) {
+	ctx, span := tracing.StartDatabase(ctx, method, append(attrs, attribute.String("db.system", i.Backend))...)
+	return ctx, span, time.Now()
+}
+
+func (i *Instrumented[T]) end(method string, span trace.Span, start time.Time, err error) {
+	result := metrics.ResultOK
+	if err != nil {
+		result = metrics.ResultError
+	}
+	metrics.DBOperations.WithLabelValues(i.Backend, method, result).Inc()
+	metrics.DBDuration.WithLabelValues(i.Backend, method).Observe(time.Since(start).Seconds())
+	tracing.End(span, err)
+}
+
+func (i *Instrumented[T]) Ping(ctx context.Context) (err error) {
+	ctx, span, start := i.start(ctx, "Ping")
+	defer func() { i.end("Ping", span, start, err) }()
+	return i.Database.Ping(ctx)
+}
+
+func (i *Instrumented[T]) Get(ctx context.Context, id string) (_ *T, err error) {
+	ctx, span, start := i.start(ctx, "Get", attribute.String("db.record.id", id))
+	defer func() { i.end("Get", span, start, err) }()
+	return i.Database.Get(ctx, id)
+}
+
+func (i *Instrumented[T]) GetAll(ctx context.Context, f *m.Filters[T]) (_ []*T, err error) {
+	ctx, span, start := i.start(ctx, "GetAll", attribute.Int("db.limit", f.Limit), attribute.Int("db.offset", f.Offset),
+		attribute.Bool("db.cursor", f.Cursor != nil))
+	defer func() { i.end("GetAll", span, start, err) }()
+	return i.Database.GetAll(ctx, f)
+}
+
+func (i *Instrumented[T]) Count(ctx context.Context, where []m.Condition, mode CountMode) (_ int64, err error) {
+	ctx, span, start := i.start(ctx, "Count", attribute.Bool("db.count.estimate", mode == CountEstimate))
+	defer func() { i.end("Count", span, start, err) }()
+	return i.Database.Count(ctx, where, mode)
+}
+
+func (i *Instrumented[T]) Insert(ctx context.Context, id string, element *T) (err error) {
+	ctx, span, start := i.start(ctx, "Insert")
+	defer func() { i.end("Insert", span, start, err) }()
+	return i.Database.Insert(ctx, id, element)
+}
+
+func (i *Instrumented[T]) Update(ctx context.Context, id string, fields map[string]any) (err error) {
+	ctx, span, start := i.start(ctx, "Update", attribute.String("db.record.id", id))
+	defer func() { i.end("Update", span, start, err) }()
+	return i.Database.Update(ctx, id, fields)
+}
+
+func (i *Instrumented[T]) Delete(ctx context.Context, id string) (err error) {
+	ctx, span, start := i.start(ctx, "Delete", attribute.String("db.record.id", id))
+	defer func() { i.end("Delete", span, start, err) }()
+	return i.Database.Delete(ctx, id)
+}
+
+func (i *Instrumented[T]) WithTx(ctx context.Context, opts *TxOptions, fn func(tx Tx) error) (err error) {
+	ctx, span, start := i.start(ctx, "WithTx")
+	defer func() { i.end("WithTx", span, start, err) }()
+	return i.Database.WithTx(ctx, opts, fn)
+}
@@ -0,0 +1,295 @@
+package database
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+
+	"k8s-backend/metrics"
+	m "k8s-backend/model"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// listKey returns the Redis key of a listing or tag of listings.
+//
+// Listings are cached for ListTTL under {<Name>:lists}:<query>:<hash of the
+// normalized query>, the braces keeping every listing and tag in one Redis
+// Cluster slot. Each listing is also added to the sets of the tags it
+// depends on, and writes evict the listings of the tags they touch:
+//
+//	tag:all             every listing; evicted by inserts and deletes, which
+//	                    may shift any page
+//	tag:record:<id>     the listings showing the record; evicted by updates
+//	tag:field:<field>   the listings filtering or sorting on the field;
+//	                    evicted by updates of it, which may move records
+//	                    into, out of or across pages
+//
+// A tag may still hold a listing that was cached again since without
+// depending on it, which only evicts it more often than needed.
+// Listings are only kept in Redis, not in process.
+//
+// Every eviction also increments the generation of the listings, under gen. A
+// listing is only cached if no eviction happened while it was loaded, since
+// it may be missing the write that caused it.
+func (c *CachedDatabase[T]) listKey(parts ...string) string {
+	key := "{" + c.Name + ":lists}"
+	for _, p := range parts {
+		key += ":" + p
+	}
+	return key
+}
+
+// queryHash hashes query to a key that is the same for equivalent queries:
+// conditions are all required, so their order does not matter, and neither
+// does the order of the values of in.
+func queryHash(query any) string {
+	data, _ := json.Marshal(query)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+func normalizeWhere(where []m.Condition) []m.Condition {
+	encode := func(v any) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	normalized := make([]m.Condition, len(where))
+	for i, cond := range where {
+		if cond.Op == m.OpIn {
+			cond.Values = slices.Clone(cond.Values)
+			slices.SortFunc(cond.Values, func(a, b any) int { return cmp.Compare(encode(a), encode(b)) })
+		}
+		normalized[i] = cond
+	}
+	slices.SortFunc(normalized, func(a, b m.Condition) int { return cmp.Compare(encode(a), encode(b)) })
+	return normalized
+}
+
+func (c *CachedDatabase[T]) GetAll(ctx context.Context, f *m.Filters[T]) ([]*T, error) {
+	if c.ListTTL <= 0 || txFrom(ctx) != nil {
+		return c.Database.GetAll(ctx, f)
+	}
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	query := struct {
+		Where  []m.Condition `json:"w"`
+		Sort   []m.SortField `json:"s"`
+		Limit  int           `json:"l"`
+		Offset int           `json:"o"`
+		Cursor *m.Cursor     `json:"c"`
+	}{normalizeWhere(f.Where), f.Sort, f.Limit, f.Offset, f.Cursor}
+	tags := []string{"all"}
+	for _, cond := range f.Where {
+		tags = append(tags, "field:"+cond.Field)
+	}
+	for _, s := range f.Sort {
+		tags = append(tags, "field:"+s.Field)
+	}
+	if cols.primaryKey != nil {
+		// ties are broken by the primary key
+		tags = append(tags, "field:"+cols.primaryKey.Name)
+	}
+
+	return cachedQuery(ctx, c, c.listKey("getall", queryHash(query)), tags, func(ctx context.Context) ([]*T, []string, error) {
+		records, err := c.Database.GetAll(ctx, f)
+		if err != nil || cols.primaryKey == nil {
+			return records, nil, err
+		}
+		ids := make([]string, len(records))
+		for i, record := range records {
+			ids[i] = "record:" + fmt.Sprint(reflect.ValueOf(record).Elem().FieldByName(cols.primaryKey.Field).Interface())
+		}
+		return records, ids, nil
+	})
+}
+
+func (c *CachedDatabase[T]) Count(ctx context.Context, where []m.Condition, mode CountMode) (int64, error) {
+	if c.ListTTL <= 0 || txFrom(ctx) != nil {
+		return c.Database.Count(ctx, where, mode)
+	}
+
+	query := struct {
+		Where []m.Condition `json:"w"`
+		Mode  CountMode     `json:"m"`
+	}{normalizeWhere(where), mode}
+	tags := []string{"all"}
+	for _, cond := range where {
+		tags = append(tags, "field:"+cond.Field)
+	}
+
+	return cachedQuery(ctx, c, c.listKey("count", queryHash(query)), tags, func(ctx context.Context) (int64, []string, error) {
+		n, err := c.Database.Count(ctx, where, mode)
+		return n, nil, err
+	})
+}
+
+// cachedQuery returns the result cached under key or else loads, caches and
+// tags it with tags and the extra tags load returns. Like Get, concurrent
+// misses share one load.
+func cachedQuery[T, V any](ctx context.Context, c *CachedDatabase[T], key string, tags []string, load func(context.Context) (V, []string, error)) (V, error) {
+	var result V
+	name := c.Name + ".list"
+	data, err := c.Client.Get(ctx, key).Bytes()
+	switch {
+	case err == nil:
+		var cached V
+		if err := json.Unmarshal(data, &cached); err != nil {
+			c.softFail(ctx, "decode", fmt.Errorf("decoding %s: %w", key, err))
+			break
+		}
+		metrics.CacheRequests.WithLabelValues(name, metrics.CacheHit).Inc()
+		return cached, nil
+	case errors.Is(err, redis.Nil):
+		metrics.CacheRequests.WithLabelValues(name, metrics.CacheMiss).Inc()
+	default:
+		c.softFail(ctx, "get", err)
+	}
+
+	// callers share the encoded result and each decode a copy of their own
+	var leader bool
+	loaded := c.loads.DoChan(key, func() (any, error) {
+		leader = true
+		ctx := context.WithoutCancel(ctx)
+		gen, err := c.Client.Get(ctx, c.listKey("gen")).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			c.softFail(ctx, "get", err)
+		}
+		v, extra, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		c.setList(ctx, key, gen, data, append(tags, extra...))
+		return data, nil
+	})
+	select {
+	case <-ctx.Done():
+		return result, ctx.Err()
+	case res := <-loaded:
+		if !leader {
+			metrics.CacheCoalesced.WithLabelValues(name).Inc()
+		}
+		if res.Err != nil {
+			return result, res.Err
+		}
+		err := json.Unmarshal(res.Val.([]byte), &result)
+		return result, err
+	}
+}
+
+// setListing caches a listing and adds it to its tags, whose sets live as
+// long as the listings they hold, unless listings were evicted since it was
+// loaded.
+//
+// KEYS[1] generation of the listings, KEYS[2] listing, KEYS[3...] its tags
+// ARGV[1] generation the listing was loaded at, ARGV[2] listing, ARGV[3] TTL
+// (ms)
+// returns 1 if cached, 0 if the generation changed
+var setListing = redis.NewScript(`
+if (redis.call('GET', KEYS[1]) or '') ~= ARGV[1] then
+  return 0
+end
+redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[3])
+for i = 3, #KEYS do
+  redis.call('SADD', KEYS[i], KEYS[2])
+  redis.call('PEXPIRE', KEYS[i], ARGV[3])
+end
+return 1
+`)
+
+// setList caches a listing loaded at generation gen and adds it to its tags.
+func (c *CachedDatabase[T]) setList(ctx context.Context, key, gen string, data []byte, tags []string) {
+	keys := []string{c.listKey("gen"), key}
+	for _, tag := range tags {
+		keys = append(keys, c.listKey("tag", tag))
+	}
+	if err := setListing.Run(ctx, c.Client, keys, gen, data, c.ListTTL.Milliseconds()).Err(); err != nil {
+		c.softFail(ctx, "set", err)
+	}
+}
+
+// invalidateLists evicts the listings of tags and, in a transaction, once
+// more after the commit.
+func (c *CachedDatabase[T]) invalidateLists(ctx context.Context, tags ...string) {
+	if c.ListTTL <= 0 {
+		return
+	}
+	c.evictLists(ctx, tags)
+	if txFrom(ctx) != nil {
+		afterCommit(ctx, func() { c.evictLists(context.WithoutCancel(ctx), tags) })
+	}
+}
+
+// evictLists deletes the listings of tags along with the tags, and increments
+// the generation of the listings. The tags are watched, so that a listing
+// added to one meanwhile is not left cached outside of it: the eviction is
+// then retried.
+func (c *CachedDatabase[T]) evictLists(ctx context.Context, tags []string) {
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = c.listKey("tag", tag)
+	}
+	gen := c.listKey("gen")
+	evict := func(tx *redis.Tx) error {
+		listings, err := tx.SUnion(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, append(listings, keys...)...)
+			pipe.Incr(ctx, gen)
+			pipe.PExpire(ctx, gen, c.ListTTL)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for range evictRetries {
+		if err = c.Client.Watch(ctx, evict, keys...); !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
+	if err != nil {
+		c.softFail(ctx, "del", err)
+	}
+}
+
+// evictRetries bounds how many times evictLists retries when listings keep
+// being added to its tags.
+const evictRetries = 5
+
+// updateTags returns the tags of the listings an update of fields of the
+// record id may change.
+func updateTags[T any](id string, fields map[string]any) []string {
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return []string{"all"}
+	}
+	pk, err := primaryKey(cols, id)
+	if err != nil {
+		return []string{"all"}
+	}
+	tags := []string{"record:" + pk}
+	for name := range fields {
+		col, ok := lookupColumn(cols, name)
+		if !ok {
+			return []string{"all"}
+		}
+		tags = append(tags, "field:"+col.Name)
+	}
+	return tags
+}
@@ -0,0 +1,240 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	m "k8s-backend/model"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedListsReadThrough(t *testing.T) {
+	c, backend, _ := cachedBooks(t)
+	c.ListTTL = time.Minute
+	ctx := t.Context()
+
+	f := &m.Filters[m.Book]{
+		Where: []m.Condition{
+			{Field: "author", Op: m.OpIn, Values: []any{"Bohr", "Dirac"}},
+			{Field: "price", Op: m.OpLt, Values: []any{12.0}},
+		},
+		Sort:  []m.SortField{{Field: "title"}},
+		Limit: 10,
+	}
+	books, err := c.GetAll(ctx, f)
+	require.NoError(t, err)
+	require.Len(t, books, 2)
+	require.Equal(t, "QFT", books[0].Title)
+
+	// the same query with conditions and values in another order
+	same := *f
+	same.Where = []m.Condition{
+		{Field: "price", Op: m.OpLt, Values: []any{12.0}},
+		{Field: "author", Op: m.OpIn, Values: []any{"Dirac", "Bohr"}},
+	}
+	books, err = c.GetAll(ctx, &same)
+	require.NoError(t, err)
+	require.Len(t, books, 2)
+	require.Equal(t, int32(1), backend.lists.Load())
+
+	// another page is another listing
+	other := *f
+	other.Offset = 1
+	books, err = c.GetAll(ctx, &other)
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	require.Equal(t, int32(2), backend.lists.Load())
+
+	n, err := c.Count(ctx, f.Where, CountExact)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+}
+
+func TestCachedListsInvalidation(t *testing.T) {
+	c, backend, _ := cachedBooks(t)
+	c.ListTTL = time.Minute
+	ctx := t.Context()
+
+	byAuthor := &m.Filters[m.Book]{
+		Where: []m.Condition{{Field: "author", Op: m.OpEq, Values: []any{"Bohr"}}},
+		Sort:  []m.SortField{{Field: "title"}},
+		Limit: 10,
+	}
+	cheapest := &m.Filters[m.Book]{Sort: []m.SortField{{Field: "price"}}, Limit: 1}
+	// reloaded tells whether f is listed from the database again
+	reloaded := func(f *m.Filters[m.Book]) bool {
+		t.Helper()
+		before := backend.lists.Load()
+		_, err := c.GetAll(ctx, f)
+		require.NoError(t, err)
+		return backend.lists.Load() > before
+	}
+	require.True(t, reloaded(byAuthor))
+	require.True(t, reloaded(cheapest))
+
+	tests := []struct {
+		name               string
+		write              func() error
+		byAuthor, cheapest bool
+	}{
+		{"Price of a book not listed", func() error { return c.Update(ctx, "2", map[string]any{"price": 1.0}) }, false, true},
+		{"Author of a book not listed", func() error { return c.Update(ctx, "3", map[string]any{"Author": "Bohr"}) }, true, false},
+		{"Title of a listed book", func() error { return c.Update(ctx, "2", map[string]any{"title": "RQM"}) }, true, true},
+		{"Sort field", func() error { return c.Update(ctx, "3", map[string]any{"title": "EM"}) }, true, false},
+		{"Insert", func() error { return c.Insert(ctx, "", &m.Book{Title: "SR", Author: "Bohr"}) }, true, true},
+		{"Delete", func() error { return c.Delete(ctx, "4") }, true, true},
+		{"Failed update", func() error { return c.Update(ctx, "42", map[string]any{"title": "X"}) }, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.write(); err != nil {
+				require.ErrorIs(t, err, ErrNotFound)
+			}
+			require.Equal(t, tt.byAuthor, reloaded(byAuthor), "by author")
+			require.Equal(t, tt.cheapest, reloaded(cheapest), "cheapest")
+		})
+	}
+
+	books, err := c.GetAll(ctx, byAuthor)
+	require.NoError(t, err)
+	require.Len(t, books, 2)
+	require.Equal(t, "EM", books[0].Title)
+}
+
+func TestCachedListsTransactions(t *testing.T) {
+	c, backend, mr := cachedBooks(t)
+	c.ListTTL = time.Minute
+	ctx := t.Context()
+	f := &m.Filters[m.Book]{Sort: []m.SortField{{Field: "title"}}, Limit: 10}
+
+	err := c.WithTx(ctx, nil, func(tx Tx) error {
+		if err := c.Insert(tx.Context(), "", &m.Book{Title: "SR"}); err != nil {
+			return err
+		}
+		books, err := c.GetAll(tx.Context(), f)
+		if err != nil {
+			return err
+		}
+		require.Len(t, books, 4)
+		return errors.New("abort")
+	})
+	require.EqualError(t, err, "abort")
+	// only the insert's eviction left a trace
+	require.Equal(t, []string{"{book:lists}:gen"}, mr.Keys(), "a transaction's listings are not cached")
+
+	// a listing cached while a transaction writes is evicted on commit
+	err = c.WithTx(ctx, nil, func(tx Tx) error {
+		if err := c.Insert(tx.Context(), "", &m.Book{Title: "SR"}); err != nil {
+			return err
+		}
+		_, err := c.GetAll(ctx, f)
+		return err
+	})
+	require.NoError(t, err)
+	books, err := c.GetAll(ctx, f)
+	require.NoError(t, err)
+	require.Len(t, books, 4)
+	// the listing of the transaction, then the one cached meanwhile, then
+	// the one after the commit
+	require.Equal(t, int32(3), backend.lists.Load())
+}
+
+func TestCachedListsLoadsRacingWrites(t *testing.T) {
+	c, backend, _ := cachedBooks(t)
+	c.ListTTL = time.Minute
+	ctx := t.Context()
+	f := &m.Filters[m.Book]{Sort: []m.SortField{{Field: "title"}}, Limit: 10}
+
+	// a listing is read, then an insert evicts the listings before it is
+	// cached
+	backend.release = make(chan struct{})
+	stale := make(chan []*m.Book, 1)
+	go func() {
+		books, err := c.GetAll(ctx, f)
+		if err != nil {
+			t.Errorf("GetAll: %v", err)
+		}
+		stale <- books
+	}()
+	require.Eventually(t, func() bool { return backend.lists.Load() == 1 }, time.Second, time.Millisecond)
+	require.NoError(t, c.Insert(ctx, "", &m.Book{Title: "SR"}))
+	close(backend.release)
+	require.Len(t, <-stale, 3)
+
+	backend.release = nil
+	books, err := c.GetAll(ctx, f)
+	require.NoError(t, err)
+	require.Len(t, books, 4)
+	require.Equal(t, int32(2), backend.lists.Load())
+}
+
+// afterCommand runs fn once, after the first command named name.
+type afterCommand struct {
+	name string
+	once *sync.Once
+	fn   func()
+}
+
+func (h afterCommand) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h afterCommand) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if cmd.Name() == h.name {
+			h.once.Do(h.fn)
+		}
+		return err
+	}
+}
+
+func (h afterCommand) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestCachedListsEvictionIsAtomic(t *testing.T) {
+	c, _, mr := cachedBooks(t)
+	c.ListTTL = time.Minute
+	ctx := t.Context()
+	f := &m.Filters[m.Book]{Limit: 10}
+	_, err := c.GetAll(ctx, f)
+	require.NoError(t, err)
+
+	// a listing is cached between the eviction reading the tags and
+	// deleting them
+	late := c.listKey("getall", "late")
+	c.Client.AddHook(afterCommand{name: "sunion", once: new(sync.Once), fn: func() {
+		require.NoError(t, mr.Set(late, "[]"))
+		_, err := mr.SAdd(c.listKey("tag", "all"), late)
+		require.NoError(t, err)
+	}})
+	require.NoError(t, c.Delete(ctx, "1"))
+
+	// it is evicted too, instead of outliving its tag
+	require.False(t, mr.Exists(late))
+	require.False(t, mr.Exists(c.listKey("tag", "all")))
+	books, err := c.GetAll(ctx, f)
+	require.NoError(t, err)
+	require.Len(t, books, 2)
+}
+
+func TestCachedListsSurviveRedisOutage(t *testing.T) {
+	c, _, mr := cachedBooks(t)
+	c.ListTTL = time.Minute
+	ctx := t.Context()
+	mr.Close()
+
+	books, err := c.GetAll(ctx, &m.Filters[m.Book]{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, books, 3)
+	n, err := c.Count(ctx, nil, CountExact)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.NoError(t, c.Update(ctx, "1", map[string]any{"price": 2.0}))
+}
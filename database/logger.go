@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"k8s-backend/logging"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// gormLogger routes gorm's logs through the logger in the query context, so
+// SQL statements carry the request ID of the request that issued them.
+type gormLogger struct {
+	SlowThreshold time.Duration
+	level         logger.LogLevel
+}
+
+func NewGormLogger(slowThreshold time.Duration) logger.Interface {
+	return &gormLogger{SlowThreshold: slowThreshold, level: logger.Info}
+}
+
+func (l *gormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	clone := *l
+	clone.level = level
+	return &clone
+}
+
+func (l *gormLogger) Info(ctx context.Context, msg string, args ...any) {
+	if l.level >= logger.Info {
+		logging.FromContext(ctx).InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Warn(ctx context.Context, msg string, args ...any) {
+	if l.level >= logger.Warn {
+		logging.FromContext(ctx).WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Error(ctx context.Context, msg string, args ...any) {
+	if l.level >= logger.Error {
+		logging.FromContext(ctx).ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+// Trace logs every statement at debug level, slow ones as warnings and
+// failures (other than a missing record) as errors.
+func (l *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= logger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	log := logging.FromContext(ctx)
+
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= logger.Error:
+		sql, rows := fc()
+		log.ErrorContext(ctx, "query failed", "sql", sql, "rows", rows, "elapsed", elapsed, "error", err)
+	case l.SlowThreshold > 0 && elapsed > l.SlowThreshold && l.level >= logger.Warn:
+		sql, rows := fc()
+		log.WarnContext(ctx, "slow query", "sql", sql, "rows", rows, "elapsed", elapsed, "threshold", l.SlowThreshold)
+	case l.level >= logger.Info && log.Enabled(ctx, slog.LevelDebug):
+		sql, rows := fc()
+		log.DebugContext(ctx, "query", "sql", sql, "rows", rows, "elapsed", elapsed)
+	}
+}
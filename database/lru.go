@@ -0,0 +1,90 @@
+package database
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lru is an in-process cache holding at most size values, each until its
+// expiry, evicting the least recently used one when full. It is safe for
+// concurrent use.
+type lru[V any] struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is the most recently used
+}
+
+type lruEntry[V any] struct {
+	key    string
+	value  V
+	expiry time.Time
+}
+
+func newLRU[V any](size int) *lru[V] {
+	return &lru[V]{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the value under key unless it expired by now.
+func (l *lru[V]) get(key string, now time.Time) (V, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var zero V
+	e, ok := l.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := e.Value.(*lruEntry[V])
+	if !now.Before(entry.expiry) {
+		l.order.Remove(e)
+		delete(l.entries, key)
+		return zero, false
+	}
+	l.order.MoveToFront(e)
+	return entry.value, true
+}
+
+// add stores value under key until expiry.
+func (l *lru[V]) add(key string, value V, expiry time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.entries[key]; ok {
+		e.Value = &lruEntry[V]{key: key, value: value, expiry: expiry}
+		l.order.MoveToFront(e)
+		return
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry[V]{key: key, value: value, expiry: expiry})
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+func (l *lru[V]) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.entries[key]; ok {
+		l.order.Remove(e)
+		delete(l.entries, key)
+	}
+}
+
+func (l *lru[V]) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	clear(l.entries)
+	l.order.Init()
+}
+
+func (l *lru[V]) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
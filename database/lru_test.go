@@ -0,0 +1,43 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRU(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Minute)
+	l := newLRU[int](2)
+
+	l.add("a", 1, later)
+	l.add("b", 2, later)
+	_, ok := l.get("a", now)
+	require.True(t, ok)
+
+	// b is the least recently used
+	l.add("c", 3, later)
+	require.Equal(t, 2, l.len())
+	_, ok = l.get("b", now)
+	require.False(t, ok)
+
+	l.add("a", 10, later)
+	v, ok := l.get("a", now)
+	require.True(t, ok)
+	require.Equal(t, 10, v)
+
+	// entries expire
+	_, ok = l.get("c", later)
+	require.False(t, ok)
+	require.Equal(t, 1, l.len())
+
+	l.remove("a")
+	_, ok = l.get("a", now)
+	require.False(t, ok)
+
+	l.add("d", 4, later)
+	l.clear()
+	require.Zero(t, l.len())
+}
@@ -0,0 +1,396 @@
+// Package migrate applies the versioned schema migrations embedded in the
+// binary. A migration is a pair of files, <version>_<name>.up.sql and
+// <version>_<name>.down.sql, in the directory of its dialect; the versions
+// applied are recorded in the schema_migrations table. Other sets of
+// migrations, such as those of a model the application does not embed, keep
+// their own history table.
+package migrate
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Table records the applied migrations of the embedded set.
+const Table = "schema_migrations"
+
+// lockKey identifies the Postgres advisory lock held while migrating, the same
+// for every replica.
+const lockKey int64 = 0x6b38732d6d6967 // "k8s-mig"
+
+//go:embed postgres/*.sql sqlite/*.sql
+var embedded embed.FS
+
+// Migration is one versioned change to the schema.
+type Migration struct {
+	Version int
+	Name    string
+	// Up applies the change and Down reverts it.
+	Up, Down string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations in the root of fsys, ordered by version. Every
+// migration must have both an up and a down file.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		match := fileName.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			return nil, fmt.Errorf("migration %s: not named <version>_<name>.up.sql or .down.sql", e.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		if version <= 0 {
+			return nil, fmt.Errorf("migration %s: version must be positive", e.Name())
+		}
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %s: version %d is also named %s", e.Name(), version, m.Name)
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %s: needs both an up and a down file", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return cmp.Compare(a.Version, b.Version) })
+	return migrations, nil
+}
+
+// For returns the migrations embedded for dialect, "postgres" or "sqlite".
+func For(dialect string) ([]Migration, error) {
+	sub, err := fs.Sub(embedded, dialect)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := Load(sub)
+	if err != nil {
+		return nil, err
+	}
+	if len(migrations) == 0 {
+		return nil, fmt.Errorf("no migrations for dialect %q", dialect)
+	}
+	return migrations, nil
+}
+
+// Status is a migration and whether it is applied.
+type Status struct {
+	Migration
+	// AppliedAt is zero for a pending migration.
+	AppliedAt time.Time
+}
+
+// Migrator brings a database schema up or down. On Postgres it holds an
+// advisory lock while it does, so that replicas booting together migrate one
+// after the other; each migration also checks, in its own transaction, that
+// it was not applied meanwhile.
+type Migrator struct {
+	DB *sql.DB
+	// Dialect is "postgres" or "sqlite".
+	Dialect    string
+	Migrations []Migration
+	// History is the table recording which Migrations are applied, Table if
+	// empty. Each set of migrations needs its own.
+	History string
+	// DryRun writes the statements that would run to Out instead of running
+	// them.
+	DryRun bool
+	Out    io.Writer
+}
+
+// New returns a Migrator for the migrations embedded for dialect.
+func New(db *sql.DB, dialect string) (*Migrator, error) {
+	migrations, err := For(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Dialect: dialect, Migrations: migrations}, nil
+}
+
+// Latest is the version of the last migration.
+func (m *Migrator) Latest() int {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+// Status lists the known migrations, in order, followed by any applied
+// version the binary does not know about, e.g. after a rollback of the
+// deployment.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.Migrations))
+	for _, mig := range m.Migrations {
+		statuses = append(statuses, Status{Migration: mig, AppliedAt: applied[mig.Version].AppliedAt})
+		delete(applied, mig.Version)
+	}
+	for _, s := range applied {
+		statuses = append(statuses, s)
+	}
+	slices.SortStableFunc(statuses[len(m.Migrations):], func(a, b Status) int { return cmp.Compare(a.Version, b.Version) })
+	return statuses, nil
+}
+
+// Pending returns the migrations that are not applied yet.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	applied, err := m.applied(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, mig := range m.Migrations {
+		if _, ok := applied[mig.Version]; !ok {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies the pending migrations up to version to, or all of them if to is
+// 0, and returns those it applied.
+func (m *Migrator) Up(ctx context.Context, to int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.Migrations {
+			if to > 0 && mig.Version > to {
+				break
+			}
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			ok, err := m.run(ctx, conn, mig, true)
+			if err != nil {
+				return err
+			}
+			if ok {
+				done = append(done, mig)
+			}
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns
+// those it reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for v := range applied {
+			if v > m.Latest() {
+				return fmt.Errorf("version %d is applied but unknown to this binary: revert it with the binary that applied it", v)
+			}
+		}
+		for i := len(m.Migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := m.Migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			ok, err := m.run(ctx, conn, mig, false)
+			if err != nil {
+				return err
+			}
+			if ok {
+				done = append(done, mig)
+			}
+		}
+		return nil
+	})
+	return done, err
+}
+
+// locked runs fn on a dedicated connection, holding the advisory lock on
+// Postgres, after creating the version table.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) (err error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.Dialect == "postgres" {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+			return fmt.Errorf("acquiring the migration lock: %w", err)
+		}
+		defer func() {
+			// the lock goes with the session should unlocking fail
+			if _, unlockErr := conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", lockKey); unlockErr != nil {
+				err = errors.Join(err, conn.Raw(func(any) error { return driver.ErrBadConn }))
+			}
+		}()
+	}
+
+	if !m.DryRun {
+		if _, err := conn.ExecContext(ctx, m.createTable()); err != nil {
+			return fmt.Errorf("creating %s: %w", m.history(), err)
+		}
+	}
+	return fn(conn)
+}
+
+// run applies mig, or reverts it if up is false, along with its version row in
+// one transaction. It reports false if another migrator got there first.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, mig Migration, up bool) (bool, error) {
+	direction, body := "up", mig.Up
+	if !up {
+		direction, body = "down", mig.Down
+	}
+
+	if m.DryRun {
+		out := m.Out
+		if out == nil {
+			out = io.Discard
+		}
+		_, err := fmt.Fprintf(out, "-- %s (%s)\n%s\n", mig, direction, body)
+		return true, err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRowContext(ctx, m.bind("SELECT count(*) FROM "+m.history()+" WHERE version = ?"), mig.Version).Scan(&n); err != nil {
+		return false, err
+	}
+	if applied := n > 0; applied == up {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, body); err != nil {
+		return false, fmt.Errorf("migration %s (%s): %w", mig, direction, err)
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, m.bind("INSERT INTO "+m.history()+" (version, name, applied_at) VALUES (?, ?, ?)"), mig.Version, mig.Name, time.Now().UTC())
+	} else {
+		_, err = tx.ExecContext(ctx, m.bind("DELETE FROM "+m.history()+" WHERE version = ?"), mig.Version)
+	}
+	if err != nil {
+		return false, fmt.Errorf("recording migration %s (%s): %w", mig, direction, err)
+	}
+	return true, tx.Commit()
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// applied returns the applied migrations by version; none if the version
+// table does not exist yet.
+func (m *Migrator) applied(ctx context.Context, q querier) (map[int]Status, error) {
+	var exists bool
+	if err := q.QueryRowContext(ctx, m.tableExists(), m.history()).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("looking up %s: %w", m.history(), err)
+	}
+	applied := make(map[int]Status)
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := q.QueryContext(ctx, "SELECT version, name, applied_at FROM "+m.history())
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", m.history(), err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s Status
+		if err := rows.Scan(&s.Version, &s.Name, &s.AppliedAt); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", m.history(), err)
+		}
+		applied[s.Version] = s
+	}
+	return applied, rows.Err()
+}
+
+func (m *Migrator) history() string {
+	if m.History != "" {
+		return m.History
+	}
+	return Table
+}
+
+func (m *Migrator) createTable() string {
+	if m.Dialect == "postgres" {
+		return "CREATE TABLE IF NOT EXISTS " + m.history() + " (version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL)"
+	}
+	return "CREATE TABLE IF NOT EXISTS " + m.history() + " (version integer PRIMARY KEY, name text NOT NULL, applied_at timestamp NOT NULL)"
+}
+
+func (m *Migrator) tableExists() string {
+	if m.Dialect == "postgres" {
+		return "SELECT to_regclass($1) IS NOT NULL"
+	}
+	return "SELECT count(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?"
+}
+
+// bind numbers the ? placeholders of query for Postgres.
+func (m *Migrator) bind(query string) string {
+	if m.Dialect != "postgres" {
+		return query
+	}
+	var out []byte
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			out = strconv.AppendInt(append(out, '$'), int64(n), 10)
+			continue
+		}
+		out = append(out, query[i])
+	}
+	return string(out)
+}
@@ -0,0 +1,227 @@
+package migrate
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/stretchr/testify/require"
+)
+
+var testMigrations = fstest.MapFS{
+	"0001_create_shelves.up.sql":   {Data: []byte("CREATE TABLE shelves (id integer PRIMARY KEY, name text);")},
+	"0001_create_shelves.down.sql": {Data: []byte("DROP TABLE shelves;")},
+	"0002_add_floor.up.sql":        {Data: []byte("ALTER TABLE shelves ADD COLUMN floor integer;\nUPDATE shelves SET floor = 1;")},
+	"0002_add_floor.down.sql":      {Data: []byte("ALTER TABLE shelves DROP COLUMN floor;")},
+}
+
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "migrate.db")
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_txlock=immediate")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newMigrator(t *testing.T, db *sql.DB) *Migrator {
+	t.Helper()
+	migrations, err := Load(testMigrations)
+	require.NoError(t, err)
+	return &Migrator{DB: db, Dialect: "sqlite", Migrations: migrations}
+}
+
+func versions(migrations []Migration) []int {
+	var v []int
+	for _, m := range migrations {
+		v = append(v, m.Version)
+	}
+	return v
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(testMigrations)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, versions(migrations))
+	require.Equal(t, "0002_add_floor", migrations[1].String())
+	require.Contains(t, migrations[1].Down, "DROP COLUMN")
+
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{"Unexpected file", fstest.MapFS{"README.md": {}}},
+		{"Zero version", fstest.MapFS{"0_init.up.sql": {Data: []byte("x")}, "0_init.down.sql": {Data: []byte("x")}}},
+		{"Missing down", fstest.MapFS{"0001_init.up.sql": {Data: []byte("x")}}},
+		{"Name mismatch", fstest.MapFS{"0001_init.up.sql": {Data: []byte("x")}, "0001_other.down.sql": {Data: []byte("x")}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.files)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestEmbeddedDialectsMatch(t *testing.T) {
+	pg, err := For("postgres")
+	require.NoError(t, err)
+	lite, err := For("sqlite")
+	require.NoError(t, err)
+
+	// both dialects describe the same schema history
+	require.Equal(t, len(pg), len(lite))
+	for i := range pg {
+		require.Equal(t, pg[i].String(), lite[i].String())
+	}
+
+	_, err = For("mysql")
+	require.Error(t, err)
+}
+
+func TestUpDownStatus(t *testing.T) {
+	db := openSQLite(t)
+	m := newMigrator(t, db)
+	ctx := t.Context()
+
+	pending, err := m.Pending(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, versions(pending))
+
+	done, err := m.Up(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, versions(done))
+	_, err = db.Exec("INSERT INTO shelves (name) VALUES ('physics')")
+	require.NoError(t, err)
+
+	done, err = m.Up(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, []int{2}, versions(done))
+	var floor int
+	require.NoError(t, db.QueryRow("SELECT floor FROM shelves").Scan(&floor))
+	require.Equal(t, 1, floor)
+
+	// up to date: nothing to do
+	done, err = m.Up(ctx, 0)
+	require.NoError(t, err)
+	require.Empty(t, done)
+
+	statuses, err := m.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	for _, s := range statuses {
+		require.False(t, s.AppliedAt.IsZero(), s.Migration)
+	}
+
+	done, err = m.Down(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []int{2}, versions(done))
+	require.Error(t, db.QueryRow("SELECT floor FROM shelves").Scan(&floor))
+
+	statuses, err = m.Status(ctx)
+	require.NoError(t, err)
+	require.True(t, statuses[1].AppliedAt.IsZero())
+
+	done, err = m.Down(ctx, 5)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, versions(done))
+	pending, err = m.Pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	db := openSQLite(t)
+	m := newMigrator(t, db)
+	m.Migrations = append(m.Migrations, Migration{
+		Version: 3,
+		Name:    "broken",
+		Up:      "ALTER TABLE shelves ADD COLUMN aisle integer; SELECT * FROM nowhere;",
+		Down:    "ALTER TABLE shelves DROP COLUMN aisle;",
+	})
+
+	done, err := m.Up(t.Context(), 0)
+	require.ErrorContains(t, err, "0003_broken")
+	require.Equal(t, []int{1, 2}, versions(done))
+
+	// the first statement of the failed migration was rolled back with it
+	_, err = db.Exec("SELECT aisle FROM shelves")
+	require.Error(t, err)
+	pending, err := m.Pending(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []int{3}, versions(pending))
+}
+
+func TestDryRun(t *testing.T) {
+	db := openSQLite(t)
+	m := newMigrator(t, db)
+	var out strings.Builder
+	m.DryRun, m.Out = true, &out
+
+	done, err := m.Up(t.Context(), 0)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, versions(done))
+	require.Contains(t, out.String(), "-- 0001_create_shelves (up)\nCREATE TABLE shelves")
+	require.Contains(t, out.String(), "-- 0002_add_floor (up)")
+
+	// nothing ran, not even the creation of the version table
+	var tables int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM sqlite_master").Scan(&tables))
+	require.Zero(t, tables)
+}
+
+func TestDownRefusesUnknownVersions(t *testing.T) {
+	db := openSQLite(t)
+	m := newMigrator(t, db)
+	_, err := m.Up(t.Context(), 0)
+	require.NoError(t, err)
+
+	// an older binary knows only the first migration
+	old := &Migrator{DB: db, Dialect: "sqlite", Migrations: m.Migrations[:1]}
+	statuses, err := old.Status(t.Context())
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	require.Equal(t, "add_floor", statuses[1].Name)
+
+	_, err = old.Down(t.Context(), 1)
+	require.ErrorContains(t, err, "version 2")
+}
+
+func TestConcurrentUpAppliesOnce(t *testing.T) {
+	db := openSQLite(t)
+
+	// replicas booting together
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		total []Migration
+	)
+	for range 4 {
+		m := newMigrator(t, db)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done, err := m.Up(t.Context(), 0)
+			if err != nil {
+				t.Errorf("Up: %v", err)
+				return
+			}
+			mu.Lock()
+			total = append(total, done...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	require.Len(t, total, 2)
+}
+
+func TestBind(t *testing.T) {
+	m := &Migrator{Dialect: "postgres"}
+	require.Equal(t, "INSERT INTO t VALUES ($1, $2)", m.bind("INSERT INTO t VALUES (?, ?)"))
+	m.Dialect = "sqlite"
+	require.Equal(t, "SELECT ?", m.bind("SELECT ?"))
+}
@@ -0,0 +1,10 @@
+-- IF NOT EXISTS adopts the table AutoMigrate created before migrations existed.
+CREATE TABLE IF NOT EXISTS books (
+    id bigserial,
+    title text,
+    author varchar(255),
+    price decimal,
+    created_at text,
+    PRIMARY KEY (id),
+    CONSTRAINT uni_books_title UNIQUE (title)
+);
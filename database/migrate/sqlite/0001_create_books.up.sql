@@ -0,0 +1,9 @@
+-- IF NOT EXISTS adopts the table AutoMigrate created before migrations existed.
+CREATE TABLE IF NOT EXISTS books (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    title text,
+    author text,
+    price real,
+    created_at text,
+    CONSTRAINT uni_books_title UNIQUE (title)
+);
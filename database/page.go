@@ -0,0 +1,239 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+
+	m "k8s-backend/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CountMode selects how Count computes a total.
+type CountMode int
+
+const (
+	// CountExact counts every matching record.
+	CountExact CountMode = iota
+	// CountEstimate may answer from statistics instead, which is much cheaper
+	// on large tables. Backends without statistics count exactly.
+	CountEstimate
+)
+
+// Page is one page of a keyset-paginated listing.
+type Page[T any] struct {
+	Items []*T
+	// Next and Prev position the following and preceding pages; nil at
+	// either end of the listing.
+	Next, Prev *m.Cursor
+}
+
+// GetPage lists the page of f.Limit records f describes. It asks d for one
+// extra record to tell whether the listing continues past the page.
+func GetPage[T any](ctx context.Context, d Database[T], f *m.Filters[T]) (*Page[T], error) {
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := sortKeys(cols, f.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	probe := *f
+	probe.Limit = f.Limit + 1
+	items, err := d.GetAll(ctx, &probe)
+	if err != nil {
+		return nil, err
+	}
+
+	more := len(items) > f.Limit
+	var hasNext, hasPrev bool
+	if f.Cursor != nil && f.Cursor.Backward {
+		// the extra record precedes the page
+		if more {
+			items = items[1:]
+		}
+		hasNext, hasPrev = true, more
+	} else {
+		if more {
+			items = items[:f.Limit]
+		}
+		hasNext, hasPrev = more, f.Cursor != nil || f.Offset > 0
+	}
+
+	page := &Page[T]{Items: items}
+	if len(items) == 0 {
+		return page, nil
+	}
+	if hasNext {
+		page.Next = &m.Cursor{Values: keyValues(keys, items[len(items)-1])}
+	}
+	if hasPrev {
+		page.Prev = &m.Cursor{Values: keyValues(keys, items[0]), Backward: true}
+	}
+	return page, nil
+}
+
+// sortKey is one column of the total order a listing is paginated by.
+type sortKey struct {
+	col  Column
+	desc bool
+}
+
+func (k sortKey) column(db *gorm.DB) clause.Column {
+	return collated(db, k.col)
+}
+
+// sortKeys returns the sort fields followed by the primary key, which breaks
+// ties so that every record has a unique position to resume from.
+func sortKeys(cols *columnSet, sort []m.SortField) ([]sortKey, error) {
+	keys := make([]sortKey, 0, len(sort)+1)
+	var hasPrimaryKey bool
+	for _, s := range sort {
+		col, ok := cols.byName[s.Field]
+		if !ok {
+			return nil, fmt.Errorf("%w: cannot sort by unknown field %q", ErrValidation, s.Field)
+		}
+		hasPrimaryKey = hasPrimaryKey || col.PrimaryKey
+		keys = append(keys, sortKey{col: col, desc: s.Desc})
+	}
+	if cols.primaryKey != nil && !hasPrimaryKey {
+		keys = append(keys, sortKey{col: *cols.primaryKey})
+	}
+	return keys, nil
+}
+
+// cursorValues converts the cursor's values to the types of the sort keys;
+// decoded cursors carry them as JSON numbers and strings.
+func cursorValues(keys []sortKey, cur *m.Cursor) ([]any, error) {
+	if len(cur.Values) != len(keys) {
+		return nil, fmt.Errorf("%w: cursor does not match the sort order", ErrValidation)
+	}
+	values := make([]any, len(keys))
+	for i, k := range keys {
+		v, err := parseValue(k.col.Type, fmt.Sprint(cur.Values[i]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: cursor value for %s: %v", ErrValidation, k.col.Name, err)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// keysetExpr selects the records after values in the order of keys, or
+// before them when backward:
+//
+//	k1 > v1 OR (k1 = v1 AND k2 > v2) OR ...
+//
+// with < in place of > for descending keys. Unlike a row comparison this
+// works when keys are sorted in different directions.
+func keysetExpr(db *gorm.DB, keys []sortKey, values []any, backward bool) clause.Expression {
+	or := make([]clause.Expression, 0, len(keys))
+	for i, k := range keys {
+		and := make([]clause.Expression, 0, i+1)
+		for j := range i {
+			and = append(and, clause.Eq{Column: keys[j].column(db), Value: values[j]})
+		}
+		if k.desc != backward {
+			and = append(and, clause.Lt{Column: k.column(db), Value: values[i]})
+		} else {
+			and = append(and, clause.Gt{Column: k.column(db), Value: values[i]})
+		}
+		or = append(or, clause.And(and...))
+	}
+	return clause.Or(or...)
+}
+
+// keyValues returns the sort key of record.
+func keyValues[T any](keys []sortKey, record *T) []any {
+	v := reflect.ValueOf(record).Elem()
+	values := make([]any, len(keys))
+	for i, k := range keys {
+		values[i] = v.FieldByName(k.col.Field).Interface()
+	}
+	return values
+}
+
+// compareKeys orders two sort keys like ORDER BY would, a backward listing
+// in reverse.
+func compareKeys(keys []sortKey, a, b []any, backward bool) int {
+	for i, k := range keys {
+		c := compareValue(reflect.ValueOf(a[i]), reflect.ValueOf(b[i]))
+		if k.desc != backward {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// page applies the order, keyset, offset and limit of f to records already
+// filtered by f.Where. It is the in-memory counterpart of applyFilters.
+func page[T any](cols *columnSet, records []*T, f *m.Filters[T]) ([]*T, error) {
+	keys, err := sortKeys(cols, f.Sort)
+	if err != nil {
+		return nil, err
+	}
+	backward := f.Cursor != nil && f.Cursor.Backward
+
+	type keyed struct {
+		record *T
+		key    []any
+	}
+	sorted := make([]keyed, 0, len(records))
+	for _, r := range records {
+		sorted = append(sorted, keyed{record: r, key: keyValues(keys, r)})
+	}
+	slices.SortStableFunc(sorted, func(a, b keyed) int {
+		return compareKeys(keys, a.key, b.key, backward)
+	})
+
+	if f.Cursor != nil {
+		values, err := cursorValues(keys, f.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		start, _ := slices.BinarySearchFunc(sorted, values, func(r keyed, v []any) int {
+			if compareKeys(keys, r.key, v, backward) <= 0 {
+				return -1
+			}
+			return 1
+		})
+		sorted = sorted[start:]
+	}
+
+	sorted = sorted[min(f.Offset, len(sorted)):]
+	sorted = sorted[:min(f.Limit, len(sorted))]
+
+	out := make([]*T, len(sorted))
+	for i, r := range sorted {
+		out[i] = r.record
+	}
+	if backward {
+		slices.Reverse(out)
+	}
+	return out, nil
+}
+
+// planRows extracts the top-level row estimate from EXPLAIN (FORMAT JSON).
+func planRows(plan string) (int64, error) {
+	var explain []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		}
+	}
+	if err := json.Unmarshal([]byte(plan), &explain); err != nil {
+		return 0, fmt.Errorf("parsing query plan: %w", err)
+	}
+	if len(explain) == 0 {
+		return 0, fmt.Errorf("parsing query plan: empty plan")
+	}
+	return int64(explain[0].Plan.Rows), nil
+}
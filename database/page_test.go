@@ -0,0 +1,126 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	m "k8s-backend/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeysetSQL(t *testing.T) {
+	sort := []m.SortField{{Field: "price", Desc: true}, {Field: "title"}}
+
+	sql, vars, err := render(t, &m.Filters[m.Book]{
+		Sort:   sort,
+		Limit:  10,
+		Cursor: &m.Cursor{Values: []any{json.Number("10.99"), "QM", json.Number("1")}},
+	})
+	require.NoError(t, err)
+	require.Equal(t,
+		`SELECT * FROM "books" WHERE ("price" < $1 OR ("price" = $2 AND "title" COLLATE "C" > $3) OR ("price" = $4 AND "title" COLLATE "C" = $5 AND "id" > $6)) ORDER BY "price" DESC,"title" COLLATE "C","id" LIMIT $7`,
+		sql)
+	require.Equal(t, []any{10.99, 10.99, "QM", 10.99, "QM", 1, 10}, vars)
+
+	sql, _, err = render(t, &m.Filters[m.Book]{
+		Sort:   sort,
+		Limit:  10,
+		Cursor: &m.Cursor{Values: []any{10.99, "QM", 1}, Backward: true},
+	})
+	require.NoError(t, err)
+	require.Equal(t,
+		`SELECT * FROM "books" WHERE ("price" > $1 OR ("price" = $2 AND "title" COLLATE "C" < $3) OR ("price" = $4 AND "title" COLLATE "C" = $5 AND "id" < $6)) ORDER BY "price","title" COLLATE "C" DESC,"id" DESC LIMIT $7`,
+		sql)
+
+	_, _, err = render(t, &m.Filters[m.Book]{Sort: sort, Cursor: &m.Cursor{Values: []any{10.99}}})
+	require.ErrorIs(t, err, ErrValidation)
+	_, _, err = render(t, &m.Filters[m.Book]{Sort: sort, Cursor: &m.Cursor{Values: []any{"cheap", "QM", 1}}})
+	require.ErrorIs(t, err, ErrValidation)
+}
+
+func newBooks(n int) *Cache[m.Book] {
+	c := &Cache[m.Book]{Data: make(map[string]*m.Book)}
+	for i := 1; i <= n; i++ {
+		// prices repeat so the primary key has to break ties
+		c.Data[fmt.Sprint(i)] = &m.Book{Id: i, Title: fmt.Sprintf("B%02d", i), Price: float64(i % 3)}
+	}
+	return c
+}
+
+func ids(books []*m.Book) []int {
+	out := make([]int, len(books))
+	for i, b := range books {
+		out[i] = b.Id
+	}
+	return out
+}
+
+func TestGetPageWalksBothWays(t *testing.T) {
+	c := newBooks(7)
+	f := m.Filters[m.Book]{Sort: []m.SortField{{Field: "price", Desc: true}}, Limit: 3}
+
+	// price desc, id asc: 2,5 (price 2), 1,4,7 (price 1), 3,6 (price 0)
+	first, err := GetPage[m.Book](t.Context(), c, &f)
+	require.NoError(t, err)
+	require.Equal(t, []int{2, 5, 1}, ids(first.Items))
+	require.Nil(t, first.Prev)
+	require.NotNil(t, first.Next)
+
+	f.Cursor = first.Next
+	second, err := GetPage[m.Book](t.Context(), c, &f)
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 7, 3}, ids(second.Items))
+
+	f.Cursor = second.Next
+	last, err := GetPage[m.Book](t.Context(), c, &f)
+	require.NoError(t, err)
+	require.Equal(t, []int{6}, ids(last.Items))
+	require.Nil(t, last.Next)
+
+	f.Cursor = last.Prev
+	back, err := GetPage[m.Book](t.Context(), c, &f)
+	require.NoError(t, err)
+	require.Equal(t, []int{4, 7, 3}, ids(back.Items))
+
+	f.Cursor = back.Prev
+	back, err = GetPage[m.Book](t.Context(), c, &f)
+	require.NoError(t, err)
+	require.Equal(t, []int{2, 5, 1}, ids(back.Items))
+	require.Nil(t, back.Prev)
+	require.NotNil(t, back.Next)
+}
+
+func TestGetPageIsStableUnderInserts(t *testing.T) {
+	c := newBooks(6)
+	f := m.Filters[m.Book]{Sort: []m.SortField{{Field: "title"}}, Limit: 2}
+
+	first, err := GetPage[m.Book](t.Context(), c, &f)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2}, ids(first.Items))
+
+	// a book sorting before the cursor would shift an offset by one
+	c.Data["0"] = &m.Book{Id: 100, Title: "A00"}
+
+	f.Cursor = first.Next
+	second, err := GetPage[m.Book](t.Context(), c, &f)
+	require.NoError(t, err)
+	require.Equal(t, []int{3, 4}, ids(second.Items))
+}
+
+func TestCacheCount(t *testing.T) {
+	c := newBooks(7)
+	n, err := c.Count(t.Context(), []m.Condition{{Field: "price", Op: m.OpGte, Values: []any{1.0}}}, CountEstimate)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+}
+
+func TestPlanRows(t *testing.T) {
+	n, err := planRows(`[{"Plan": {"Node Type": "Seq Scan", "Plan Rows": 1234, "Plan Width": 72}}]`)
+	require.NoError(t, err)
+	require.Equal(t, int64(1234), n)
+
+	_, err = planRows(`[]`)
+	require.Error(t, err)
+}
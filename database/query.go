@@ -0,0 +1,294 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	m "k8s-backend/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Column is a model field clients may sort and filter on. Only columns
+// returned by Columns ever reach the SQL text; everything a client sends is
+// either matched against them or bound as a parameter.
+type Column struct {
+	// Name is the field's JSON name, the one used in query parameters.
+	Name string
+	// DBName is the column name in the table, from the gorm tags.
+	DBName string
+	// Field is the Go struct field name.
+	Field      string
+	Type       reflect.Type
+	PrimaryKey bool
+	// Updatable is false for the primary key and for fields gorm only
+	// writes on create, tagged gorm:"<-:create".
+	Updatable bool
+}
+
+// columnSet holds the whitelist both by name and in struct field order, so
+// the generated SQL does not depend on map iteration order.
+type columnSet struct {
+	byName     map[string]Column
+	ordered    []Column
+	primaryKey *Column
+	// uniques lists the Go field names of every unique constraint, from
+	// gorm's unique and uniqueIndex tags and the primary key.
+	uniques [][]string
+}
+
+var (
+	columnCache  sync.Map // reflect.Type -> *columnSet
+	schemaCache  sync.Map
+	schemaNaming = schema.NamingStrategy{}
+)
+
+// Columns returns the whitelist of queryable columns of T keyed by JSON name.
+// Fields tagged json:"-" or gorm:"-" are left out. The map is shared and must
+// not be modified.
+func Columns[T any]() (map[string]Column, error) {
+	set, err := columnsOf[T]()
+	if err != nil {
+		return nil, err
+	}
+	return set.byName, nil
+}
+
+// tableOf returns the name of the table T is stored in.
+func tableOf[T any]() (string, error) {
+	s, err := schema.Parse(new(T), &schemaCache, schemaNaming)
+	if err != nil {
+		return "", fmt.Errorf("parsing schema of %s: %w", reflect.TypeFor[T](), err)
+	}
+	return s.Table, nil
+}
+
+func columnsOf[T any]() (*columnSet, error) {
+	t := reflect.TypeFor[T]()
+	if set, ok := columnCache.Load(t); ok {
+		return set.(*columnSet), nil
+	}
+
+	s, err := schema.Parse(new(T), &schemaCache, schemaNaming)
+	if err != nil {
+		return nil, fmt.Errorf("parsing schema of %s: %w", t, err)
+	}
+
+	set := &columnSet{byName: make(map[string]Column, len(s.Fields))}
+	for _, f := range s.Fields {
+		if f.DBName == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(f.StructField.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		col := Column{Name: name, DBName: f.DBName, Field: f.Name, Type: f.FieldType, PrimaryKey: f.PrimaryKey, Updatable: f.Updatable && !f.PrimaryKey}
+		set.byName[name] = col
+		set.ordered = append(set.ordered, col)
+		if col.PrimaryKey && set.primaryKey == nil {
+			set.primaryKey = &col
+		}
+	}
+
+	for _, f := range s.Fields {
+		if f.Unique && !f.PrimaryKey {
+			set.uniques = append(set.uniques, []string{f.Name})
+		}
+	}
+	for _, idx := range s.ParseIndexes() {
+		if idx.Class != "UNIQUE" {
+			continue
+		}
+		fields := make([]string, len(idx.Fields))
+		for i, f := range idx.Fields {
+			fields[i] = f.Name
+		}
+		set.uniques = append(set.uniques, fields)
+	}
+
+	columnCache.Store(t, set)
+	return set, nil
+}
+
+// ParseSort parses a comma separated sort expression such as "-price,title"
+// into sort fields of T. A leading "-" sorts descending, a leading "+" or no
+// prefix ascending. Unknown or repeated fields are rejected with a
+// *QueryError.
+func ParseSort[T any](raw string) ([]m.SortField, error) {
+	cols, err := Columns[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []m.SortField
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var desc bool
+		switch part[0] {
+		case '-':
+			desc, part = true, part[1:]
+		case '+':
+			part = part[1:]
+		}
+
+		if _, ok := cols[part]; !ok {
+			return nil, &QueryError{Param: "sort", Message: fmt.Sprintf("cannot sort by unknown field %q", part)}
+		}
+		if seen[part] {
+			return nil, &QueryError{Param: "sort", Message: fmt.Sprintf("field %q is sorted on more than once", part)}
+		}
+		seen[part] = true
+		fields = append(fields, m.SortField{Field: part, Desc: desc})
+	}
+	return fields, nil
+}
+
+// applyFilters adds the conditions, order and keyset of f to query. Column
+// names come from the whitelist and are quoted by gorm, filter and cursor
+// values are always bound. A backward cursor reverses the order; callers
+// reverse the records back.
+func applyFilters[T any](query *gorm.DB, f *m.Filters[T]) (*gorm.DB, error) {
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := sortKeys(cols, f.Sort)
+	if err != nil {
+		return nil, err
+	}
+	backward := f.Cursor != nil && f.Cursor.Backward
+	for _, k := range keys {
+		query = query.Order(clause.OrderByColumn{Column: k.column(query), Desc: k.desc != backward})
+	}
+
+	if query, err = applyWhere(query, cols, f.Where); err != nil {
+		return nil, err
+	}
+
+	if f.Cursor != nil {
+		values, err := cursorValues(keys, f.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where(keysetExpr(query, keys, values, backward))
+	}
+	return query, nil
+}
+
+// applyWhere adds the conditions to query.
+func applyWhere(query *gorm.DB, cols *columnSet, where []m.Condition) (*gorm.DB, error) {
+	for _, c := range where {
+		col, ok := cols.byName[c.Field]
+		if !ok {
+			return nil, fmt.Errorf("%w: cannot filter on unknown field %q", ErrValidation, c.Field)
+		}
+		if err := validateCondition(col, c); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrValidation, c.Field, err)
+		}
+		column := clause.Column{Name: col.DBName}
+		switch c.Op {
+		case m.OpLt, m.OpLte, m.OpGt, m.OpGte, m.OpBetween:
+			column = collated(query, col)
+		}
+		query = query.Where(conditionExpr(column, c))
+	}
+	return query, nil
+}
+
+// collated returns col to order by and compare with: strings compare byte
+// by byte as in Cache[T], whatever the collation of the database, so that
+// every backend returns the same pages. SQLite already does; Postgres is
+// told to with COLLATE "C", which cannot use an index in another collation.
+func collated(db *gorm.DB, col Column) clause.Column {
+	if kindOf(col.Type) != reflect.String || db.Dialector.Name() != "postgres" {
+		return clause.Column{Name: col.DBName}
+	}
+	return clause.Column{Name: db.Statement.Quote(col.DBName) + ` COLLATE "C"`, Raw: true}
+}
+
+// conditionExpr translates a validated condition into SQL on column.
+func conditionExpr(column clause.Column, c m.Condition) clause.Expression {
+	switch c.Op {
+	case m.OpNe:
+		return clause.Neq{Column: column, Value: c.Values[0]}
+	case m.OpLt:
+		return clause.Lt{Column: column, Value: c.Values[0]}
+	case m.OpLte:
+		return clause.Lte{Column: column, Value: c.Values[0]}
+	case m.OpGt:
+		return clause.Gt{Column: column, Value: c.Values[0]}
+	case m.OpGte:
+		return clause.Gte{Column: column, Value: c.Values[0]}
+	case m.OpIn:
+		return clause.IN{Column: column, Values: c.Values}
+	case m.OpBetween:
+		return clause.Expr{SQL: "? BETWEEN ? AND ?", Vars: []any{column, c.Values[0], c.Values[1]}}
+	case m.OpPrefix:
+		return like{Column: column, Value: escapeLike(c.Values[0].(string)) + "%"}
+	case m.OpContains:
+		return like{Column: column, Value: "%" + escapeLike(c.Values[0].(string)) + "%", Fold: true}
+	case m.OpIsNull:
+		if c.Values[0].(bool) {
+			return clause.Expr{SQL: "? IS NULL", Vars: []any{column}}
+		}
+		return clause.Expr{SQL: "? IS NOT NULL", Vars: []any{column}}
+	default:
+		return clause.Eq{Column: column, Value: c.Values[0]}
+	}
+}
+
+// like matches Column against the LIKE pattern Value, built with escapeLike.
+// Fold makes the match case-insensitive: ILIKE in Postgres, LOWER on both
+// sides elsewhere. Other databases are also told the escape character, which
+// Postgres defaults to; SQLite connections must enable case_sensitive_like for
+// an unfolded match to be case-sensitive as in Postgres.
+type like struct {
+	Column clause.Column
+	Value  string
+	Fold   bool
+}
+
+func (l like) Build(builder clause.Builder) {
+	if stmt, ok := builder.(*gorm.Statement); ok && stmt.Dialector.Name() != "postgres" {
+		if l.Fold {
+			builder.WriteString("LOWER(")
+			builder.WriteQuoted(l.Column)
+			builder.WriteString(") LIKE LOWER(")
+			builder.AddVar(builder, l.Value)
+			builder.WriteString(")")
+		} else {
+			builder.WriteQuoted(l.Column)
+			builder.WriteString(" LIKE ")
+			builder.AddVar(builder, l.Value)
+		}
+		builder.WriteString(` ESCAPE '\'`)
+		return
+	}
+
+	builder.WriteQuoted(l.Column)
+	if l.Fold {
+		builder.WriteString(" ILIKE ")
+	} else {
+		builder.WriteString(" LIKE ")
+	}
+	builder.AddVar(builder, l.Value)
+}
+
+// escapeLike escapes the LIKE wildcards in s so they match literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
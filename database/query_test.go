@@ -0,0 +1,350 @@
+package database
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+
+	m "k8s-backend/model"
+
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// dryRun returns a gorm handle that renders SQL without connecting.
+func dryRun(t testing.TB) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+	})
+	require.NoError(t, err)
+	return db
+}
+
+// render returns the SELECT gorm would run for f, and its bound values.
+func render(t testing.TB, f *m.Filters[m.Book]) (string, []any, error) {
+	t.Helper()
+	query, err := applyFilters(dryRun(t).Model(new(m.Book)), f)
+	if err != nil {
+		return "", nil, err
+	}
+	if f.Limit > 0 {
+		query = query.Limit(f.Limit).Offset(f.Offset)
+	}
+	var books []*m.Book
+	stmt := query.Find(&books).Statement
+	return stmt.SQL.String(), stmt.Vars, nil
+}
+
+func TestColumns(t *testing.T) {
+	cols, err := Columns[m.Book]()
+	require.NoError(t, err)
+
+	names := make([]string, 0, len(cols))
+	for name := range cols {
+		names = append(names, name)
+	}
+	require.ElementsMatch(t, []string{"id", "title", "author", "price", "created_at"}, names)
+	require.Equal(t, "created_at", cols["created_at"].DBName)
+	require.Equal(t, "CreatedAt", cols["created_at"].Field)
+	require.True(t, cols["id"].PrimaryKey)
+}
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []m.SortField
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"title", []m.SortField{{Field: "title"}}, false},
+		{"-price,title", []m.SortField{{Field: "price", Desc: true}, {Field: "title"}}, false},
+		{" +author , -created_at ", []m.SortField{{Field: "author"}, {Field: "created_at", Desc: true}}, false},
+		{"Title", nil, true},
+		{"price,-price", nil, true},
+		{"title; DROP TABLE books", nil, true},
+		{"--title", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ParseSort[m.Book](tt.raw)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrValidation)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestApplyFilters(t *testing.T) {
+	sql, vars, err := render(t, &m.Filters[m.Book]{
+		Where: []m.Condition{
+			{Field: "title", Op: m.OpContains, Values: []any{"50%_off"}},
+			{Field: "price", Op: m.OpGte, Values: []any{10.0}},
+		},
+		Limit:  10,
+		Offset: 20,
+		Sort:   []m.SortField{{Field: "price", Desc: true}, {Field: "title"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t,
+		`SELECT * FROM "books" WHERE "title" ILIKE $1 AND "price" >= $2 ORDER BY "price" DESC,"title" COLLATE "C","id" LIMIT $3 OFFSET $4`,
+		sql)
+	require.Equal(t, []any{`%50\%\_off%`, 10.0, 10, 20}, vars)
+
+	_, _, err = render(t, &m.Filters[m.Book]{Sort: []m.SortField{{Field: "price DESC; --"}}})
+	require.ErrorIs(t, err, ErrValidation)
+	_, _, err = render(t, &m.Filters[m.Book]{Where: []m.Condition{{Field: "1=1 OR title", Op: m.OpEq, Values: []any{"QM"}}}})
+	require.ErrorIs(t, err, ErrValidation)
+	_, _, err = render(t, &m.Filters[m.Book]{Where: []m.Condition{{Field: "price", Op: m.OpEq, Values: []any{"10"}}}})
+	require.ErrorIs(t, err, ErrValidation)
+}
+
+func TestConditionSQL(t *testing.T) {
+	tests := []struct {
+		op     m.Operator
+		field  string
+		values []any
+		sql    string
+	}{
+		{m.OpEq, "author", []any{"Bohr"}, `"author" = $1`},
+		{m.OpNe, "author", []any{"Bohr"}, `"author" <> $1`},
+		{m.OpLt, "price", []any{20.0}, `"price" < $1`},
+		{m.OpLte, "price", []any{20.0}, `"price" <= $1`},
+		{m.OpGt, "id", []any{1}, `"id" > $1`},
+		{m.OpGte, "id", []any{1}, `"id" >= $1`},
+		{m.OpGte, "title", []any{"Q"}, `"title" COLLATE "C" >= $1`},
+		{m.OpIn, "author", []any{"Bohr", "Dirac"}, `"author" IN ($1,$2)`},
+		{m.OpBetween, "price", []any{10.0, 20.0}, `"price" BETWEEN $1 AND $2`},
+		{m.OpPrefix, "title", []any{"Q"}, `"title" LIKE $1`},
+		{m.OpContains, "title", []any{"q"}, `"title" ILIKE $1`},
+		{m.OpIsNull, "author", []any{true}, `"author" IS NULL`},
+		{m.OpIsNull, "author", []any{false}, `"author" IS NOT NULL`},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.op), func(t *testing.T) {
+			sql, vars, err := render(t, &m.Filters[m.Book]{
+				Where: []m.Condition{{Field: tt.field, Op: tt.op, Values: tt.values}},
+			})
+			require.NoError(t, err)
+			require.Equal(t, `SELECT * FROM "books" WHERE `+tt.sql+` ORDER BY "id"`, sql)
+			if tt.op != m.OpIsNull {
+				require.Len(t, vars, len(tt.values))
+			}
+		})
+	}
+}
+
+func TestConditionSQLite(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{DryRun: true})
+	require.NoError(t, err)
+	cols, err := columnsOf[m.Book]()
+	require.NoError(t, err)
+
+	tests := []struct {
+		op  m.Operator
+		sql string
+	}{
+		{m.OpPrefix, "`title` LIKE ? ESCAPE '\\'"},
+		// SQLite has no ILIKE
+		{m.OpContains, "LOWER(`title`) LIKE LOWER(?) ESCAPE '\\'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.op), func(t *testing.T) {
+			query, err := applyWhere(db.Model(new(m.Book)), cols, []m.Condition{{Field: "title", Op: tt.op, Values: []any{"q_"}}})
+			require.NoError(t, err)
+			stmt := query.Find(&[]*m.Book{}).Statement
+			require.Equal(t, "SELECT * FROM `books` WHERE "+tt.sql, stmt.SQL.String())
+			require.Contains(t, stmt.Vars[0], `q\_`)
+		})
+	}
+}
+
+func TestParseWhere(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    []m.Condition
+		wantErr string
+	}{
+		{
+			name:  "Operators",
+			query: "price[lte]=20&author[in]=Bohr,Dirac",
+			want: []m.Condition{
+				{Field: "author", Op: m.OpIn, Values: []any{"Bohr", "Dirac"}},
+				{Field: "price", Op: m.OpLte, Values: []any{20.0}},
+			},
+		},
+		{
+			name:  "Bare parameters keep their old meaning",
+			query: "title=qm&price=10&id=2",
+			want: []m.Condition{
+				{Field: "id", Op: m.OpGte, Values: []any{2}},
+				{Field: "price", Op: m.OpGte, Values: []any{10.0}},
+				{Field: "title", Op: m.OpContains, Values: []any{"qm"}},
+			},
+		},
+		{
+			name:  "Repeated parameters are ANDed",
+			query: "price[gt]=10&price[lt]=20&title[isnull]=false",
+			want: []m.Condition{
+				{Field: "price", Op: m.OpGt, Values: []any{10.0}},
+				{Field: "price", Op: m.OpLt, Values: []any{20.0}},
+				{Field: "title", Op: m.OpIsNull, Values: []any{false}},
+			},
+		},
+		{name: "Between", query: "price[between]=10,20", want: []m.Condition{{Field: "price", Op: m.OpBetween, Values: []any{10.0, 20.0}}}},
+		{name: "Unknown field", query: "isbn=1", wantErr: "isbn"},
+		{name: "Unknown operator", query: "price[like]=1", wantErr: "price[like]"},
+		{name: "Wrong type", query: "price[lt]=cheap", wantErr: "price[lt]"},
+		{name: "Prefix on a number", query: "price[prefix]=1", wantErr: "price[prefix]"},
+		{name: "Between needs two values", query: "price[between]=10", wantErr: "price[between]"},
+		{name: "Isnull needs a bool", query: "author[isnull]=maybe", wantErr: "author[isnull]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+
+			got, err := ParseWhere[m.Book](params)
+			if tt.wantErr != "" {
+				var qe *QueryError
+				require.ErrorAs(t, err, &qe)
+				require.Equal(t, tt.wantErr, qe.Param)
+				require.ErrorIs(t, err, ErrValidation)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCacheFilters(t *testing.T) {
+	c := &Cache[m.Book]{}
+	require.NoError(t, c.Initialize())
+	c.Data = map[string]*m.Book{
+		"1": {Id: 1, Title: "QM", Author: "Bohr", Price: 10.99},
+		"2": {Id: 2, Title: "QFT", Author: "Dirac", Price: 11.99},
+		"3": {Id: 3, Title: "GR", Author: "Einstein", Price: 12.99},
+	}
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"price[lte]=12&author[in]=Bohr,Dirac", []int{1, 2}},
+		{"price[between]=11,13", []int{2, 3}},
+		{"title[prefix]=Q&author[ne]=Bohr", []int{2}},
+		{"title=r", []int{3}},
+		{"id[gt]=1&id[lt]=3", []int{2}},
+		{"author[isnull]=true", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			params, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+			where, err := ParseWhere[m.Book](params)
+			require.NoError(t, err)
+
+			books, err := c.GetAll(t.Context(), &m.Filters[m.Book]{Where: where, Limit: 10})
+			require.NoError(t, err)
+			var ids []int
+			for _, b := range books {
+				ids = append(ids, b.Id)
+			}
+			require.ElementsMatch(t, tt.want, ids)
+		})
+	}
+}
+
+// sortedSelect matches a SELECT whose ORDER BY is made only of whitelisted,
+// quoted columns.
+var sortedSelect = regexp.MustCompile(`^SELECT \* FROM "books" ORDER BY "(id|title|author|price|created_at)"( COLLATE "C")?( DESC)?(,"(id|title|author|price|created_at)"( COLLATE "C")?( DESC)?)* LIMIT \$1$`)
+
+func FuzzParseSort(f *testing.F) {
+	for _, seed := range []string{"title", "-price,title", "title; DROP TABLE books", `"title"`, "price DESC", "-", ",,"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		fields, err := ParseSort[m.Book](raw)
+		if err != nil {
+			require.ErrorIs(t, err, ErrValidation)
+			return
+		}
+		if len(fields) == 0 {
+			return
+		}
+
+		sql, _, err := render(t, &m.Filters[m.Book]{Sort: fields, Limit: 10})
+		require.NoError(t, err)
+		require.Regexp(t, sortedSelect, sql)
+	})
+}
+
+func FuzzFilterValues(f *testing.F) {
+	for _, seed := range []string{"QM", "'; DROP TABLE books; --", `" OR 1=1 --`, "%", `\`, "$1"} {
+		f.Add(seed, seed, 1.5)
+	}
+
+	where := func(title, author string, price float64) []m.Condition {
+		return []m.Condition{
+			{Field: "title", Op: m.OpContains, Values: []any{title}},
+			{Field: "author", Op: m.OpIn, Values: []any{author, title}},
+			{Field: "price", Op: m.OpBetween, Values: []any{price, price}},
+		}
+	}
+
+	// the SQL text must not depend on the values, only on which filters are set
+	want, _, err := render(f, &m.Filters[m.Book]{Where: where("t", "a", 1), Limit: 10})
+	require.NoError(f, err)
+
+	f.Fuzz(func(t *testing.T, title, author string, price float64) {
+		sql, vars, err := render(t, &m.Filters[m.Book]{Where: where(title, author, price), Limit: 10})
+		require.NoError(t, err)
+		require.Equal(t, want, sql)
+		require.Equal(t, "%"+escapeLike(title)+"%", vars[0])
+	})
+}
+
+func FuzzParseWhere(f *testing.F) {
+	for _, seed := range []string{"price[lte]=20&author[in]=Bohr,Dirac", "title=x", "title[eq]=';--", "title]=x", "[eq]=1", "price[between]=1,2,3"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, query string) {
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return
+		}
+		where, err := ParseWhere[m.Book](params)
+		if err != nil {
+			require.ErrorIs(t, err, ErrValidation)
+			return
+		}
+
+		// whatever parses, renders with whitelisted columns and bound values only
+		sql, _, err := render(t, &m.Filters[m.Book]{Where: where})
+		require.NoError(t, err)
+		require.Regexp(t, filteredSelect, sql)
+	})
+}
+
+// filteredSelect matches a SELECT whose WHERE only compares whitelisted,
+// quoted columns with placeholders, ordered by the primary key.
+var filteredSelect = func() *regexp.Regexp {
+	column := `"(id|title|author|price|created_at)"( COLLATE "C")?`
+	predicate := column + ` ((=|<>|<|<=|>|>=|LIKE|ILIKE) \$\d+|IN \(\$\d+(,\$\d+)*\)|BETWEEN \$\d+ AND \$\d+|IS NULL|IS NOT NULL)`
+	return regexp.MustCompile(`^SELECT \* FROM "books"( WHERE ` + predicate + `( AND ` + predicate + `)*)? ORDER BY "id"$`)
+}()
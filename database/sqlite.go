@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+
+	"k8s-backend/config"
+	"k8s-backend/database/migrate"
+	m "k8s-backend/model"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+// SQLite is a Database[T] on an embedded SQLite database, through a pure-Go
+// driver, so it needs neither cgo nor a database server. It stores the same
+// table as Postgres[T] and answers queries the same way.
+type SQLite[T any] struct {
+	// DB, when set before Initialize, is the connection of another backend,
+	// shared so that transactions can span both. Close leaves it open.
+	DB *gorm.DB
+	// Config.Path is the database file; empty or ":memory:" keeps the
+	// database in memory, where it is lost on Close.
+	Config       config.SQLite
+	InitElements []T
+	// ManualMigrations makes Initialize check that the schema is up to date
+	// instead of migrating it, when `migrate up` runs as a deployment step.
+	ManualMigrations bool
+	// Migrations create and evolve the table of T, for a model the embedded
+	// migrations do not cover; nil runs the embedded ones. Initialize fails
+	// if T's table is still missing after migrating.
+	Migrations []migrate.Migration
+
+	shared bool
+}
+
+// sqlitePragmas are run on every connection: LIKE is case-sensitive as in
+// Postgres, and writers wait for each other instead of failing.
+const sqlitePragmas = "_pragma=case_sensitive_like(1)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_txlock=immediate"
+
+// openSQLite opens the database file, or an in-memory database.
+func openSQLite(cfg config.SQLite) (*gorm.DB, error) {
+	inMemory := cfg.Path == "" || cfg.Path == ":memory:"
+	dsn := cfg.Path + "?" + sqlitePragmas + "&_pragma=journal_mode(WAL)"
+	if inMemory {
+		dsn = ":memory:?" + sqlitePragmas
+	}
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: NewGormLogger(cfg.SlowQueryThreshold),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if inMemory {
+		// every connection to :memory: opens a database of its own
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
+
+func (s *SQLite[T]) Initialize() error {
+	if s.DB != nil {
+		s.shared = true
+		return migrateSchema[T](context.Background(), s.DB, s.ManualMigrations, s.Migrations)
+	}
+
+	var err error
+	if s.DB, err = openSQLite(s.Config); err != nil {
+		return err
+	}
+	if err := migrateSchema[T](context.Background(), s.DB, s.ManualMigrations, s.Migrations); err != nil {
+		return err
+	}
+
+	slog.Info("Database opened", "path", s.Config.Path)
+
+	return nil
+}
+
+func (s *SQLite[T]) store() *sqlStore[T] {
+	return &sqlStore[T]{db: s.DB, timeout: s.Config.QueryTimeout, translate: sqliteError}
+}
+
+func (s *SQLite[T]) Close() error {
+	if s.shared {
+		return nil
+	}
+	return s.store().close()
+}
+
+func (s *SQLite[T]) Seed(ctx context.Context) error {
+	return s.store().seed(ctx, s.InitElements)
+}
+
+func (s *SQLite[T]) Ping(ctx context.Context) error {
+	return s.store().Ping(ctx)
+}
+
+func (s *SQLite[T]) Get(ctx context.Context, id string) (*T, error) {
+	return s.store().Get(ctx, id)
+}
+
+func (s *SQLite[T]) GetAll(ctx context.Context, f *m.Filters[T]) ([]*T, error) {
+	return s.store().GetAll(ctx, f)
+}
+
+// Count always counts exactly, SQLite keeps no row estimates.
+func (s *SQLite[T]) Count(ctx context.Context, where []m.Condition, mode CountMode) (int64, error) {
+	return s.store().Count(ctx, where, mode)
+}
+
+func (s *SQLite[T]) Insert(ctx context.Context, id string, element *T) error {
+	return s.store().Insert(ctx, id, element)
+}
+
+func (s *SQLite[T]) Update(ctx context.Context, id string, fields map[string]any) error {
+	return s.store().Update(ctx, id, fields)
+}
+
+func (s *SQLite[T]) Delete(ctx context.Context, id string) error {
+	return s.store().Delete(ctx, id)
+}
+
+func (s *SQLite[T]) WithTx(ctx context.Context, opts *TxOptions, fn func(tx Tx) error) error {
+	return s.store().WithTx(ctx, opts, fn)
+}
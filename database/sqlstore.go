@@ -0,0 +1,323 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"k8s-backend/database/migrate"
+	m "k8s-backend/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sqlStore implements the Database[T] operations on an open gorm connection,
+// whichever SQL database is behind it. Backends open the connection and
+// delegate to it; translate maps their driver errors onto the sentinel errors.
+type sqlStore[T any] struct {
+	db        *gorm.DB
+	timeout   time.Duration
+	translate func(error) error
+}
+
+// migrateSchema applies the pending migrations of the database behind db
+// or, with manual migrations, fails if there are any. These are the embedded
+// ones unless a model brings its own, recorded in a history table of their
+// own. It then fails if the model's table is still missing.
+func migrateSchema[T any](ctx context.Context, db *gorm.DB, manual bool, migrations []migrate.Migration) error {
+	table, err := tableOf[T]()
+	if err != nil {
+		return err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	mig, err := migrate.New(sqlDB, db.Dialector.Name())
+	if err != nil {
+		return err
+	}
+	if migrations != nil {
+		mig.Migrations = migrations
+		mig.History = migrate.Table + "_" + table
+	}
+
+	if manual {
+		pending, err := mig.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%w: %d schema migrations pending, from %s: run migrate up", ErrUnavailable, len(pending), pending[0])
+		}
+	} else {
+		applied, err := mig.Up(ctx, 0)
+		for _, a := range applied {
+			slog.Info("Applied migration", "migration", a.String())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !db.WithContext(ctx).Migrator().HasTable(table) {
+		return fmt.Errorf("%w: no table %s: the embedded migrations only create the application's tables, give the backend the Migrations of its model", ErrUnavailable, table)
+	}
+	return nil
+}
+
+// seed inserts the i-th element unless a record with id i+1 already exists.
+func (s *sqlStore[T]) seed(ctx context.Context, initElements []T) error {
+	db, cancel, err := s.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	for i, e := range initElements {
+		var existing T
+		result := db.Limit(1).Find(&existing, i+1)
+		if err := result.Error; err != nil {
+			return fmt.Errorf("seeding: %w", s.translate(err))
+		}
+		if result.RowsAffected == 0 {
+			if err := db.Create(&e).Error; err != nil {
+				return fmt.Errorf("seeding: %w", s.translate(err))
+			}
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore[T]) close() error {
+	if s.db == nil {
+		return nil
+	}
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+func (s *sqlStore[T]) Ping(ctx context.Context) error {
+	if s.db == nil {
+		return fmt.Errorf("%w: not initialized", ErrUnavailable)
+	}
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return s.translate(err)
+	}
+	return s.translate(sqlDB.PingContext(ctx))
+}
+
+// session bounds the operation by timeout unless ctx already carries an
+// earlier deadline; the query is cancelled with ctx. It runs in the
+// transaction ctx carries, if any.
+func (s *sqlStore[T]) session(ctx context.Context) (*gorm.DB, context.CancelFunc, error) {
+	db := s.db
+	switch tx := txFrom(ctx).(type) {
+	case nil:
+	case *sqlTx:
+		if tx.pool != s.db.ConnPool {
+			return nil, nil, errForeignTx
+		}
+		db = tx.db
+	default:
+		return nil, nil, errForeignTx
+	}
+
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		return db.WithContext(ctx), cancel, nil
+	}
+	return db.WithContext(ctx), func() {}, nil
+}
+
+// byID restricts query to the record with the given id. The id is converted
+// to the primary key's type first, so a malformed id is a validation error
+// whether or not the database would compare it loosely.
+func (s *sqlStore[T]) byID(query *gorm.DB, id string) (*gorm.DB, error) {
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return nil, err
+	}
+	if cols.primaryKey == nil {
+		// gorm looks the id up on its own, as it always did
+		return query.Where(id), nil
+	}
+	key, err := parseValue(cols.primaryKey.Type, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: id: %v", ErrValidation, err)
+	}
+	return query.Where(clause.Eq{Column: clause.Column{Name: cols.primaryKey.DBName}, Value: key}), nil
+}
+
+func (s *sqlStore[T]) Get(ctx context.Context, id string) (*T, error) {
+	db, cancel, err := s.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	query, err := s.byID(db, id)
+	if err != nil {
+		return nil, err
+	}
+	var record T
+	if err := query.First(&record).Error; err != nil {
+		return nil, s.translate(err)
+	}
+	return &record, nil
+}
+
+func (s *sqlStore[T]) GetAll(ctx context.Context, f *m.Filters[T]) ([]*T, error) {
+	db, cancel, err := s.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	query, err := applyFilters(db.Model(new(T)), f)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*T
+	if err := query.Limit(f.Limit).Offset(f.Offset).Find(&records).Error; err != nil {
+		return nil, fmt.Errorf("error finding records: %w", s.translate(err))
+	}
+	if f.Cursor != nil && f.Cursor.Backward {
+		slices.Reverse(records)
+	}
+
+	return records, nil
+}
+
+// Count counts the records matching where. On Postgres CountEstimate returns
+// the planner's row estimate, computed from table statistics, instead of
+// scanning; it is only as fresh as the last ANALYZE. Other databases count
+// exactly.
+func (s *sqlStore[T]) Count(ctx context.Context, where []m.Condition, mode CountMode) (int64, error) {
+	db, cancel, err := s.session(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return 0, err
+	}
+
+	if mode == CountEstimate && db.Dialector.Name() == "postgres" {
+		// render the query without running it, then ask the planner about it
+		dry := db.Session(&gorm.Session{DryRun: true}).Model(new(T))
+		if dry, err = applyWhere(dry, cols, where); err != nil {
+			return 0, err
+		}
+		stmt := dry.Find(&[]*T{}).Statement
+
+		var plan string
+		row := db.ConnPool.QueryRowContext(db.Statement.Context, "EXPLAIN (FORMAT JSON) "+stmt.SQL.String(), stmt.Vars...)
+		if err := row.Scan(&plan); err != nil {
+			return 0, fmt.Errorf("estimating count: %w", s.translate(err))
+		}
+		return planRows(plan)
+	}
+
+	query, err := applyWhere(db.Model(new(T)), cols, where)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if err := query.Count(&n).Error; err != nil {
+		return 0, fmt.Errorf("counting records: %w", s.translate(err))
+	}
+	return n, nil
+}
+
+func (s *sqlStore[T]) Insert(ctx context.Context, _ string, element *T) error {
+	if err := writable(ctx); err != nil {
+		return err
+	}
+	db, cancel, err := s.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	// GORM handles primary key auto-increment
+	if err := db.Create(element).Error; err != nil {
+		return s.translate(err)
+	}
+
+	return nil
+}
+
+func (s *sqlStore[T]) Update(ctx context.Context, id string, fields map[string]any) error {
+	if err := writable(ctx); err != nil {
+		return err
+	}
+	db, cancel, err := s.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	cols, err := columnsOf[T]()
+	if err != nil {
+		return err
+	}
+	// like sort and filter fields, only whitelisted columns reach the SQL
+	columns := make(map[string]any, len(fields))
+	for name, value := range fields {
+		col, err := updatableColumn(cols, name)
+		if err != nil {
+			return err
+		}
+		columns[col.DBName] = value
+	}
+
+	query, err := s.byID(db.Model(new(T)), id)
+	if err != nil {
+		return err
+	}
+	// Updates only sets the given fields, unlike Save
+	result := query.Updates(columns)
+	if err := result.Error; err != nil {
+		return s.translate(err)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: id %s", ErrNotFound, id)
+	}
+	return nil
+}
+
+func (s *sqlStore[T]) Delete(ctx context.Context, id string) error {
+	if err := writable(ctx); err != nil {
+		return err
+	}
+	db, cancel, err := s.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	query, err := s.byID(db, id)
+	if err != nil {
+		return err
+	}
+	result := query.Delete(new(T))
+	if err := result.Error; err != nil {
+		return s.translate(err)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: id %s", ErrNotFound, id)
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrSerialization is returned when a transaction lost a race with a
+// concurrent one and still did after its retries. It is a conflict: the client
+// may try again.
+var ErrSerialization = fmt.Errorf("%w: transaction could not be serialized with concurrent ones", ErrConflict)
+
+// Tx is a unit of work running in WithTx. Every Database[T] call made with
+// its Context joins it, whichever model the backend stores, provided the
+// backend shares the transaction's connection: Postgres[T] and SQLite[T]
+// sharing a DB, or any Cache[T].
+type Tx interface {
+	// Context carries the transaction; pass it, or a context derived from
+	// it, to the calls that belong to the unit of work.
+	Context() context.Context
+	// Savepoint runs fn in a nested transaction. If fn fails, only its changes
+	// are rolled back and its error is returned; the outer transaction goes on.
+	Savepoint(fn func(tx Tx) error) error
+}
+
+// TxOptions configures WithTx. A nil *TxOptions uses the backend's default
+// isolation level and DefaultTxRetries.
+type TxOptions struct {
+	// Isolation is the isolation level, e.g. sql.LevelSerializable.
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// Retries is how many times fn is run again after a serialization
+	// failure or deadlock; 0 uses DefaultTxRetries, a negative value none.
+	Retries int
+}
+
+// DefaultTxRetries is the number of retries when TxOptions.Retries is 0.
+const DefaultTxRetries = 3
+
+func (o *TxOptions) retries() int {
+	switch {
+	case o == nil || o.Retries == 0:
+		return DefaultTxRetries
+	case o.Retries < 0:
+		return 0
+	default:
+		return o.Retries
+	}
+}
+
+func (o *TxOptions) sqlOptions() *sql.TxOptions {
+	if o == nil {
+		return nil
+	}
+	return &sql.TxOptions{Isolation: o.Isolation, ReadOnly: o.ReadOnly}
+}
+
+type txKey struct{}
+
+// txFrom returns the transaction ctx carries, if any.
+func txFrom(ctx context.Context) Tx {
+	tx, _ := ctx.Value(txKey{}).(Tx)
+	return tx
+}
+
+// errForeignTx is returned when a call is made with the context of a
+// transaction the backend cannot join, rather than silently running outside
+// of it.
+var errForeignTx = errors.New("database: the context carries a transaction on another database")
+
+// writable fails writes in a read-only transaction up front, as not every
+// database refuses them itself.
+func writable(ctx context.Context) error {
+	var readOnly bool
+	switch tx := txFrom(ctx).(type) {
+	case *sqlTx:
+		readOnly = tx.readOnly
+	case *memTx:
+		readOnly = tx.readOnly
+	}
+	if readOnly {
+		return fmt.Errorf("%w: cannot write in a read-only transaction", ErrValidation)
+	}
+	return nil
+}
+
+// afterCommit runs fn once the transaction ctx carries commits, or right away
+// outside of one. It is dropped if the transaction rolls back.
+func afterCommit(ctx context.Context, fn func()) {
+	switch tx := txFrom(ctx).(type) {
+	case *sqlTx:
+		tx.committed = append(tx.committed, fn)
+	case *memTx:
+		tx.committed = append(tx.committed, fn)
+	default:
+		fn()
+	}
+}
+
+// retry runs attempt until it succeeds, fails with something other than
+// ErrSerialization or runs out of retries, backing off a little more each
+// time so that the contenders spread out.
+func retry(ctx context.Context, opts *TxOptions, attempt func() error) error {
+	retries := opts.retries()
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil || !errors.Is(err, ErrSerialization) || i >= retries {
+			return err
+		}
+
+		backoff := time.Duration(1<<i) * 5 * time.Millisecond
+		backoff += rand.N(backoff)
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// sqlTx is a transaction on a gorm connection pool.
+type sqlTx struct {
+	ctx       context.Context
+	db        *gorm.DB
+	pool      gorm.ConnPool
+	translate func(error) error
+	readOnly  bool
+
+	savepoints int
+	committed  []func()
+}
+
+func (t *sqlTx) Context() context.Context {
+	return t.ctx
+}
+
+func (t *sqlTx) Savepoint(fn func(tx Tx) error) error {
+	t.savepoints++
+	name := fmt.Sprintf("sp%d", t.savepoints)
+	if err := t.db.SavePoint(name).Error; err != nil {
+		return t.translate(err)
+	}
+	if err := fn(t); err != nil {
+		if rbErr := t.db.RollbackTo(name).Error; rbErr != nil {
+			return errors.Join(err, t.translate(rbErr))
+		}
+		return err
+	}
+	return nil
+}
+
+// WithTx runs fn in a transaction on the store's connection, committing if it
+// returns nil and rolling back otherwise. Called with the context of a
+// transaction on the same connection, it runs fn in a savepoint of it.
+func (s *sqlStore[T]) WithTx(ctx context.Context, opts *TxOptions, fn func(tx Tx) error) error {
+	switch tx := txFrom(ctx).(type) {
+	case nil:
+	case *sqlTx:
+		if tx.pool != s.db.ConnPool {
+			return errForeignTx
+		}
+		return tx.Savepoint(fn)
+	default:
+		return errForeignTx
+	}
+
+	return retry(ctx, opts, func() error {
+		db := s.db.WithContext(ctx).Begin(opts.sqlOptions())
+		if err := db.Error; err != nil {
+			return s.translate(err)
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				db.Rollback()
+				panic(p)
+			}
+		}()
+
+		tx := &sqlTx{db: db, pool: s.db.ConnPool, translate: s.translate, readOnly: opts != nil && opts.ReadOnly}
+		tx.ctx = context.WithValue(ctx, txKey{}, Tx(tx))
+		if err := fn(tx); err != nil {
+			db.Rollback()
+			return err
+		}
+		if err := db.Commit().Error; err != nil {
+			return s.translate(err)
+		}
+		for _, fn := range tx.committed {
+			fn()
+		}
+		return nil
+	})
+}
+
+// memTxLock serializes in-memory transactions, which are therefore
+// serializable whatever isolation level is asked for.
+var memTxLock sync.Mutex
+
+// memTx is a transaction over Cache[T] instances. Each write records how to
+// undo itself in the journal, and rolling back replays it backwards.
+type memTx struct {
+	ctx       context.Context
+	journal   []func()
+	readOnly  bool
+	committed []func()
+}
+
+func (t *memTx) Context() context.Context {
+	return t.ctx
+}
+
+func (t *memTx) Savepoint(fn func(tx Tx) error) error {
+	mark := len(t.journal)
+	if err := fn(t); err != nil {
+		t.rollbackTo(mark)
+		return err
+	}
+	return nil
+}
+
+// record adds an undo function to the journal; it does nothing outside of a
+// transaction.
+func (t *memTx) record(undo func()) {
+	if t != nil {
+		t.journal = append(t.journal, undo)
+	}
+}
+
+func (t *memTx) rollbackTo(mark int) {
+	for i := len(t.journal) - 1; i >= mark; i-- {
+		t.journal[i]()
+	}
+	t.journal = t.journal[:mark]
+}
+
+// memTxFrom returns the in-memory transaction ctx carries, nil if there is
+// none, or errForeignTx for a transaction of another backend.
+func memTxFrom(ctx context.Context) (*memTx, error) {
+	switch tx := txFrom(ctx).(type) {
+	case nil:
+		return nil, nil
+	case *memTx:
+		return tx, nil
+	default:
+		return nil, errForeignTx
+	}
+}
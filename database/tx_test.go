@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"testing/fstest"
+
+	"k8s-backend/database/migrate"
+	m "k8s-backend/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+type account struct {
+	Id      int `gorm:"primaryKey"`
+	Balance float64
+}
+
+// accountMigrations create the table of account, which the embedded
+// migrations know nothing about.
+func accountMigrations(t *testing.T) []migrate.Migration {
+	migrations, err := migrate.Load(fstest.MapFS{
+		"0001_create_accounts.up.sql":   {Data: []byte("CREATE TABLE accounts (id integer PRIMARY KEY, balance real NOT NULL DEFAULT 0)")},
+		"0001_create_accounts.down.sql": {Data: []byte("DROP TABLE accounts")},
+	})
+	require.NoError(t, err)
+	return migrations
+}
+
+// reserve takes a book off the shelf and charges the account for it, the kind
+// of unit of work spanning two models that transactions exist for.
+func reserve(ctx context.Context, books Database[m.Book], accounts Database[account], bookID, accountID string) error {
+	return books.WithTx(ctx, nil, func(tx Tx) error {
+		book, err := books.Get(tx.Context(), bookID)
+		if err != nil {
+			return err
+		}
+		if err := books.Delete(tx.Context(), bookID); err != nil {
+			return err
+		}
+		acc, err := accounts.Get(tx.Context(), accountID)
+		if err != nil {
+			return err
+		}
+		if acc.Balance < book.Price {
+			return fmt.Errorf("%w: insufficient funds", ErrValidation)
+		}
+		return accounts.Update(tx.Context(), accountID, map[string]any{"balance": acc.Balance - book.Price})
+	})
+}
+
+func TestTxSpansModels(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(t *testing.T) (Database[m.Book], Database[account])
+	}{
+		{"Cache", func(t *testing.T) (Database[m.Book], Database[account]) {
+			return seededBooks(t), &Cache[account]{}
+		}},
+		{"SQLite", func(t *testing.T) (Database[m.Book], Database[account]) {
+			books := &SQLite[m.Book]{InitElements: seededBooks(t).InitElements}
+			require.NoError(t, books.Initialize())
+			t.Cleanup(func() { books.Close() })
+			require.NoError(t, books.Seed(t.Context()))
+			// accounts have no migration of their own
+			require.NoError(t, books.DB.AutoMigrate(new(account)))
+			// sharing the connection is what lets a transaction span both
+			return books, &SQLite[account]{DB: books.DB}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			books, accounts := tt.open(t)
+			require.NoError(t, accounts.Initialize())
+			require.NoError(t, accounts.Insert(t.Context(), "", &account{Balance: 12}))
+
+			// the account cannot afford GR: the book stays on the shelf
+			require.ErrorIs(t, reserve(t.Context(), books, accounts, "3", "1"), ErrValidation)
+			_, err := books.Get(t.Context(), "3")
+			require.NoError(t, err)
+
+			require.NoError(t, reserve(t.Context(), books, accounts, "1", "1"))
+			_, err = books.Get(t.Context(), "1")
+			require.ErrorIs(t, err, ErrNotFound)
+			acc, err := accounts.Get(t.Context(), "1")
+			require.NoError(t, err)
+			require.InDelta(t, 1.01, acc.Balance, 1e-9)
+		})
+	}
+}
+
+func TestInitializeNeedsTheTableOfItsModel(t *testing.T) {
+	s := &SQLite[account]{}
+	err := s.Initialize()
+	require.ErrorIs(t, err, ErrUnavailable)
+	require.ErrorContains(t, err, "no table accounts")
+	require.NoError(t, s.Close())
+
+	s = &SQLite[account]{Migrations: accountMigrations(t)}
+	require.NoError(t, s.Initialize())
+	defer s.Close()
+	require.NoError(t, s.Insert(t.Context(), "", &account{Balance: 3}))
+
+	// the accounts' migrations keep a history of their own
+	require.False(t, s.DB.Migrator().HasTable(migrate.Table))
+	var n int64
+	require.NoError(t, s.DB.Table(migrate.Table+"_accounts").Count(&n).Error)
+	require.EqualValues(t, 1, n)
+}
+
+func TestTxRetriesSerializationFailures(t *testing.T) {
+	s := &SQLite[m.Book]{}
+	require.NoError(t, s.Initialize())
+	defer s.Close()
+
+	var attempts int
+	err := s.WithTx(t.Context(), &TxOptions{Retries: 2}, func(tx Tx) error {
+		attempts++
+		if err := s.Insert(tx.Context(), "", &m.Book{Title: fmt.Sprint("attempt ", attempts)}); err != nil {
+			return err
+		}
+		if attempts < 3 {
+			return fmt.Errorf("%w: simulated", ErrSerialization)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, attempts)
+
+	// only the last attempt was committed
+	all, err := s.GetAll(t.Context(), &m.Filters[m.Book]{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	require.Equal(t, "attempt 3", all[0].Title)
+
+	attempts = 0
+	err = s.WithTx(t.Context(), &TxOptions{Retries: -1}, func(tx Tx) error {
+		attempts++
+		return ErrSerialization
+	})
+	require.ErrorIs(t, err, ErrConflict)
+	require.Equal(t, 1, attempts)
+}
+
+func TestTxRejectsForeignTransactions(t *testing.T) {
+	cache := seededBooks(t)
+	lite := &SQLite[m.Book]{InitElements: cache.InitElements}
+	require.NoError(t, lite.Initialize())
+	defer lite.Close()
+	require.NoError(t, lite.Seed(t.Context()))
+	other := &SQLite[m.Book]{}
+	require.NoError(t, other.Initialize())
+	defer other.Close()
+
+	// a call that cannot join the transaction fails instead of escaping it
+	err := cache.WithTx(t.Context(), nil, func(tx Tx) error {
+		_, err := lite.Get(tx.Context(), "1")
+		return err
+	})
+	require.ErrorIs(t, err, errForeignTx)
+
+	err = lite.WithTx(t.Context(), nil, func(tx Tx) error {
+		return errors.Join(
+			cache.Delete(tx.Context(), "1"),
+			other.Insert(tx.Context(), "", &m.Book{Title: "SR"}),
+		)
+	})
+	require.ErrorIs(t, err, errForeignTx)
+	_, err = cache.Get(t.Context(), "1")
+	require.NoError(t, err)
+}
@@ -3,32 +3,77 @@ package main
 import (
 	"context"
 	"fmt"
+	"k8s-backend/config"
+	"k8s-backend/logging"
 	s "k8s-backend/server"
 	svc "k8s-backend/services"
+	"k8s-backend/tracing"
 	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	cfg, args, err := config.LoadCommand(os.Args[1:])
+	if err != nil {
+		slog.Error("failed to load configuration", "error", err)
+		os.Exit(2)
+	}
+
+	handler, err := logging.NewHandler(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		slog.Error("failed to configure logging", "error", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	// Kubernetes sends SIGTERM on every rollout
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	go func() {
-		slog.Info("starting pprof server on port 6060")
-		fmt.Println(http.ListenAndServe("localhost:6060", nil))
-	}()
+	if len(args) > 0 {
+		if err := runCommand(ctx, cfg, args, os.Stdout); err != nil {
+			slog.Error("command failed", "command", args[0], "error", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	bookSvc := svc.NewBookService()
-	bookSvc.Init()
-	defer bookSvc.DB.Close()
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+	if err != nil {
+		slog.Error("failed to configure tracing", "error", err)
+		os.Exit(2)
+	}
+	flushTraces := func() {
+		// the signal context is already cancelled here
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("failed to flush traces", "error", err)
+		}
+	}
 
-	go func() {
-		s.NewServer(":8081", []s.Service{bookSvc}).Run()
-	}()
+	if cfg.Server.PprofAddr != "" {
+		go func() {
+			slog.Info("starting pprof server", "addr", cfg.Server.PprofAddr)
+			fmt.Println(http.ListenAndServe(cfg.Server.PprofAddr, nil))
+		}()
+	}
+
+	bookSvc := svc.NewBookService(cfg)
+	bookSvc.Init()
 
-	<-ctx.Done()
+	// Run blocks until the signal context is cancelled, then drains requests
+	// and shuts down the services
+	err = s.NewServer(cfg, []s.Service{bookSvc}).Run(ctx)
+	flushTraces()
+	if err != nil {
+		slog.Error("server exited with error", "error", err)
+		os.Exit(1)
+	}
 	slog.Info("exiting gracefully")
 }
@@ -3,11 +3,15 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"k8s-backend/config"
 	db "k8s-backend/database"
 	m "k8s-backend/model"
 	svc "k8s-backend/services"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -58,10 +62,8 @@ func BenchmarkAPIData(b *testing.B) {
 
 func BenchmarkCreateBook(b *testing.B) {
 	bookSvc := &svc.BookService{
-		DB: &db.Cache[m.Book]{},
-		Cache: redis.NewClient(&redis.Options{
-			Addr: "localhost:6379", // TODO: Config
-		}),
+		DB:    &db.Cache[m.Book]{},
+		Cache: redis.NewClient(config.Default().Redis.Options()),
 	}
 	bookSvc.Init()
 	defer bookSvc.DB.Close()
@@ -73,7 +75,8 @@ func BenchmarkCreateBook(b *testing.B) {
 	b.ResetTimer()
 
 	for i := range b.N {
-		book := fmt.Appendf(nil, `{"Id": %d, "Title": "E-Myth", "Author": "Michael Gerber", "Price": 15.99}`, i)
+		// titles are unique, like in Postgres
+		book := fmt.Appendf(nil, `{"Id": %d, "Title": "E-Myth %d", "Author": "Michael Gerber", "Price": 15.99}`, i+1, i)
 
 		req, err := http.NewRequestWithContext(
 			b.Context(),
@@ -90,6 +93,79 @@ func BenchmarkCreateBook(b *testing.B) {
 	}
 }
 
+// BenchmarkCreateBookParallel creates books from GOMAXPROCS goroutines at
+// once (scale them with -cpu 1,4,16) to measure throughput under concurrent
+// load. Postgres runs when K8S_BACKEND_TEST_POSTGRES is set, configured like
+// the server through K8S_BACKEND_POSTGRES_* variables.
+func BenchmarkCreateBookParallel(b *testing.B) {
+	backends := []struct {
+		name string
+		open func(b *testing.B) db.Database[m.Book]
+	}{
+		{"Cache", func(b *testing.B) db.Database[m.Book] {
+			return &db.Cache[m.Book]{}
+		}},
+		{"SQLite", func(b *testing.B) db.Database[m.Book] {
+			return &db.SQLite[m.Book]{Config: config.SQLite{Path: filepath.Join(b.TempDir(), "books.db")}}
+		}},
+		{"Postgres", func(b *testing.B) db.Database[m.Book] {
+			if os.Getenv("K8S_BACKEND_TEST_POSTGRES") == "" {
+				b.Skip("set K8S_BACKEND_TEST_POSTGRES to run against Postgres")
+			}
+			cfg, err := config.Load(nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return &db.Postgres[m.Book]{Config: cfg.Postgres}
+		}},
+	}
+
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			bookSvc := &svc.BookService{
+				DB:    backend.open(b),
+				Cache: redis.NewClient(config.Default().Redis.Options()),
+			}
+			bookSvc.Init()
+			defer bookSvc.DB.Close()
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			bookSvc.SetupEndpoints(router)
+
+			// titles are unique across goroutines and runs against the same table
+			prefix := fmt.Sprint(os.Getpid(), "-", b.N)
+			var n atomic.Int64
+
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					book := fmt.Appendf(nil, `{"Title": "E-Myth %s-%d", "Author": "Michael Gerber", "Price": 15.99}`, prefix, n.Add(1))
+
+					req, err := http.NewRequestWithContext(
+						b.Context(),
+						http.MethodPost,
+						"/api/v1/book",
+						bytes.NewReader(book),
+					)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+
+					rr := httptest.NewRecorder()
+					router.ServeHTTP(rr, req)
+					if rr.Code != http.StatusCreated {
+						b.Errorf("Expected status %v, got %v: %s", http.StatusCreated, rr.Code, rr.Body)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
 // Inefficient
 func createSlice() []int {
 	var s []int
@@ -0,0 +1,188 @@
+// Package metrics defines the Prometheus collectors exported on /metrics.
+// Collectors register with the default registry, which also carries the Go
+// runtime and process collectors.
+package metrics
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "k8s_backend"
+
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route template and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	DBOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_operations_total",
+		Help:      "Database[T] calls by backend, method and result (ok or error).",
+	}, []string{"backend", "method", "result"})
+
+	DBDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_operation_duration_seconds",
+		Help:      "Database[T] call latency by backend and method.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"backend", "method"})
+
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache name and result (hit, negative_hit, miss, error or bypass); failed writes count as errors, writes skipped by an open circuit breaker as bypass.",
+	}, []string{"cache", "result"})
+
+	CacheCoalesced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_coalesced_total",
+		Help:      "Cache misses served by another request's concurrent database read, by cache name.",
+	}, []string{"cache"})
+
+	CacheEarlyRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_early_refreshes_total",
+		Help:      "Cache entries refreshed in the background ahead of their expiry, by cache name.",
+	}, []string{"cache"})
+
+	BreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_state",
+		Help:      "State of each circuit breaker: 0 closed, 1 half-open, 2 open.",
+	}, []string{"breaker"})
+
+	BreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_transitions_total",
+		Help:      "Circuit breaker state changes by breaker and new state.",
+	}, []string{"breaker", "state"})
+
+	BreakerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_breaker_rejections_total",
+		Help:      "Calls not made because the circuit breaker was open, by breaker.",
+	}, []string{"breaker"})
+
+	RateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ratelimit_rejections_total",
+		Help:      "Requests rejected with 429 by rate limit policy.",
+	}, []string{"policy"})
+)
+
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+
+	CacheHit         = "hit"
+	CacheNegativeHit = "negative_hit"
+	CacheMiss        = "miss"
+	CacheError       = "error"
+	CacheBypass      = "bypass"
+)
+
+// dbPools collects the statistics of the database/sql connection pools
+// registered with RegisterDBPool when scraped.
+var dbPools = newDBPoolCollector()
+
+func init() {
+	prometheus.MustRegister(dbPools)
+}
+
+// RegisterDBPool exports the statistics of a connection pool under the given
+// pool label, replacing any pool registered under it before. The returned
+// function unregisters it, typically when the pool is closed.
+func RegisterDBPool(pool string, stats func() sql.DBStats) (unregister func()) {
+	dbPools.mu.Lock()
+	defer dbPools.mu.Unlock()
+	dbPools.gen++
+	gen := dbPools.gen
+	dbPools.pools[pool] = registeredPool{stats: stats, gen: gen}
+
+	return func() {
+		dbPools.mu.Lock()
+		defer dbPools.mu.Unlock()
+		// a later registration under the same label stays
+		if dbPools.pools[pool].gen == gen {
+			delete(dbPools.pools, pool)
+		}
+	}
+}
+
+type registeredPool struct {
+	stats func() sql.DBStats
+	gen   int
+}
+
+type dbPoolCollector struct {
+	mu    sync.Mutex
+	pools map[string]registeredPool
+	gen   int
+
+	maxOpen, open, inUse, idle                          *prometheus.Desc
+	waitCount, waitDuration                             *prometheus.Desc
+	maxIdleClosed, maxIdleTimeClosed, maxLifetimeClosed *prometheus.Desc
+}
+
+func newDBPoolCollector() *dbPoolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, []string{"pool"}, nil)
+	}
+	return &dbPoolCollector{
+		pools:             make(map[string]registeredPool),
+		maxOpen:           desc("max_open_connections", "Maximum number of open connections to the database."),
+		open:              desc("open_connections", "Established connections, in use or idle."),
+		inUse:             desc("in_use_connections", "Connections currently in use."),
+		idle:              desc("idle_connections", "Idle connections."),
+		waitCount:         desc("wait_count_total", "Times a caller waited for a free connection."),
+		waitDuration:      desc("wait_duration_seconds_total", "Total time callers waited for a free connection."),
+		maxIdleClosed:     desc("max_idle_closed_total", "Connections closed because of the idle connection limit."),
+		maxIdleTimeClosed: desc("max_idle_time_closed_total", "Connections closed because they were idle too long."),
+		maxLifetimeClosed: desc("max_lifetime_closed_total", "Connections closed because they reached their maximum lifetime."),
+	}
+}
+
+func (c *dbPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		c.maxOpen, c.open, c.inUse, c.idle, c.waitCount, c.waitDuration,
+		c.maxIdleClosed, c.maxIdleTimeClosed, c.maxLifetimeClosed,
+	} {
+		ch <- d
+	}
+}
+
+func (c *dbPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for pool, p := range c.pools {
+		s := p.stats()
+		gauge := func(d *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, pool)
+		}
+		counter := func(d *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v, pool)
+		}
+		gauge(c.maxOpen, float64(s.MaxOpenConnections))
+		gauge(c.open, float64(s.OpenConnections))
+		gauge(c.inUse, float64(s.InUse))
+		gauge(c.idle, float64(s.Idle))
+		counter(c.waitCount, float64(s.WaitCount))
+		counter(c.waitDuration, s.WaitDuration.Seconds())
+		counter(c.maxIdleClosed, float64(s.MaxIdleClosed))
+		counter(c.maxIdleTimeClosed, float64(s.MaxIdleTimeClosed))
+		counter(c.maxLifetimeClosed, float64(s.MaxLifetimeClosed))
+	}
+}
@@ -11,7 +11,7 @@ type Book struct {
 	Title     string  `json:"title" gorm:"unique"`
 	Author    string  `json:"author" gorm:"size:255"`
 	Price     float64 `json:"price"`
-	CreatedAt string  `json:"created_at"`
+	CreatedAt string  `json:"created_at" gorm:"<-:create"`
 }
 
 type Result struct {
@@ -28,9 +28,65 @@ type FleetHealthStatus struct {
 type Region = string
 
 type Filters[T any] struct {
-	Model  *T     `json:"model"`
-	Limit  int    `json:"limit"`
-	Offset int    `json:"offset"`
-	SortBy string `json:"sort_by"`
-	Order  string `json:"order"`
+	// Where holds the conditions a record must all satisfy.
+	Where  []Condition `json:"where,omitempty"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	Sort   []SortField `json:"sort"`
+	// Cursor, when set, starts the page next to a previously listed record
+	// instead of at Offset.
+	Cursor *Cursor `json:"-"`
+}
+
+// Cursor positions a keyset page right after, or when Backward right before,
+// the record whose sort key is Values: one value per sort field followed by
+// the primary key.
+type Cursor struct {
+	Values   []any `json:"v"`
+	Backward bool  `json:"b,omitempty"`
+}
+
+// PageMetadata describes a page of a list response.
+type PageMetadata struct {
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset,omitempty"`
+	Sort   []SortField `json:"sort"`
+	Where  []Condition `json:"where,omitempty"`
+	// Total is only present when requested with total=exact or total=estimate.
+	Total *int64 `json:"total,omitempty"`
+	// Next and Prev link to the neighbouring pages, absent at either end.
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// Operator compares a field against the values of a Condition.
+type Operator string
+
+const (
+	OpEq       Operator = "eq"
+	OpNe       Operator = "ne"
+	OpLt       Operator = "lt"
+	OpLte      Operator = "lte"
+	OpGt       Operator = "gt"
+	OpGte      Operator = "gte"
+	OpIn       Operator = "in"
+	OpBetween  Operator = "between"
+	OpPrefix   Operator = "prefix"
+	OpContains Operator = "contains"
+	OpIsNull   Operator = "isnull"
+)
+
+// Condition restricts results to records whose field satisfies Op. Values
+// have the Go type of the field: in takes one or more, between exactly two
+// (low and high, inclusive), isnull a single bool and every other operator one.
+type Condition struct {
+	Field  string   `json:"field"`
+	Op     Operator `json:"op"`
+	Values []any    `json:"values"`
+}
+
+// SortField orders results by a field, named by its JSON name.
+type SortField struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc,omitempty"`
 }
@@ -0,0 +1,111 @@
+// Package pagination turns keyset cursors into opaque, signed tokens that
+// clients pass back to fetch the neighbouring page.
+package pagination
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	m "k8s-backend/model"
+)
+
+// ErrInvalidCursor is returned for tokens that are malformed, were not
+// signed with the codec's secret or were issued for a different query.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Codec signs cursors with an HMAC-SHA256 of Secret, so clients cannot
+// forge positions. Replicas behind the same load balancer must share the
+// secret; the zero Codec signs with a random per-process key.
+type Codec struct {
+	Secret []byte
+}
+
+func NewCodec(secret string) Codec {
+	return Codec{Secret: []byte(secret)}
+}
+
+var processKey = sync.OnceValue(func() []byte {
+	slog.Warn("no cursor secret configured, cursors will not be valid across replicas or restarts")
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+})
+
+func (c Codec) key() []byte {
+	if len(c.Secret) == 0 {
+		return processKey()
+	}
+	return c.Secret
+}
+
+// token is the signed payload. Query binds the cursor to the sort order and
+// filters it was issued for.
+type token struct {
+	m.Cursor
+	Query string `json:"q"`
+}
+
+// Encode returns the token for cur, bound to query (see Fingerprint).
+func (c Codec) Encode(cur *m.Cursor, query string) (string, error) {
+	payload, err := json.Marshal(token{Cursor: *cur, Query: query})
+	if err != nil {
+		return "", fmt.Errorf("encoding cursor: %w", err)
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(c.sign(payload)), nil
+}
+
+// Decode verifies raw and returns its cursor. Numbers are returned as
+// json.Number; the database converts them to the types of the sort fields.
+func (c Codec) Decode(raw, query string) (*m.Cursor, error) {
+	enc := base64.RawURLEncoding
+	p, s, ok := strings.Cut(raw, ".")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	payload, err := enc.DecodeString(p)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	sig, err := enc.DecodeString(s)
+	if err != nil || !hmac.Equal(sig, c.sign(payload)) {
+		return nil, ErrInvalidCursor
+	}
+
+	var t token
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&t); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if t.Query != query {
+		return nil, fmt.Errorf("%w: it was issued for a different sort order or filters", ErrInvalidCursor)
+	}
+	return &t.Cursor, nil
+}
+
+func (c Codec) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, c.key())
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Fingerprint identifies the sort order and filters of a listing, so a cursor
+// is only accepted by the listing it was taken from.
+func Fingerprint(sort []m.SortField, where []m.Condition) string {
+	data, _ := json.Marshal(struct {
+		Sort  []m.SortField `json:"s"`
+		Where []m.Condition `json:"w"`
+	}{sort, where})
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
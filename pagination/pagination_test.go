@@ -0,0 +1,74 @@
+package pagination
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	m "k8s-backend/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	codec := NewCodec("secret")
+	query := Fingerprint([]m.SortField{{Field: "price", Desc: true}}, nil)
+
+	token, err := codec.Encode(&m.Cursor{Values: []any{10.99, 3}, Backward: true}, query)
+	require.NoError(t, err)
+
+	cur, err := codec.Decode(token, query)
+	require.NoError(t, err)
+	require.True(t, cur.Backward)
+	require.Equal(t, []any{json.Number("10.99"), json.Number("3")}, cur.Values)
+}
+
+func TestCodecRejects(t *testing.T) {
+	codec := NewCodec("secret")
+	query := Fingerprint([]m.SortField{{Field: "title"}}, nil)
+	token, err := codec.Encode(&m.Cursor{Values: []any{"QM", 1}}, query)
+	require.NoError(t, err)
+
+	payload, sig, _ := strings.Cut(token, ".")
+	forged, err := codec.Encode(&m.Cursor{Values: []any{"QFT", 2}}, query)
+	require.NoError(t, err)
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		codec Codec
+		query string
+	}{
+		{"Garbage", "not-a-cursor", codec, query},
+		{"Bad encoding", "!!!.!!!", codec, query},
+		{"Swapped payload", forgedPayload + "." + sig, codec, query},
+		{"Truncated signature", payload + "." + sig[:10], codec, query},
+		{"Other secret", token, NewCodec("other"), query},
+		{"Other query", token, codec, Fingerprint([]m.SortField{{Field: "title", Desc: true}}, nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.codec.Decode(tt.token, tt.query)
+			require.ErrorIs(t, err, ErrInvalidCursor)
+		})
+	}
+}
+
+func TestZeroCodecSigns(t *testing.T) {
+	var codec Codec
+	token, err := codec.Encode(&m.Cursor{Values: []any{1}}, "q")
+	require.NoError(t, err)
+	_, err = codec.Decode(token, "q")
+	require.NoError(t, err)
+}
+
+func TestFingerprint(t *testing.T) {
+	where := []m.Condition{{Field: "price", Op: m.OpLte, Values: []any{20.0}}}
+	sort := []m.SortField{{Field: "title"}}
+
+	require.Equal(t, Fingerprint(sort, where), Fingerprint(sort, where))
+	require.NotEqual(t, Fingerprint(sort, where), Fingerprint(sort, nil))
+	require.NotEqual(t, Fingerprint(sort, where), Fingerprint([]m.SortField{{Field: "title", Desc: true}}, where))
+}
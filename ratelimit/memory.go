@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryLimiter keeps one Algorithm per policy and key in process memory.
+// Keys idle for longer than IdleTTL are evicted.
+type MemoryLimiter struct {
+	IdleTTL time.Duration
+
+	now       func() time.Time
+	buckets   map[string]*entry
+	lastSweep time.Time
+	sync.Mutex
+}
+
+type entry struct {
+	alg      Algorithm
+	lastSeen time.Time
+}
+
+func NewMemoryLimiter(idleTTL time.Duration) *MemoryLimiter {
+	return &MemoryLimiter{
+		IdleTTL:   idleTTL,
+		now:       time.Now,
+		buckets:   make(map[string]*entry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *MemoryLimiter) Allow(_ context.Context, key string, p Policy) (Result, error) {
+	now := l.now()
+
+	l.Lock()
+	l.sweep(now)
+	id := p.Name + "|" + key
+	e, ok := l.buckets[id]
+	if !ok {
+		e = &entry{alg: p.New(now)}
+		l.buckets[id] = e
+	}
+	e.lastSeen = now
+	l.Unlock()
+
+	// algorithms lock themselves, so unrelated keys don't contend here
+	return e.alg.Take(now), nil
+}
+
+// Len returns the number of tracked keys.
+func (l *MemoryLimiter) Len() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.buckets)
+}
+
+// sweep evicts idle keys at most once per IdleTTL; callers hold the lock.
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if l.IdleTTL <= 0 || now.Sub(l.lastSweep) < l.IdleTTL {
+		return
+	}
+	for id, e := range l.buckets {
+		if now.Sub(e.lastSeen) >= l.IdleTTL {
+			delete(l.buckets, id)
+		}
+	}
+	l.lastSweep = now
+}
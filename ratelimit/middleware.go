@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"k8s-backend/metrics"
+	"k8s-backend/server/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	KeyByIP     = "ip"
+	KeyByAPIKey = "apikey"
+	KeyByUser   = "user"
+
+	// UserContextKey is the gin context key an authentication middleware sets
+	// to the authenticated user's identifier.
+	UserContextKey = "user"
+)
+
+// KeyFunc identifies the caller a request is accounted to.
+type KeyFunc func(c *gin.Context) string
+
+func ByClientIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// ByAPIKey keys callers by a hash of the given header, falling back to the
+// client IP for anonymous requests.
+func ByAPIKey(header string) KeyFunc {
+	return func(c *gin.Context) string {
+		k := c.GetHeader(header)
+		if k == "" {
+			return ByClientIP(c)
+		}
+		sum := sha256.Sum256([]byte(k)) // never keep raw credentials in limiter state
+		return "key:" + hex.EncodeToString(sum[:8])
+	}
+}
+
+// ByUser keys callers by UserContextKey, falling back to the client IP.
+func ByUser(c *gin.Context) string {
+	if u := c.GetString(UserContextKey); u != "" {
+		return "user:" + u
+	}
+	return ByClientIP(c)
+}
+
+func NewKeyFunc(keyBy, apiKeyHeader string) (KeyFunc, error) {
+	switch keyBy {
+	case KeyByIP:
+		return ByClientIP, nil
+	case KeyByAPIKey:
+		return ByAPIKey(apiKeyHeader), nil
+	case KeyByUser:
+		return ByUser, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q", keyBy)
+	}
+}
+
+// Middleware admits each request under the policy for its route, identified
+// as "METHOD /route/:template". Limiter errors fail open.
+func Middleware(l Limiter, key KeyFunc, policyFor func(route string) Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := policyFor(c.Request.Method + " " + c.FullPath())
+
+		res, err := l.Allow(c.Request.Context(), key(c), p)
+		if err != nil {
+			slog.Warn("rate limiter unavailable, admitting request", "policy", p.Name, "error", err)
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Limit", strconv.FormatUint(uint64(res.Limit), 10))
+		c.Header("RateLimit-Remaining", strconv.FormatUint(uint64(res.Remaining), 10))
+		if !res.Allowed {
+			metrics.RateLimitRejections.WithLabelValues(p.Name).Inc()
+			retry := max(1, int(math.Ceil(res.RetryAfter.Seconds())))
+			c.Header("Retry-After", strconv.Itoa(retry))
+			apierror.Abort(c, apierror.New(http.StatusTooManyRequests,
+				fmt.Sprintf("rate limit %q exceeded, retry in %ds", p.Name, retry)))
+			return
+		}
+		c.Next()
+	}
+}
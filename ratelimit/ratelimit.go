@@ -0,0 +1,176 @@
+// Package ratelimit provides keyed request admission with pluggable
+// algorithms (token bucket, sliding window) and a gin middleware that sets
+// the standard RateLimit-* response headers.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	AlgorithmTokenBucket   = "tokenbucket"
+	AlgorithmSlidingWindow = "slidingwindow"
+)
+
+// Result is the outcome of a single admission decision.
+type Result struct {
+	Allowed   bool
+	Limit     uint
+	Remaining uint
+	// RetryAfter is how long a rejected caller should wait before retrying.
+	RetryAfter time.Duration
+}
+
+// Algorithm is the state of one rate-limited key.
+type Algorithm interface {
+	Take(now time.Time) Result
+}
+
+// Limiter admits requests per key under a policy.
+type Limiter interface {
+	Allow(ctx context.Context, key string, p Policy) (Result, error)
+}
+
+// Policy allows bursts of Capacity requests and one request per Rate sustained.
+// Routes whose policies share a Name share their buckets.
+type Policy struct {
+	Name      string
+	Algorithm string
+	Capacity  uint
+	Rate      time.Duration
+}
+
+func (p Policy) Validate() error {
+	switch p.Algorithm {
+	case AlgorithmTokenBucket, AlgorithmSlidingWindow:
+	default:
+		return fmt.Errorf("unknown rate limit algorithm %q", p.Algorithm)
+	}
+	if p.Capacity == 0 {
+		return fmt.Errorf("rate limit policy %q: capacity must be > 0", p.Name)
+	}
+	if p.Rate <= 0 {
+		return fmt.Errorf("rate limit policy %q: rate must be > 0", p.Name)
+	}
+	return nil
+}
+
+// New returns fresh state for one key under this policy.
+func (p Policy) New(now time.Time) Algorithm {
+	if p.Algorithm == AlgorithmSlidingWindow {
+		return &SlidingWindow{
+			Limit:  p.Capacity,
+			Window: time.Duration(p.Capacity) * p.Rate,
+			start:  now,
+		}
+	}
+	return &TokenBucket{
+		Capacity:   p.Capacity,
+		Tokens:     p.Capacity,
+		Rate:       p.Rate,
+		LastFilled: now,
+	}
+}
+
+type TokenBucket struct {
+	Capacity   uint
+	Tokens     uint
+	Rate       time.Duration
+	LastFilled time.Time
+	sync.Mutex
+}
+
+func NewTokenBucket(capacity uint, rate time.Duration) *TokenBucket {
+	return &TokenBucket{
+		Capacity:   capacity,
+		Tokens:     capacity,
+		Rate:       rate,
+		LastFilled: time.Now().Local(),
+	}
+}
+
+func (tb *TokenBucket) Allow() bool {
+	return tb.Take(time.Now()).Allowed
+}
+
+func (tb *TokenBucket) Take(now time.Time) Result {
+	tb.Lock()
+	defer tb.Unlock()
+
+	elapsed := now.Sub(tb.LastFilled)
+	addTokens := uint(elapsed / tb.Rate) // refill if at least [1] rate interval has elapsed
+	tb.Tokens += addTokens
+	if addTokens > 0 {
+		// keep the partial interval so a steady caller isn't penalized
+		tb.LastFilled = tb.LastFilled.Add(time.Duration(addTokens) * tb.Rate)
+	}
+	if tb.Tokens >= tb.Capacity {
+		tb.Tokens = tb.Capacity
+		tb.LastFilled = now
+	}
+
+	if tb.Tokens > 0 {
+		tb.Tokens--
+		return Result{Allowed: true, Limit: tb.Capacity, Remaining: tb.Tokens}
+	}
+
+	return Result{
+		Limit:      tb.Capacity,
+		RetryAfter: tb.Rate - now.Sub(tb.LastFilled),
+	}
+}
+
+// SlidingWindow approximates a rolling window by weighting the previous
+// fixed window's count by how much of it still overlaps the rolling one.
+type SlidingWindow struct {
+	Limit  uint
+	Window time.Duration
+
+	start time.Time
+	prev  uint
+	curr  uint
+	sync.Mutex
+}
+
+func (sw *SlidingWindow) Take(now time.Time) Result {
+	sw.Lock()
+	defer sw.Unlock()
+
+	if elapsed := now.Sub(sw.start); elapsed >= sw.Window {
+		windows := elapsed / sw.Window
+		if windows == 1 {
+			sw.prev = sw.curr
+		} else {
+			sw.prev = 0
+		}
+		sw.curr = 0
+		sw.start = sw.start.Add(windows * sw.Window)
+	}
+
+	elapsed := now.Sub(sw.start)
+	weight := 1 - float64(elapsed)/float64(sw.Window)
+	estimate := float64(sw.prev)*weight + float64(sw.curr)
+
+	if estimate+1 > float64(sw.Limit) {
+		return Result{Limit: sw.Limit, RetryAfter: sw.retryAfter(elapsed)}
+	}
+
+	sw.curr++
+	used := uint(math.Ceil(estimate + 1))
+	return Result{Allowed: true, Limit: sw.Limit, Remaining: sw.Limit - min(used, sw.Limit)}
+}
+
+// retryAfter returns the time until the estimate leaves room for one request.
+func (sw *SlidingWindow) retryAfter(elapsed time.Duration) time.Duration {
+	rest := sw.Window - elapsed
+	if sw.curr+1 > sw.Limit || sw.prev == 0 {
+		return rest
+	}
+	// solve prev*(1-e/W) + curr + 1 <= limit for e
+	frac := 1 - float64(sw.Limit-sw.curr-1)/float64(sw.prev)
+	return max(time.Duration(frac*float64(sw.Window))-elapsed, time.Millisecond)
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := Policy{Algorithm: AlgorithmTokenBucket, Capacity: 3, Rate: time.Second}.New(now)
+
+	for i := range 3 {
+		r := tb.Take(now)
+		require.True(t, r.Allowed)
+		require.Equal(t, uint(2-i), r.Remaining)
+	}
+
+	r := tb.Take(now.Add(400 * time.Millisecond))
+	require.False(t, r.Allowed)
+	require.Equal(t, 600*time.Millisecond, r.RetryAfter)
+
+	// one token per second; the partial interval carries over
+	require.True(t, tb.Take(now.Add(1500*time.Millisecond)).Allowed)
+	require.False(t, tb.Take(now.Add(1900*time.Millisecond)).Allowed)
+	require.True(t, tb.Take(now.Add(2*time.Second)).Allowed)
+
+	// refill never exceeds capacity
+	r = tb.Take(now.Add(time.Hour))
+	require.True(t, r.Allowed)
+	require.Equal(t, uint(2), r.Remaining)
+}
+
+func TestSlidingWindow(t *testing.T) {
+	now := time.Now()
+	// 4 requests per 4s window
+	sw := Policy{Algorithm: AlgorithmSlidingWindow, Capacity: 4, Rate: time.Second}.New(now)
+
+	for range 4 {
+		require.True(t, sw.Take(now).Allowed)
+	}
+	r := sw.Take(now.Add(time.Second))
+	require.False(t, r.Allowed)
+	require.Equal(t, 3*time.Second, r.RetryAfter)
+
+	// halfway through the next window the previous one still counts for half
+	require.True(t, sw.Take(now.Add(6*time.Second)).Allowed)
+	require.True(t, sw.Take(now.Add(6*time.Second)).Allowed)
+	require.False(t, sw.Take(now.Add(6*time.Second)).Allowed)
+
+	// a gap of two windows forgets everything
+	r = sw.Take(now.Add(20 * time.Second))
+	require.True(t, r.Allowed)
+	require.Equal(t, uint(3), r.Remaining)
+}
+
+func TestMemoryLimiterKeysAndEviction(t *testing.T) {
+	now := time.Now()
+	l := NewMemoryLimiter(time.Minute)
+	l.now = func() time.Time { return now }
+	p := Policy{Name: "test", Algorithm: AlgorithmTokenBucket, Capacity: 1, Rate: time.Hour}
+
+	r, err := l.Allow(t.Context(), "a", p)
+	require.NoError(t, err)
+	require.True(t, r.Allowed)
+	r, _ = l.Allow(t.Context(), "a", p)
+	require.False(t, r.Allowed)
+
+	// one noisy caller doesn't starve another
+	r, _ = l.Allow(t.Context(), "b", p)
+	require.True(t, r.Allowed)
+	require.Equal(t, 2, l.Len())
+
+	now = now.Add(2 * time.Minute)
+	r, _ = l.Allow(t.Context(), "c", p)
+	require.True(t, r.Allowed)
+	require.Equal(t, 1, l.Len(), "idle keys are evicted")
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	strict := Policy{Name: "strict", Algorithm: AlgorithmTokenBucket, Capacity: 1, Rate: time.Hour}
+	loose := Policy{Name: "loose", Algorithm: AlgorithmTokenBucket, Capacity: 10, Rate: time.Second}
+
+	router := gin.New()
+	router.Use(Middleware(NewMemoryLimiter(time.Minute), ByAPIKey("X-API-Key"), func(route string) Policy {
+		if route == "POST /items/:id" {
+			return strict
+		}
+		return loose
+	}))
+	router.GET("/items/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/items/:id", func(c *gin.Context) { c.Status(http.StatusCreated) })
+
+	do := func(method, path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequestWithContext(t.Context(), method, path, nil)
+		req.Header.Set("X-API-Key", key)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(http.MethodPost, "/items/1", "alice")
+	require.Equal(t, http.StatusCreated, rr.Code)
+	require.Equal(t, "1", rr.Header().Get("RateLimit-Limit"))
+	require.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+
+	// the route template, not the concrete path, selects the policy
+	rr = do(http.MethodPost, "/items/2", "alice")
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	require.Equal(t, "3600", rr.Header().Get("Retry-After"))
+
+	require.Equal(t, http.StatusCreated, do(http.MethodPost, "/items/1", "bob").Code)
+
+	rr = do(http.MethodGet, "/items/1", "alice")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "10", rr.Header().Get("RateLimit-Limit"))
+	require.Equal(t, "9", rr.Header().Get("RateLimit-Remaining"))
+}
@@ -0,0 +1,149 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// gcra implements a token bucket as the generic cell rate algorithm: the key
+// stores the theoretical arrival time (TAT) of the next request in
+// microseconds of Redis server time, so every replica shares one clock.
+//
+// KEYS[1] bucket key
+// ARGV[1] emission interval (µs), ARGV[2] capacity
+// returns {allowed, remaining, retry after (µs)}
+var gcra = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local emission = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local tolerance = emission * capacity
+
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if not tat or tat < now then
+  tat = now
+end
+
+local new_tat = tat + emission
+local allow_at = new_tat - tolerance
+if allow_at > now then
+  return {0, 0, allow_at - now}
+end
+
+redis.call('SET', KEYS[1], new_tat, 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor((tolerance - (new_tat - now)) / emission), 0}
+`)
+
+// slidingWindow counts requests in fixed windows and weights the previous
+// window by its overlap with the rolling one, like SlidingWindow. Both counts
+// live in one hash along with the index of the current window, so that the
+// script only touches the key it declares.
+//
+// KEYS[1] window hash
+// ARGV[1] window (µs), ARGV[2] limit
+// returns {allowed, remaining, retry after (µs)}
+var slidingWindow = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+
+local index = math.floor(now / window)
+local elapsed = now - index * window
+local state = redis.call('HMGET', KEYS[1], 'index', 'curr', 'prev')
+local stored = tonumber(state[1])
+local curr, prev = 0, 0
+if stored == index then
+  curr, prev = tonumber(state[2]) or 0, tonumber(state[3]) or 0
+elseif stored == index - 1 then
+  prev = tonumber(state[2]) or 0
+end
+
+local estimate = prev * (1 - elapsed / window) + curr
+if estimate + 1 > limit then
+  local retry = window - elapsed
+  if curr + 1 <= limit and prev > 0 then
+    retry = math.max((1 - (limit - curr - 1) / prev) * window - elapsed, 1000)
+  end
+  return {0, 0, retry}
+end
+
+redis.call('HSET', KEYS[1], 'index', index, 'curr', curr + 1, 'prev', prev)
+redis.call('PEXPIRE', KEYS[1], math.ceil(2 * window / 1000))
+return {1, math.max(limit - math.ceil(estimate + 1), 0), 0}
+`)
+
+// RedisLimiter shares limits across replicas. When Redis is unreachable it
+// degrades to Fallback, so each replica enforces the policy locally.
+type RedisLimiter struct {
+	Client   *redis.Client
+	Prefix   string
+	Fallback Limiter
+
+	// degraded is set while requests fall back, so that only the change is
+	// logged rather than every request.
+	degraded atomic.Bool
+}
+
+func NewRedisLimiter(client *redis.Client, fallback Limiter) *RedisLimiter {
+	return &RedisLimiter{
+		Client:   client,
+		Prefix:   "ratelimit:",
+		Fallback: fallback,
+	}
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string, p Policy) (Result, error) {
+	res, err := l.allow(ctx, key, p)
+	if err == nil {
+		if l.degraded.CompareAndSwap(true, false) {
+			slog.Info("redis rate limiter available again")
+		}
+		return res, nil
+	}
+	if ctx.Err() != nil || l.Fallback == nil {
+		return Result{}, err
+	}
+
+	if l.degraded.CompareAndSwap(false, true) {
+		slog.Warn("redis rate limiter unavailable, using local fallback", "policy", p.Name, "error", err)
+	}
+	return l.Fallback.Allow(ctx, key, p)
+}
+
+func (l *RedisLimiter) allow(ctx context.Context, key string, p Policy) (Result, error) {
+	redisKey := l.Prefix + p.Name + ":" + key
+
+	var (
+		vals []int64
+		err  error
+	)
+	switch p.Algorithm {
+	case AlgorithmSlidingWindow:
+		window := time.Duration(p.Capacity) * p.Rate
+		vals, err = slidingWindow.Run(ctx, l.Client, []string{redisKey}, window.Microseconds(), p.Capacity).Int64Slice()
+	case AlgorithmTokenBucket:
+		vals, err = gcra.Run(ctx, l.Client, []string{redisKey}, p.Rate.Microseconds(), p.Capacity).Int64Slice()
+	default:
+		return Result{}, fmt.Errorf("unknown rate limit algorithm %q", p.Algorithm)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	if len(vals) != 3 {
+		return Result{}, errors.New("unexpected rate limit script reply")
+	}
+
+	return Result{
+		Allowed:    vals[0] == 1,
+		Limit:      p.Capacity,
+		Remaining:  uint(max(vals[1], 0)),
+		RetryAfter: time.Duration(vals[2]) * time.Microsecond,
+	}, nil
+}
@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisLimiterSharedAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	now := time.Now()
+	mr.SetTime(now)
+
+	for _, alg := range []string{AlgorithmTokenBucket, AlgorithmSlidingWindow} {
+		t.Run(alg, func(t *testing.T) {
+			p := Policy{Name: alg, Algorithm: alg, Capacity: 3, Rate: time.Second}
+
+			// two replicas talking to the same Redis
+			a := NewRedisLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr()}), nil)
+			b := NewRedisLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr()}), nil)
+
+			for i, l := range []*RedisLimiter{a, b, a} {
+				r, err := l.Allow(t.Context(), "client", p)
+				require.NoError(t, err)
+				require.True(t, r.Allowed)
+				require.Equal(t, uint(3), r.Limit)
+				require.Equal(t, uint(2-i), r.Remaining)
+			}
+
+			r, err := b.Allow(t.Context(), "client", p)
+			require.NoError(t, err)
+			require.False(t, r.Allowed)
+			require.Positive(t, r.RetryAfter)
+
+			r, err = b.Allow(t.Context(), "other", p)
+			require.NoError(t, err)
+			require.True(t, r.Allowed)
+		})
+	}
+}
+
+func TestRedisLimiterRefill(t *testing.T) {
+	mr := miniredis.RunT(t)
+	now := time.Now()
+	mr.SetTime(now)
+
+	l := NewRedisLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr()}), nil)
+	p := Policy{Name: "refill", Algorithm: AlgorithmTokenBucket, Capacity: 2, Rate: time.Second}
+
+	require.True(t, allow(t, l, p))
+	require.True(t, allow(t, l, p))
+	require.False(t, allow(t, l, p))
+
+	mr.SetTime(now.Add(time.Second))
+	require.True(t, allow(t, l, p))
+	require.False(t, allow(t, l, p))
+}
+
+func TestRedisLimiterFallback(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	l := NewRedisLimiter(client, NewMemoryLimiter(time.Minute))
+	p := Policy{Name: "fallback", Algorithm: AlgorithmTokenBucket, Capacity: 1, Rate: time.Hour}
+
+	mr.Close()
+
+	// the local bucket still enforces the policy
+	require.True(t, allow(t, l, p))
+	require.False(t, allow(t, l, p))
+
+	_, err := NewRedisLimiter(client, nil).Allow(t.Context(), "client", p)
+	require.Error(t, err)
+}
+
+func TestRedisLimiterLogsFallbackOnce(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	mr := miniredis.RunT(t)
+	l := NewRedisLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1}), NewMemoryLimiter(time.Minute))
+	p := Policy{Name: "outage", Algorithm: AlgorithmTokenBucket, Capacity: 100, Rate: time.Second}
+
+	mr.Close()
+	for range 5 {
+		allow(t, l, p)
+	}
+	require.Equal(t, 1, strings.Count(buf.String(), "using local fallback"))
+
+	require.NoError(t, mr.Restart())
+	for range 5 {
+		allow(t, l, p)
+	}
+	require.Equal(t, 1, strings.Count(buf.String(), "available again"))
+}
+
+func TestRedisSlidingWindowDeclaresItsKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	now := time.Now().Truncate(time.Second)
+	mr.SetTime(now)
+	l := NewRedisLimiter(redis.NewClient(&redis.Options{Addr: mr.Addr()}), nil)
+	p := Policy{Name: "sw", Algorithm: AlgorithmSlidingWindow, Capacity: 2, Rate: 500 * time.Millisecond}
+
+	require.True(t, allow(t, l, p))
+	require.True(t, allow(t, l, p))
+	require.False(t, allow(t, l, p))
+	// everything is kept under the key passed in KEYS, which Redis Cluster
+	// routes by
+	require.Equal(t, []string{"ratelimit:sw:client"}, mr.Keys())
+
+	// half of the previous window still counts half
+	mr.SetTime(now.Add(1500 * time.Millisecond))
+	require.True(t, allow(t, l, p))
+	require.False(t, allow(t, l, p))
+
+	// windows older than the previous one are forgotten
+	mr.SetTime(now.Add(5 * time.Second))
+	require.True(t, allow(t, l, p))
+	require.True(t, allow(t, l, p))
+}
+
+func allow(t *testing.T, l Limiter, p Policy) bool {
+	t.Helper()
+	r, err := l.Allow(t.Context(), "client", p)
+	require.NoError(t, err)
+	return r.Allowed
+}
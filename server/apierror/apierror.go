@@ -0,0 +1,208 @@
+// Package apierror renders every error response as RFC 7807
+// application/problem+json, mapping errors returned by the database package
+// onto HTTP statuses so every service reports the same failure the same way.
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	db "k8s-backend/database"
+	"k8s-backend/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ContentType = "application/problem+json"
+
+// TypeBase prefixes every problem type URI. The URIs are relative to the API,
+// which serves each type's documentation there with Docs.
+const TypeBase = "/problems/"
+
+// StatusClientClosedRequest is the de-facto status for requests the client
+// abandoned before a response was written.
+const StatusClientClosedRequest = 499
+
+// Problem is an RFC 7807 problem details object. It implements error so
+// handlers can return it like any other error.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Instance identifies this occurrence; it is the request ID.
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+} // @name Problem
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+} // @name FieldError
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Title + ": " + p.Detail
+	}
+	return p.Title
+}
+
+// FieldErrors is returned by request validators; it maps to 422 with one
+// entry per rejected field.
+type FieldErrors []FieldError
+
+func (f FieldErrors) Error() string {
+	msgs := make([]string, len(f))
+	for i, e := range f {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (f FieldErrors) Unwrap() error {
+	return db.ErrValidation
+}
+
+// New returns a problem of the generic type for status.
+func New(status int, detail string) *Problem {
+	return &Problem{
+		Type:   TypeBase + typeSlug(status),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// BadRequest reports a malformed request, optionally naming the fields at fault.
+func BadRequest(detail string, fields ...FieldError) *Problem {
+	p := New(http.StatusBadRequest, detail)
+	p.Errors = fields
+	return p
+}
+
+// BadRequestf is BadRequest with a formatted detail.
+func BadRequestf(format string, args ...any) *Problem {
+	return BadRequest(fmt.Sprintf(format, args...))
+}
+
+// problemType documents the problems of one type.
+type problemType struct {
+	slug        string
+	status      int
+	description string
+}
+
+// problemTypes lists every problem type; the last one is used for any status
+// not listed.
+var problemTypes = []problemType{
+	{"bad-request", http.StatusBadRequest, "The request is malformed, such as an unknown or invalid query parameter. The errors member names the fields at fault."},
+	{"not-found", http.StatusNotFound, "No record or route matches the request."},
+	{"method-not-allowed", http.StatusMethodNotAllowed, "The route does not support the request method."},
+	{"conflict", http.StatusConflict, "The request conflicts with an existing record, such as a duplicate unique field."},
+	{"validation-failed", http.StatusUnprocessableEntity, "The request is well-formed but some of its fields are invalid. The errors member names them."},
+	{"rate-limited", http.StatusTooManyRequests, "The caller exceeded its rate limit. Retry after the time given by the Retry-After header."},
+	{"unavailable", http.StatusServiceUnavailable, "A dependency such as the database is unavailable or timed out. Retrying later may succeed."},
+	{"client-closed-request", StatusClientClosedRequest, "The client went away before the response was ready."},
+	{"internal", http.StatusInternalServerError, "The server failed unexpectedly. The instance member identifies the request in the server logs."},
+}
+
+func typeSlug(status int) string {
+	for _, t := range problemTypes {
+		if t.status == status {
+			return t.slug
+		}
+	}
+	return problemTypes[len(problemTypes)-1].slug
+}
+
+// Docs serves the documentation of the problem type named by the :type path
+// parameter, as plain text, at the type's URI under TypeBase.
+func Docs(c *gin.Context) {
+	for _, t := range problemTypes {
+		if t.slug == c.Param("type") {
+			title := http.StatusText(t.status)
+			if t.status == StatusClientClosedRequest {
+				title = "Client Closed Request"
+			}
+			c.String(http.StatusOK, "%s (%d)\n\n%s\n", title, t.status, t.description)
+			return
+		}
+	}
+	Abort(c, New(http.StatusNotFound, "no problem type "+c.Param("type")))
+}
+
+// Status returns the HTTP status code for err.
+func Status(err error) int {
+	var p *Problem
+	switch {
+	case errors.As(err, &p):
+		return p.Status
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrValidation):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, db.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// FromError converts err into a problem. Details of server errors are hidden
+// from clients.
+func FromError(err error) *Problem {
+	var p *Problem
+	if errors.As(err, &p) {
+		clone := *p
+		return &clone
+	}
+
+	status := Status(err)
+	detail := err.Error()
+	if status >= http.StatusInternalServerError {
+		detail = ""
+	}
+	problem := New(status, detail)
+
+	var fields FieldErrors
+	if errors.As(err, &fields) {
+		problem.Detail = "the request contains invalid fields"
+		problem.Errors = fields
+	}
+	return problem
+}
+
+// Abort writes the problem for err and stops the gin handler chain.
+func Abort(c *gin.Context, err error) {
+	p := FromError(err)
+	p.Instance = logging.RequestID(c.Request.Context())
+	if p.Status >= http.StatusInternalServerError {
+		logging.FromContext(c.Request.Context()).Error("request failed", "status", p.Status, "error", err)
+	}
+
+	_ = c.Error(err)
+	c.Header("Content-Type", ContentType)
+	c.AbortWithStatusJSON(p.Status, p)
+}
+
+// Write is Abort for net/http handlers.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	p := FromError(err)
+	p.Instance = logging.RequestID(r.Context())
+	if p.Status >= http.StatusInternalServerError {
+		logging.FromContext(r.Context()).Error("request failed", "status", p.Status, "error", err)
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
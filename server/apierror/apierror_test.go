@@ -0,0 +1,134 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	db "k8s-backend/database"
+	"k8s-backend/logging"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("%w: id 7", db.ErrNotFound), http.StatusNotFound},
+		{fmt.Errorf("%w: title exists", db.ErrConflict), http.StatusConflict},
+		{db.ErrValidation, http.StatusUnprocessableEntity},
+		{fmt.Errorf("%w: %w", db.ErrUnavailable, errors.New("dial tcp")), http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable},
+		{context.Canceled, StatusClientClosedRequest},
+		{FieldErrors{{Field: "title", Message: "required"}}, http.StatusUnprocessableEntity},
+		{New(http.StatusTooManyRequests, "slow down"), http.StatusTooManyRequests},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			require.Equal(t, tt.status, Status(tt.err))
+		})
+	}
+}
+
+func TestAbortWritesProblems(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name string
+		err  error
+		body string
+	}{
+		{
+			name: "Not found",
+			err:  fmt.Errorf("%w: id 7", db.ErrNotFound),
+			body: `{"type":"/problems/not-found","title":"Not Found","status":404,"detail":"record not found: id 7","instance":"req-1"}`,
+		},
+		{
+			name: "Server error details are hidden",
+			err:  errors.New("pq: password authentication failed"),
+			body: `{"type":"/problems/internal","title":"Internal Server Error","status":500,"instance":"req-1"}`,
+		},
+		{
+			name: "Field errors",
+			err:  FieldErrors{{Field: "title", Message: "must not be empty"}},
+			body: `{"type":"/problems/validation-failed","title":"Unprocessable Entity","status":422,
+				"detail":"the request contains invalid fields","instance":"req-1",
+				"errors":[{"field":"title","message":"must not be empty"}]}`,
+		},
+		{
+			name: "Explicit problem",
+			err:  BadRequest("invalid query parameter", FieldError{Field: "limit", Message: "must be > 0"}),
+			body: `{"type":"/problems/bad-request","title":"Bad Request","status":400,
+				"detail":"invalid query parameter","instance":"req-1",
+				"errors":[{"field":"limit","message":"must be > 0"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rr)
+			c.Request = httptest.NewRequestWithContext(
+				logging.WithRequestID(t.Context(), "req-1"), http.MethodGet, "/", nil)
+
+			Abort(c, tt.err)
+
+			require.True(t, c.IsAborted())
+			require.Equal(t, ContentType, rr.Header().Get("Content-Type"))
+			require.JSONEq(t, tt.body, rr.Body.String())
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", nil)
+	Write(rr, req, fmt.Errorf("%w: title QM", db.ErrConflict))
+
+	require.Equal(t, http.StatusConflict, rr.Code)
+	require.Equal(t, ContentType, rr.Header().Get("Content-Type"))
+	require.JSONEq(t,
+		`{"type":"/problems/conflict","title":"Conflict","status":409,"detail":"record conflicts with an existing one: title QM"}`,
+		rr.Body.String())
+}
+
+func TestDocs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET(TypeBase+":type", Docs)
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequestWithContext(t.Context(), http.MethodGet, target, nil))
+		return rr
+	}
+
+	// every type a problem may carry is documented
+	for _, status := range []int{400, 404, 405, 409, 422, 429, 499, 500, 502, 503} {
+		p := New(status, "")
+		rr := get(p.Type)
+		require.Equal(t, http.StatusOK, rr.Code, p.Type)
+		require.Contains(t, rr.Body.String(), fmt.Sprintf("(%d)", typeStatus(p.Type)), p.Type)
+	}
+
+	rr := get(TypeBase + "nope")
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.Equal(t, ContentType, rr.Header().Get("Content-Type"))
+}
+
+// typeStatus returns the status documented for the type URI.
+func typeStatus(uri string) int {
+	for _, pt := range problemTypes {
+		if TypeBase+pt.slug == uri {
+			return pt.status
+		}
+	}
+	return 0
+}
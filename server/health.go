@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthChecker is implemented by services that depend on external systems
+// such as a database pool or a cache client. Each named check backs the
+// /readyz and /startupz probes; names must be unique across services.
+type HealthChecker interface {
+	HealthChecks() map[string]func(ctx context.Context) error
+}
+
+// Degraded is implemented by the check errors of dependencies a service can
+// run without, such as a cache: they are reported as degraded but leave the
+// probes passing.
+type Degraded interface {
+	Degraded() bool
+}
+
+type checkResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded"
+	statusFailing  = "failing"
+)
+
+func (s *Server) setupProbes(r *gin.Engine) {
+	// /livez only reports that the process can serve HTTP; restarting the pod
+	// would not fix a broken dependency
+	r.GET("/livez", func(c *gin.Context) {
+		writeHealth(c, &healthReport{Status: statusOK, Checks: []checkResult{}})
+	})
+	r.GET("/health", func(c *gin.Context) {
+		writeHealth(c, &healthReport{Status: statusOK, Checks: []checkResult{}})
+	})
+
+	r.GET("/readyz", func(c *gin.Context) {
+		if s.shuttingDown.Load() {
+			writeHealth(c, &healthReport{
+				Status: statusFailing,
+				Checks: []checkResult{{Name: "shutdown", Status: statusFailing, Error: "server is shutting down"}},
+			})
+			return
+		}
+		writeHealth(c, s.checkHealth(c.Request.Context()))
+	})
+
+	// /startupz latches once every dependency has been reachable, so slow
+	// migrations or cold caches don't trip the liveness probe while starting
+	r.GET("/startupz", func(c *gin.Context) {
+		if s.started.Load() {
+			writeHealth(c, &healthReport{Status: statusOK, Checks: []checkResult{}})
+			return
+		}
+		report := s.checkHealth(c.Request.Context())
+		if report.Status != statusFailing {
+			s.started.Store(true)
+		}
+		writeHealth(c, report)
+	})
+}
+
+// checkHealth runs every registered check concurrently, each bounded by the
+// configured timeout.
+func (s *Server) checkHealth(ctx context.Context) *healthReport {
+	checks := make(map[string]func(ctx context.Context) error)
+	for _, svc := range s.Services {
+		if hc, ok := svc.(HealthChecker); ok {
+			maps.Copy(checks, hc.HealthChecks())
+		}
+	}
+	names := slices.Sorted(maps.Keys(checks))
+
+	report := &healthReport{Status: statusOK, Checks: make([]checkResult, len(names))}
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, s.Config.HealthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := checks[name](ctx)
+			result := checkResult{Name: name, Status: statusOK, Duration: time.Since(start).String()}
+			var degraded Degraded
+			switch {
+			case err == nil:
+			case errors.As(err, &degraded) && degraded.Degraded():
+				result.Status = statusDegraded
+				result.Error = err.Error()
+			default:
+				result.Status = statusFailing
+				result.Error = err.Error()
+			}
+			report.Checks[i] = result
+		}()
+	}
+	wg.Wait()
+
+	for _, r := range report.Checks {
+		switch {
+		case r.Status == statusFailing:
+			report.Status = statusFailing
+		case r.Status == statusDegraded && report.Status == statusOK:
+			report.Status = statusDegraded
+		}
+	}
+	return report
+}
+
+// writeHealth responds 200, degraded included, or 503; ?verbose adds
+// per-check JSON detail.
+func writeHealth(c *gin.Context, report *healthReport) {
+	code := http.StatusOK
+	if report.Status == statusFailing {
+		code = http.StatusServiceUnavailable
+	}
+
+	if _, verbose := c.GetQuery("verbose"); verbose {
+		c.JSON(code, report)
+		return
+	}
+	c.String(code, report.Status)
+}
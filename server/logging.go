@@ -0,0 +1,74 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"k8s-backend/logging"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// requestLoggingMiddleware assigns or accepts an X-Request-ID, stores a
+// logger carrying it in both the gin and the request context, and logs the
+// completed request as structured fields.
+func requestLoggingMiddleware(c *gin.Context) {
+	start := time.Now()
+
+	id := c.GetHeader(RequestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.NewString()
+	}
+	c.Header(RequestIDHeader, id)
+
+	logger := slog.Default().With("request_id", id)
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+	}
+	ctx := logging.WithRequestID(c.Request.Context(), id)
+	c.Request = c.Request.WithContext(logging.WithLogger(ctx, logger))
+	c.Set(logging.GinKey, logger)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", c.Request.Method),
+		slog.String("route", c.FullPath()),
+		slog.String("path", c.Request.URL.Path),
+		slog.Int("status", status),
+		slog.Duration("latency", time.Since(start)),
+		slog.Int("bytes", max(c.Writer.Size(), 0)),
+		slog.String("client", c.ClientIP()),
+		slog.String("user_agent", c.Request.UserAgent()),
+	}
+	if len(c.Errors) > 0 {
+		attrs = append(attrs, slog.String("errors", c.Errors.String()))
+	}
+	logger.LogAttrs(c.Request.Context(), level, "request", attrs...)
+}
+
+// validRequestID accepts caller-supplied IDs that are safe to echo and log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
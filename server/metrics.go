@@ -0,0 +1,26 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"k8s-backend/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metricsMiddleware records request counts and latency by route template, so
+// /book/1 and /book/2 share a series. Unmatched routes are grouped together.
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+
+	metrics.HTTPRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+	metrics.HTTPDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+}
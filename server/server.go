@@ -1,15 +1,24 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
-	"sync"
+	"sync/atomic"
 	"time"
 
+	"k8s-backend/config"
 	_ "k8s-backend/docs" // swag init | http://localhost:8081/swagger/index.html
+	"k8s-backend/ratelimit"
+	"k8s-backend/server/apierror"
+	"k8s-backend/tracing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 	f "github.com/swaggo/files"
 	gs "github.com/swaggo/gin-swagger"
 )
@@ -17,35 +26,80 @@ import (
 type Service interface {
 	Init()
 	SetupEndpoints(r *gin.Engine)
+	// Shutdown releases the service's resources (database pools, clients).
+	// It is called once the HTTP server has stopped accepting requests.
+	Shutdown(ctx context.Context) error
+}
+
+// RateLimited is implemented by services whose routes need their own policy
+// instead of the configured default. Keys are "METHOD /route/:template".
+type RateLimited interface {
+	RateLimitPolicies() map[string]ratelimit.Policy
 }
 
 type Server struct {
 	Router   *gin.Engine
-	Port     string
+	Config   config.Server
 	Services []Service
+
+	httpServer    *http.Server
+	redis         *redis.Client
+	started       atomic.Bool
+	shuttingDown  atomic.Bool
+	defaultPolicy ratelimit.Policy
+	policies      map[string]ratelimit.Policy
 }
 
-func NewServer(port string, services []Service) *Server {
-	router := gin.Default()
+func NewServer(cfg *config.Config, services []Service) *Server {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.HandleMethodNotAllowed = true
+	router.NoRoute(func(c *gin.Context) {
+		apierror.Abort(c, apierror.New(http.StatusNotFound, "no route for "+c.Request.URL.Path))
+	})
+	router.NoMethod(func(c *gin.Context) {
+		apierror.Abort(c, apierror.New(http.StatusMethodNotAllowed, c.Request.Method+" is not supported for "+c.Request.URL.Path))
+	})
 
-	router.Use(loggingMiddleware, customHeaderMiddleware)
+	s := &Server{
+		Router:   router,
+		Config:   cfg.Server,
+		Services: services,
+		httpServer: &http.Server{
+			Addr:    cfg.Server.Addr,
+			Handler: router,
+		},
+		defaultPolicy: ratelimit.Policy{
+			Name:      "default",
+			Algorithm: cfg.RateLimit.Algorithm,
+			Capacity:  uint(cfg.RateLimit.Capacity),
+			Rate:      cfg.RateLimit.Rate,
+		},
+		policies: make(map[string]ratelimit.Policy),
+	}
 
-	rateLimiter := NewTokenBucket(5, 1*time.Second)
-	router.Use(func(c *gin.Context) {
-		if !rateLimiter.Allow() {
-			c.String(http.StatusTooManyRequests, "rate limit exceeded")
-			c.Abort()
-			return
-		}
-		c.Next()
-	})
+	router.Use(tracing.Middleware, requestLoggingMiddleware, metricsMiddleware, customHeaderMiddleware)
+
+	// probes and metrics are registered before the rate limiter so the kubelet
+	// and Prometheus are never throttled
+	s.setupProbes(router)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET(apierror.TypeBase+":type", apierror.Docs)
+
+	keyFn, err := ratelimit.NewKeyFunc(cfg.RateLimit.KeyBy, cfg.RateLimit.APIKeyHeader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var limiter ratelimit.Limiter = ratelimit.NewMemoryLimiter(cfg.RateLimit.IdleTTL)
+	if cfg.RateLimit.Backend == "redis" {
+		s.redis = redis.NewClient(cfg.Redis.Options())
+		limiter = ratelimit.NewRedisLimiter(s.redis, limiter)
+	}
+	router.Use(ratelimit.Middleware(limiter, keyFn, s.policyFor))
 
 	// Set up Swagger UI to serve API documentation
 	router.GET("/swagger/*any", gs.WrapHandler(f.Handler))
 
-	router.GET("/health", func(c *gin.Context) {
-		c.String(http.StatusOK, "Gin server healthy")
-	})
 	router.GET("/svc", func(c *gin.Context) {
 		// get query parameter
 		name := c.DefaultQuery("name", "Book")
@@ -54,80 +108,95 @@ func NewServer(port string, services []Service) *Server {
 
 	slog.Info("Gin router", "base path: %s", router.BasePath())
 
-	return &Server{
-		Router:   router,
-		Port:     port,
-		Services: services,
-	}
+	return s
 }
 
-func (s *Server) Run() {
+// Run serves HTTP until ctx is cancelled or the listener fails, then shuts
+// the server down gracefully.
+func (s *Server) Run(ctx context.Context) error {
 	for _, svc := range s.Services {
 		slog.Info("setting up endpoints")
 		svc.SetupEndpoints(s.Router)
+		if rl, ok := svc.(RateLimited); ok {
+			for route, p := range rl.RateLimitPolicies() {
+				if err := p.Validate(); err != nil {
+					return fmt.Errorf("route %s: %w", route, err)
+				}
+				s.policies[route] = p
+			}
+		}
 	}
 
-	slog.Info("starting server", "port", s.Port)
-	if err := s.Router.Run(s.Port); err != nil {
-		log.Fatal(err)
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "addr", s.Config.Addr)
+		serveErr <- s.httpServer.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		slog.Info("shutdown signal received", "timeout", s.Config.ShutdownTimeout)
+	case err = <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
 	}
-	//if err := http.ListenAndServe(s.Port, nil); err != http.ErrServerClosed {
-	//	log.Fatal(err)
-	//}
-}
 
-func loggingMiddleware(c *gin.Context) {
-	start := time.Now()
-	c.Next()
-	latency := time.Since(start)
-	log.Printf("%s %s %d %s", c.Request.Method, c.Request.URL.Path, c.Writer.Status(), latency)
-}
+	// the parent context is already cancelled, drain against a fresh deadline
+	// that only starts once ShutdownDelay is over
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.Config.ShutdownDelay+s.Config.ShutdownTimeout)
+	defer cancel()
 
-// customHeaderMiddleware adds a custom header to all responses
-// Middleware in Gin is a function that takes a gin.Context and performs some operation
-func customHeaderMiddleware(c *gin.Context) {
-	// Add a custom header to the response
-	// Headers set using c.Header will be included in the HTTP response
-	c.Header("X-Custom-Header", "Middleware-Active")
-	// Call the next middleware or the final handler in the chain
-	c.Next()
+	return errors.Join(err, s.Shutdown(shutdownCtx))
 }
 
-type TokenBucket struct {
-	Capacity   uint
-	Tokens     uint
-	Rate       time.Duration
-	LastFilled time.Time
-	sync.Mutex
-}
-
-func NewTokenBucket(capacity uint, rate time.Duration) *TokenBucket {
-	return &TokenBucket{
-		Capacity:   capacity,
-		Tokens:     capacity,
-		Rate:       rate,
-		LastFilled: time.Now().Local(),
+// Shutdown fails readiness, gives load balancers ShutdownDelay to stop routing
+// new traffic, stops accepting connections, waits for in-flight requests until
+// ctx expires, then shuts down every service in reverse registration order.
+// ctx bounds the delay too, so it must outlast it.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+
+	s.shuttingDown.Store(true)
+	select {
+	case <-time.After(s.Config.ShutdownDelay):
+	case <-ctx.Done():
 	}
-}
 
-func (tb *TokenBucket) Allow() bool {
-	tb.Lock()
-	defer tb.Unlock()
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("draining http server: %w", err))
+	}
 
-	elapsed := time.Since(tb.LastFilled)
-	addTokens := uint(elapsed / tb.Rate) // refill if at least [1] second has elapsed
-	tb.Tokens += addTokens
-	if tb.Tokens > tb.Capacity {
-		tb.Tokens = tb.Capacity
+	for i := len(s.Services) - 1; i >= 0; i-- {
+		if err := s.Services[i].Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutting down service %T: %w", s.Services[i], err))
+		}
 	}
-	if addTokens > 0 {
-		tb.LastFilled = time.Now()
+
+	if s.redis != nil {
+		if err := s.redis.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing rate limiter redis client: %w", err))
+		}
 	}
 
-	if tb.Tokens > 0 {
-		tb.Tokens--
-		return true
+	slog.Info("server stopped")
+	return errors.Join(errs...)
+}
+
+func (s *Server) policyFor(route string) ratelimit.Policy {
+	if p, ok := s.policies[route]; ok {
+		return p
 	}
+	return s.defaultPolicy
+}
 
-	return false
+// customHeaderMiddleware adds a custom header to all responses
+// Middleware in Gin is a function that takes a gin.Context and performs some operation
+func customHeaderMiddleware(c *gin.Context) {
+	// Add a custom header to the response
+	// Headers set using c.Header will be included in the HTTP response
+	c.Header("X-Custom-Header", "Middleware-Active")
+	// Call the next middleware or the final handler in the chain
+	c.Next()
 }
@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"k8s-backend/config"
 	db "k8s-backend/database"
+	"k8s-backend/logging"
 	m "k8s-backend/model"
 	svc "k8s-backend/services"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/require"
 )
 
@@ -46,3 +53,287 @@ func TestRegisterHandler(t *testing.T) {
 	require.Equal(t, http.StatusOK, rr.Code)
 	t.Log(rr.Body.String())
 }
+
+type recordingService struct {
+	name  string
+	order *[]string
+}
+
+func (s *recordingService) Init() {}
+
+func (s *recordingService) SetupEndpoints(r *gin.Engine) {
+	r.GET("/"+s.name, func(c *gin.Context) {
+		time.Sleep(200 * time.Millisecond) // in flight when the signal arrives
+		c.String(http.StatusOK, s.name)
+	})
+}
+
+func (s *recordingService) Shutdown(_ context.Context) error {
+	*s.order = append(*s.order, s.name)
+	return nil
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestServerGracefulShutdown(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name  string
+		delay time.Duration
+		// sent is when the request is sent, relative to the signal
+		sent time.Duration
+	}{
+		{"No delay", 0, -50 * time.Millisecond},
+		// the drain gets its full timeout after the delay
+		{"Delay longer than the timeout", 600 * time.Millisecond, 550 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var order []string
+			cfg := config.Default()
+			cfg.Server.Addr = freeAddr(t)
+			cfg.Server.ShutdownDelay = tt.delay
+			cfg.Server.ShutdownTimeout = 500 * time.Millisecond
+			srv := NewServer(cfg, []Service{
+				&recordingService{name: "first", order: &order},
+				&recordingService{name: "second", order: &order},
+			})
+
+			ctx, cancel := context.WithCancel(t.Context())
+			done := make(chan error, 1)
+			go func() { done <- srv.Run(ctx) }()
+
+			require.Eventually(t, func() bool {
+				conn, err := net.Dial("tcp", cfg.Server.Addr)
+				if err == nil {
+					conn.Close()
+				}
+				return err == nil
+			}, time.Second, 10*time.Millisecond)
+
+			res := make(chan int, 1)
+			get := func() {
+				r, err := http.Get("http://" + cfg.Server.Addr + "/first")
+				if err != nil {
+					res <- 0
+					return
+				}
+				r.Body.Close()
+				res <- r.StatusCode
+			}
+			if tt.sent < 0 {
+				go get()
+				time.Sleep(-tt.sent)
+				cancel()
+			} else {
+				cancel()
+				time.AfterFunc(tt.sent, get)
+			}
+
+			require.Equal(t, http.StatusOK, <-res, "in-flight request must be drained")
+			require.NoError(t, <-done)
+			require.Equal(t, []string{"second", "first"}, order)
+		})
+	}
+}
+
+type dependencyService struct {
+	recordingService
+	err error
+}
+
+func (s *dependencyService) HealthChecks() map[string]func(ctx context.Context) error {
+	return map[string]func(ctx context.Context) error{
+		"database": func(ctx context.Context) error { return s.err },
+		"slow": func(ctx context.Context) error {
+			<-ctx.Done() // only returns once the per-check timeout fires
+			return nil
+		},
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var order []string
+	dep := &dependencyService{
+		recordingService: recordingService{name: "dep", order: &order},
+		err:              errors.New("connection refused"),
+	}
+	cfg := config.Default()
+	cfg.Server.ShutdownDelay = 0
+	cfg.Server.HealthCheckTimeout = 20 * time.Millisecond
+	srv := NewServer(cfg, []Service{dep})
+
+	probe := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, path, nil)
+		srv.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	require.Equal(t, http.StatusOK, probe("/livez").Code)
+	require.Equal(t, http.StatusServiceUnavailable, probe("/startupz").Code)
+
+	rr := probe("/readyz?verbose")
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	var report struct {
+		Status string
+		Checks []struct{ Name, Status, Error string }
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	require.Equal(t, "failing", report.Status)
+	require.Len(t, report.Checks, 2)
+	require.Equal(t, "database", report.Checks[0].Name)
+	require.Equal(t, "connection refused", report.Checks[0].Error)
+	require.Equal(t, "slow", report.Checks[1].Name)
+	require.Equal(t, "ok", report.Checks[1].Status)
+
+	dep.err = nil
+	require.Equal(t, http.StatusOK, probe("/readyz").Code)
+	require.Equal(t, http.StatusOK, probe("/startupz").Code)
+
+	// startup latches even if a dependency fails later
+	dep.err = errors.New("connection reset")
+	require.Equal(t, http.StatusOK, probe("/startupz").Code)
+	require.Equal(t, http.StatusServiceUnavailable, probe("/readyz").Code)
+
+	dep.err = nil
+	require.NoError(t, srv.Shutdown(t.Context()))
+	require.Equal(t, http.StatusServiceUnavailable, probe("/readyz").Code)
+	require.Equal(t, http.StatusOK, probe("/livez").Code)
+}
+
+// optionalDependency can run without its cache.
+type optionalDependency struct {
+	recordingService
+	err error
+}
+
+type degradedError struct{ error }
+
+func (degradedError) Degraded() bool { return true }
+
+func (s *optionalDependency) HealthChecks() map[string]func(ctx context.Context) error {
+	return map[string]func(ctx context.Context) error{
+		"cache": func(ctx context.Context) error { return s.err },
+	}
+}
+
+func TestHealthProbesDegraded(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var order []string
+	dep := &optionalDependency{
+		recordingService: recordingService{name: "dep", order: &order},
+		err:              degradedError{errors.New("circuit breaker open")},
+	}
+	srv := NewServer(config.Default(), []Service{dep})
+
+	probe := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, path, nil)
+		srv.Router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the pod starts and takes traffic without its cache
+	require.Equal(t, http.StatusOK, probe("/startupz").Code)
+	rr := probe("/readyz")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "degraded", rr.Body.String())
+
+	rr = probe("/readyz?verbose")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var report struct {
+		Status string
+		Checks []struct{ Name, Status, Error string }
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	require.Equal(t, "degraded", report.Status)
+	require.Equal(t, "degraded", report.Checks[0].Status)
+	require.Equal(t, "circuit breaker open", report.Checks[0].Error)
+
+	dep.err = nil
+	require.Equal(t, "ok", probe("/readyz").Body.String())
+}
+
+func TestRequestLogging(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	srv := NewServer(config.Default(), nil)
+	var handlerID string
+	srv.Router.GET("/items/:id", func(c *gin.Context) {
+		handlerID = logging.RequestID(c.Request.Context())
+		logging.FromContext(c.Request.Context()).Info("handling")
+		c.String(http.StatusOK, "ok")
+	})
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/items/7", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	rr := httptest.NewRecorder()
+	srv.Router.ServeHTTP(rr, req)
+
+	require.Equal(t, "abc-123", rr.Header().Get(RequestIDHeader))
+	require.Equal(t, "abc-123", handlerID)
+
+	var lines []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(line, &entry))
+		if entry["request_id"] != nil {
+			lines = append(lines, entry)
+		}
+	}
+	require.Len(t, lines, 2)
+	require.Equal(t, "handling", lines[0]["msg"])
+	require.Equal(t, "request", lines[1]["msg"])
+	require.Equal(t, "/items/:id", lines[1]["route"])
+	require.Equal(t, "/items/7", lines[1]["path"])
+	require.EqualValues(t, http.StatusOK, lines[1]["status"])
+	require.EqualValues(t, 2, lines[1]["bytes"])
+
+	// invalid IDs are replaced rather than echoed
+	req = httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/items/7", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	rr = httptest.NewRecorder()
+	srv.Router.ServeHTTP(rr, req)
+	require.NotEqual(t, "bad id\n", rr.Header().Get(RequestIDHeader))
+	require.Len(t, rr.Header().Get(RequestIDHeader), 36)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := config.Default()
+	cfg.RateLimit.Capacity = 1
+	cfg.RateLimit.Rate = time.Hour
+	srv := NewServer(cfg, nil)
+	srv.Router.GET("/widgets/:id", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	for _, path := range []string{"/widgets/1", "/widgets/2"} {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, path, nil)
+		srv.Router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rr := httptest.NewRecorder()
+	srv.Router.ServeHTTP(rr, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	body := rr.Body.String()
+	require.Contains(t, body, `k8s_backend_http_requests_total{method="GET",route="/widgets/:id",status="200"} 1`)
+	require.Contains(t, body, `k8s_backend_http_requests_total{method="GET",route="/widgets/:id",status="429"} 1`)
+	require.Contains(t, body, `k8s_backend_ratelimit_rejections_total{policy="default"}`)
+	require.Contains(t, body, `k8s_backend_http_request_duration_seconds_bucket{method="GET",route="/widgets/:id",status="200"`)
+}
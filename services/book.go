@@ -1,13 +1,23 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"k8s-backend/breaker"
+	"k8s-backend/config"
 	db "k8s-backend/database"
+	"k8s-backend/logging"
 	m "k8s-backend/model"
+	"k8s-backend/pagination"
+	"k8s-backend/ratelimit"
+	"k8s-backend/server/apierror"
+	"k8s-backend/tracing"
 	"log"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -17,22 +27,69 @@ import (
 )
 
 type BookService struct {
-	DB    db.Database[m.Book]
+	// DB is usually a db.CachedDatabase on Cache.
+	DB db.Database[m.Book]
+	// Cache is the Redis client, checked for readiness and closed on
+	// shutdown.
 	Cache *redis.Client
+	// Breaker, if set, guards Cache, and readiness reports its state along
+	// with Redis failures.
+	Breaker *breaker.Breaker
+	// Cursors signs the pagination cursors of GetBooksHandler.
+	Cursors pagination.Codec
+	// MaxLimit caps the page size; 0 means no cap.
+	MaxLimit int
+	// MaxAge is how long clients and CDNs may reuse a page of books; 0
+	// has them revalidate every time.
+	MaxAge time.Duration
 }
 
-func NewBookService() *BookService {
+// BookPage is a page of books and the links to its neighbours.
+type BookPage struct {
+	Data     []*m.Book      `json:"data"`
+	Metadata m.PageMetadata `json:"metadata"`
+}
+
+// SeedBooks are the sample books inserted by Seed.
+var SeedBooks = []m.Book{
+	{Title: "QM", Author: "Bohr", Price: 10.99},
+	{Title: "QFT", Author: "Dirac", Price: 11.99},
+	{Title: "GR", Author: "Einstein", Price: 12.99},
+}
+
+func NewBookService(cfg *config.Config) *BookService {
+	cache := redis.NewClient(cfg.Redis.Options())
+	if err := tracing.InstrumentRedis(cache); err != nil {
+		slog.Warn("redis tracing disabled", "error", err)
+	}
+	var cb *breaker.Breaker
+	if cfg.Redis.BreakerThreshold > 0 {
+		cb = breaker.New("redis", cfg.Redis.BreakerThreshold, cfg.Redis.BreakerCooldown)
+		cache.AddHook(breaker.RedisHook(cb))
+	}
+
+	var seed []m.Book
+	if cfg.Database.Seed {
+		seed = SeedBooks
+	}
+
 	return &BookService{
-		DB: &db.Postgres[m.Book]{
-			InitElements: []m.Book{
-				{Title: "QM", Author: "Bohr", Price: 10.99},
-				{Title: "QFT", Author: "Dirac", Price: 11.99},
-				{Title: "GR", Author: "Einstein", Price: 12.99},
-			},
+		DB: &db.CachedDatabase[m.Book]{
+			Database:    db.New(cfg, seed),
+			Client:      cache,
+			Name:        "book",
+			TTL:         cfg.Redis.TTL,
+			NegativeTTL: cfg.Redis.NegativeTTL,
+			RefreshBeta: cfg.Redis.RefreshBeta,
+			LocalSize:   cfg.Redis.LocalSize,
+			LocalTTL:    cfg.Redis.LocalTTL,
+			ListTTL:     cfg.Redis.ListTTL,
 		},
-		Cache: redis.NewClient(&redis.Options{
-			Addr: "localhost:6379", // TODO: Config
-		}),
+		Cache:    cache,
+		Breaker:  cb,
+		Cursors:  pagination.NewCodec(cfg.Pagination.CursorSecret),
+		MaxLimit: cfg.Pagination.MaxLimit,
+		MaxAge:   cfg.Pagination.MaxAge,
 	}
 }
 
@@ -41,6 +98,59 @@ func (s *BookService) Init() {
 		slog.Error(err.Error())
 		log.Fatal(fmt.Errorf("failed to initialize database: %w", err))
 	}
+	if err := s.DB.Seed(context.Background()); err != nil {
+		slog.Error(err.Error())
+		log.Fatal(fmt.Errorf("failed to seed database: %w", err))
+	}
+}
+
+// Shutdown closes the database pool and the Redis client.
+func (s *BookService) Shutdown(_ context.Context) error {
+	var errs []error
+	if err := s.DB.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing database: %w", err))
+	}
+	if s.Cache != nil {
+		if err := s.Cache.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing redis client: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HealthChecks reports the reachability of Postgres and Redis, and the state
+// of the Redis circuit breaker. Redis failures are degraded rather than
+// failing, as books are served without it.
+func (s *BookService) HealthChecks() map[string]func(ctx context.Context) error {
+	ping := func(ctx context.Context) error {
+		if err := s.Cache.Ping(ctx).Err(); err != nil {
+			return degraded{err}
+		}
+		return nil
+	}
+	if s.Breaker != nil {
+		ping = s.Breaker.Check(ping)
+	}
+	return map[string]func(ctx context.Context) error{
+		"database": s.DB.Ping,
+		"redis":    ping,
+	}
+}
+
+// RateLimitPolicies gives writes a stricter budget, shared by create, update
+// and delete, than the server-wide default.
+func (s *BookService) RateLimitPolicies() map[string]ratelimit.Policy {
+	writes := ratelimit.Policy{
+		Name:      "book-writes",
+		Algorithm: ratelimit.AlgorithmSlidingWindow,
+		Capacity:  3,
+		Rate:      2 * time.Second,
+	}
+	return map[string]ratelimit.Policy{
+		"POST /api/v1/book":   writes,
+		"PATCH /api/v1/book":  writes,
+		"DELETE /api/v1/book": writes,
+	}
 }
 
 func (s *BookService) SetupEndpoints(r *gin.Engine) {
@@ -67,7 +177,18 @@ func (s *BookService) SetupEndpoints(r *gin.Engine) {
 // @Description Retrieve a list of all available books
 // @Tags books
 // @Produce json
-// @Success 200 {array} m.Book
+// @Param limit query int false "Page size" default(10)
+// @Param offset query int false "Number of books to skip, prefer cursor" default(0)
+// @Param cursor query string false "Opaque cursor from metadata.next or metadata.prev"
+// @Param total query string false "Include a total count" Enums(exact, estimate)
+// @Param sort query string false "Comma separated fields, prefix with - for descending" default(title)
+// @Param title query string false "Title contains; title[op]=value with op one of eq, ne, lt, lte, gt, gte, in, between, prefix, contains, isnull"
+// @Param author query string false "Author contains; author[op]=value as for title"
+// @Param price query number false "Minimum price; price[op]=value, e.g. price[between]=10,20"
+// @Success 200 {object} BookPage
+// @Header 200 {string} Cache-Control "How long clients and CDNs may reuse the page"
+// @Failure 400 {object} apierror.Problem
+// @Failure 503 {object} apierror.Problem
 // @Router /api/v1/books [get]
 func (s *BookService) GetBooksHandler(c *gin.Context) {
 	// extract query parameters
@@ -75,102 +196,225 @@ func (s *BookService) GetBooksHandler(c *gin.Context) {
 	o := c.DefaultQuery("offset", "0")
 
 	filters := new(m.Filters[m.Book])
-	filters.Model = new(m.Book)
-	filters.Model.Title = c.Query("title")
-	filters.Model.Author = c.Query("author")
-	if price := c.Query("price"); price != "" {
-		n, err := strconv.ParseFloat(price, 32)
-		if err != nil {
-			c.String(http.StatusBadRequest, "'price' query parameter must be a number >= 0")
+
+	// every other parameter filters on a field: price[lte]=20&author[in]=Bohr,Dirac
+	where, err := db.ParseWhere[m.Book](filterParams(c))
+	if err != nil {
+		apierror.Abort(c, queryProblem(err))
+		return
+	}
+	filters.Where = where
+
+	// sort=-price,title; sortBy and order are still accepted for older clients
+	sort := c.Query("sort")
+	if sort == "" {
+		sort = c.DefaultQuery("sortBy", "title")
+		switch c.DefaultQuery("order", "ASC") {
+		case "ASC":
+		case "DESC":
+			sort = "-" + sort
+		default:
+			apierror.Abort(c, apierror.BadRequest("invalid query parameter",
+				apierror.FieldError{Field: "order", Message: "must be ASC or DESC"}))
 			return
 		}
-		filters.Model.Price = n
 	}
-
-	filters.SortBy = c.DefaultQuery("sortBy", "title")
-	order := c.DefaultQuery("order", "ASC")
-	if order != "ASC" && order != "DESC" {
-		c.String(http.StatusBadRequest, "'order' query parameter must be ASC or DESC")
+	sortFields, err := db.ParseSort[m.Book](sort)
+	if err != nil {
+		apierror.Abort(c, queryProblem(err))
 		return
 	}
-	filters.Order = order
+	filters.Sort = sortFields
 
 	limit, err := strconv.Atoi(l)
 	if err != nil || limit <= 0 {
-		c.String(http.StatusBadRequest, "response limit must be a number greater than zero: %v", err)
+		apierror.Abort(c, apierror.BadRequest("invalid query parameter",
+			apierror.FieldError{Field: "limit", Message: "must be a number greater than zero"}))
+		return
+	}
+	if s.MaxLimit > 0 && limit > s.MaxLimit {
+		apierror.Abort(c, apierror.BadRequest("invalid query parameter",
+			apierror.FieldError{Field: "limit", Message: fmt.Sprintf("must be at most %d", s.MaxLimit)}))
 		return
 	}
 	filters.Limit = limit
 
 	offset, err := strconv.Atoi(o)
 	if err != nil || offset < 0 {
-		c.String(http.StatusBadRequest, fmt.Sprintf("response offset must be a non-negative number: %v", err))
+		apierror.Abort(c, apierror.BadRequest("invalid query parameter",
+			apierror.FieldError{Field: "offset", Message: "must be a non-negative number"}))
 		return
 	}
 	filters.Offset = offset
 
-	// each request gets its own unbuffered channel
-	queue := make(chan *m.Result)
-
-	go func() {
-		books, err := s.DB.GetAll(filters)
-		queue <- &m.Result{Value: books, Error: err}
-	}()
+	// the cursor is only valid for the sort order and filters it was issued for
+	query := pagination.Fingerprint(filters.Sort, filters.Where)
+	if raw := c.Query("cursor"); raw != "" {
+		if offset > 0 {
+			apierror.Abort(c, apierror.BadRequest("invalid query parameter",
+				apierror.FieldError{Field: "offset", Message: "cannot be combined with cursor"}))
+			return
+		}
+		cursor, err := s.Cursors.Decode(raw, query)
+		if err != nil {
+			apierror.Abort(c, apierror.BadRequest("invalid query parameter",
+				apierror.FieldError{Field: "cursor", Message: err.Error()}))
+			return
+		}
+		filters.Cursor = cursor
+	}
 
-	r := <-queue
-	if r.Error != nil {
-		c.JSON(http.StatusInternalServerError, r.Error.Error())
+	total := c.Query("total")
+	var countMode db.CountMode
+	switch total {
+	case "":
+	case "exact":
+		countMode = db.CountExact
+	case "estimate":
+		countMode = db.CountEstimate
+	default:
+		apierror.Abort(c, apierror.BadRequest("invalid query parameter",
+			apierror.FieldError{Field: "total", Message: "must be exact or estimate"}))
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"data":     r.Value,
-		"metadata": filters,
-	})
-}
 
-func (s *BookService) GetBookHandler(c *gin.Context) {
-	id := c.Param("id")
-	if id == "" {
-		http.Error(c.Writer, "id path parameter must be provided", http.StatusBadRequest)
-		return
+	ctx := c.Request.Context()
+
+	type listing struct {
+		page  *db.Page[m.Book]
+		total *int64
 	}
 
-	// check Redis cache first
-	key := fmt.Sprintf("book:%s", id)
-	val, err := s.Cache.Get(c, key).Result()
-	if err == nil {
-		// cache hit
-		var book m.Book
-		if err := json.Unmarshal([]byte(val), &book); err != nil {
-			c.String(http.StatusInternalServerError, err.Error())
+	// each request gets its own channel, buffered so the worker never blocks
+	// on a handler that has already given up
+	queue := make(chan *m.Result, 1)
+
+	go func() {
+		// ctx carries the request span across the channel hop and cancels the
+		// query when the client disconnects
+		page, err := db.GetPage(ctx, s.DB, filters)
+		if err != nil || total == "" {
+			queue <- &m.Result{Value: listing{page: page}, Error: err}
 			return
 		}
-		c.JSON(http.StatusOK, book)
+		n, err := s.DB.Count(ctx, filters.Where, countMode)
+		queue <- &m.Result{Value: listing{page: page, total: &n}, Error: err}
+	}()
+
+	var r *m.Result
+	select {
+	case r = <-queue:
+	case <-ctx.Done():
+		logging.FromContext(ctx).Warn("client went away while listing books", "error", ctx.Err())
+		apierror.Abort(c, ctx.Err())
 		return
-	} else if err != redis.Nil {
-		// any error other than a cache miss
-		c.String(http.StatusInternalServerError, "redis get error: %w", err)
+	}
+	if r.Error != nil {
+		apierror.Abort(c, r.Error)
 		return
 	}
 
-	// cache miss
-	book, err := s.DB.Get(id)
-	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			c.String(http.StatusNotFound, err.Error())
-			return
-		}
-		c.String(http.StatusInternalServerError, err.Error())
+	result := r.Value.(listing)
+	metadata := m.PageMetadata{
+		Limit:  filters.Limit,
+		Offset: filters.Offset,
+		Sort:   filters.Sort,
+		Where:  filters.Where,
+		Total:  result.total,
+	}
+	if metadata.Next, err = s.pageLink(c, result.page.Next, query); err != nil {
+		apierror.Abort(c, err)
 		return
 	}
+	if metadata.Prev, err = s.pageLink(c, result.page.Prev, query); err != nil {
+		apierror.Abort(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", cacheControl(s.MaxAge))
+	c.JSON(http.StatusOK, BookPage{Data: result.page.Items, Metadata: metadata})
+}
+
+// degraded is the failure of a dependency books are served without.
+type degraded struct {
+	error
+}
+
+func (e degraded) Unwrap() error {
+	return e.error
+}
+
+func (degraded) Degraded() bool {
+	return true
+}
+
+// cacheControl returns the Cache-Control header letting shared caches reuse a
+// response for maxAge. Errors are sent without one.
+func cacheControl(maxAge time.Duration) string {
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+}
 
-	data, err := json.Marshal(book)
+// pageLink returns the request's URL with its offset replaced by the signed
+// cursor, or "" when there is no page to link to.
+func (s *BookService) pageLink(c *gin.Context, cursor *m.Cursor, query string) (string, error) {
+	if cursor == nil {
+		return "", nil
+	}
+	token, err := s.Cursors.Encode(cursor, query)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		return "", err
+	}
+	q := c.Request.URL.Query()
+	q.Del("offset")
+	q.Set("cursor", token)
+	return c.Request.URL.Path + "?" + q.Encode(), nil
+}
+
+// listQueryParams are the query parameters of list endpoints that are not
+// filters.
+var listQueryParams = []string{"limit", "offset", "cursor", "total", "sort", "sortBy", "order"}
+
+// filterParams returns the request's query parameters minus listQueryParams.
+func filterParams(c *gin.Context) url.Values {
+	params := c.Request.URL.Query()
+	for _, name := range listQueryParams {
+		delete(params, name)
+	}
+	return params
+}
+
+// queryProblem turns an invalid sort or filter parameter into a 400 naming it.
+func queryProblem(err error) error {
+	var qe *db.QueryError
+	if errors.As(err, &qe) {
+		return apierror.BadRequest("invalid query parameter", apierror.FieldError{Field: qe.Param, Message: qe.Message})
+	}
+	return err
+}
+
+// GetBookHandler godoc
+// @Summary Get a book
+// @Description Retrieve a single book by ID
+// @Tags books
+// @Produce json
+// @Param id path int true "Book ID"
+// @Success 200 {object} model.Book
+// @Failure 404 {object} apierror.Problem
+// @Failure 503 {object} apierror.Problem
+// @Router /api/v1/book/{id} [get]
+func (s *BookService) GetBookHandler(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		apierror.Abort(c, apierror.BadRequest("id path parameter must be provided"))
 		return
 	}
-	if err := s.Cache.Set(c, key, data, 24*time.Hour).Err(); err != nil {
-		c.String(http.StatusInternalServerError, "redis set error: %w", err)
+
+	book, err := s.DB.Get(c.Request.Context(), id)
+	if err != nil {
+		apierror.Abort(c, err)
 		return
 	}
 
@@ -185,46 +429,61 @@ func (s *BookService) GetBookHandler(c *gin.Context) {
 // @Produce json
 // @Param book body model.Book true "Book data"
 // @Success 201 {object} model.Book
-// @Failure 400 {object} error
+// @Failure 400 {object} apierror.Problem
+// @Failure 409 {object} apierror.Problem
+// @Failure 422 {object} apierror.Problem
 // @Router /api/v1/book [post]
 func (s *BookService) CreateBookHandler(c *gin.Context) {
 	var book m.Book
 	if err := c.ShouldBindBodyWithJSON(&book); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apierror.Abort(c, apierror.BadRequest(err.Error()))
 		return
 	}
 
 	book.CreatedAt = time.Now().Format(time.RFC3339)
 
 	if err := ValidateBook(&book); err != nil {
-		http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+		apierror.Abort(c, err)
 		return
 	}
 
-	if err := s.DB.Insert("", &book); err != nil {
-		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+	if err := s.DB.Insert(c.Request.Context(), "", &book); err != nil {
+		apierror.Abort(c, err)
 		return
 	}
 
 	c.String(http.StatusCreated, "%s created successfully with ID %d", book.Title, book.Id)
 }
 
+// UpdateBookHandler godoc
+// @Summary Update a book
+// @Description Apply a partial update to a book
+// @Tags books
+// @Accept json
+// @Produce json
+// @Param id query int true "Book ID"
+// @Param fields body object true "Fields to update"
+// @Success 204
+// @Failure 400 {object} apierror.Problem
+// @Failure 404 {object} apierror.Problem
+// @Failure 409 {object} apierror.Problem
+// @Router /api/v1/book [patch]
 func (s *BookService) UpdateBookHandler(c *gin.Context) {
 	id := c.Query("id")
 	if id == "" {
-		http.Error(c.Writer, "query parameter 'id' must be provided", http.StatusBadRequest)
+		apierror.Abort(c, apierror.BadRequest("query parameter 'id' must be provided"))
 		return
 	}
 
 	var updates map[string]any
 	// Decode the JSON body into a map of fields to update
 	if err := json.NewDecoder(c.Request.Body).Decode(&updates); err != nil {
-		http.Error(c.Writer, "Invalid input", http.StatusBadRequest)
+		apierror.Abort(c, apierror.BadRequestf("request body must be a JSON object: %v", err))
 		return
 	}
 
-	if err := s.DB.Update(id, updates); err != nil {
-		http.Error(c.Writer, fmt.Sprintf("Failed to update book: %v", err), http.StatusInternalServerError)
+	if err := s.DB.Update(c.Request.Context(), id, updates); err != nil {
+		apierror.Abort(c, err)
 		return
 	}
 
@@ -232,17 +491,25 @@ func (s *BookService) UpdateBookHandler(c *gin.Context) {
 	c.Writer.WriteHeader(http.StatusNoContent)
 }
 
+// DeleteBookHandler godoc
+// @Summary Delete a book
+// @Tags books
+// @Produce json
+// @Param id query int true "Book ID"
+// @Success 204
+// @Failure 400 {object} apierror.Problem
+// @Failure 404 {object} apierror.Problem
+// @Router /api/v1/book [delete]
 func (s *BookService) DeleteBookHandler(c *gin.Context) {
 	id := c.Query("id")
 	if id == "" {
-		http.Error(c.Writer, "query parameter 'id' must be provided", http.StatusBadRequest)
+		apierror.Abort(c, apierror.BadRequest("query parameter 'id' must be provided"))
 		return
 	}
 
-	// TODO: Get first to see if it exists
-
-	if err := s.DB.Delete(id); err != nil {
-		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+	// a missing book is reported as ErrNotFound, no need to Get it first
+	if err := s.DB.Delete(c.Request.Context(), id); err != nil {
+		apierror.Abort(c, err)
 		return
 	}
 
@@ -250,5 +517,18 @@ func (s *BookService) DeleteBookHandler(c *gin.Context) {
 }
 
 func ValidateBook(book *m.Book) error {
+	var errs apierror.FieldErrors
+	if strings.TrimSpace(book.Title) == "" {
+		errs = append(errs, apierror.FieldError{Field: "title", Message: "must not be empty"})
+	}
+	if strings.TrimSpace(book.Author) == "" {
+		errs = append(errs, apierror.FieldError{Field: "author", Message: "must not be empty"})
+	}
+	if book.Price < 0 {
+		errs = append(errs, apierror.FieldError{Field: "price", Message: "must be >= 0"})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
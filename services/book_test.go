@@ -2,27 +2,44 @@ package services
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"k8s-backend/breaker"
 	db "k8s-backend/database"
 	"k8s-backend/model"
+	"k8s-backend/server/apierror"
+	"k8s-backend/tracing"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 //func TestMain(m *testing.M) {}
 
+// testBooks seeds the in-memory database with ids 1 to 3, as in production.
+var testBooks = []model.Book{
+	{Title: "QM", Author: "Bohr", Price: 10.99},
+	{Title: "QFT", Author: "Dirac", Price: 11.99},
+	{Title: "GR", Author: "Einstein", Price: 12.99},
+}
+
 // TODO: table-driven tests
 func TestGetBookHandler(t *testing.T) {
 	bookSvc := &BookService{
-		DB: &db.Cache[model.Book]{},
-		Cache: redis.NewClient(&redis.Options{
-			Addr: "localhost:6379", // TODO: Config
-		}),
+		DB:    &db.Cache[model.Book]{InitElements: testBooks},
+		Cache: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}),
 	}
 	bookSvc.Init()
 	defer bookSvc.DB.Close()
@@ -49,7 +66,7 @@ func TestGetBookHandler(t *testing.T) {
 	req, err = http.NewRequestWithContext(
 		t.Context(),
 		http.MethodGet,
-		"/api/v1/book/0",
+		"/api/v1/book/1",
 		nil,
 	)
 	if err != nil {
@@ -75,14 +92,13 @@ func TestGetBookHandler(t *testing.T) {
 	router.ServeHTTP(rr, req)
 	t.Log(rr.Body.String())
 	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.Equal(t, apierror.ContentType, rr.Header().Get("Content-Type"))
 }
 
 func TestCreateBookHandler(t *testing.T) {
 	bookSvc := &BookService{
-		DB: &db.Cache[model.Book]{},
-		Cache: redis.NewClient(&redis.Options{
-			Addr: "localhost:6379", // TODO: Config
-		}),
+		DB:    &db.Cache[model.Book]{InitElements: testBooks},
+		Cache: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}),
 	}
 	bookSvc.Init()
 	defer bookSvc.DB.Close()
@@ -111,12 +127,50 @@ func TestCreateBookHandler(t *testing.T) {
 	require.Equal(t, http.StatusCreated, rr.Code)
 }
 
+func TestUpdateBookHandler(t *testing.T) {
+	bookSvc := &BookService{
+		DB:    &db.Cache[model.Book]{InitElements: testBooks},
+		Cache: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}),
+	}
+	bookSvc.Init()
+	defer bookSvc.DB.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	bookSvc.SetupEndpoints(router)
+
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+	}{
+		{"Partial update", "2", `{"price": 9.5}`, http.StatusNoContent},
+		{"Unique title", "2", `{"title": "QM"}`, http.StatusConflict},
+		{"Unknown column", "2", `{"isbn": "123"}`, http.StatusUnprocessableEntity},
+		{"Missing book", "42", `{"price": 1}`, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodPatch,
+				"/api/v1/book?id="+tt.id, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			require.Equal(t, tt.status, rr.Code, rr.Body.String())
+		})
+	}
+
+	book, err := bookSvc.DB.Get(t.Context(), "2")
+	require.NoError(t, err)
+	require.Equal(t, model.Book{Id: 2, Title: "QFT", Author: "Dirac", Price: 9.5}, *book)
+}
+
 func TestDeleteBookHandler(t *testing.T) {
 	bookSvc := &BookService{
-		DB: &db.Cache[model.Book]{},
-		Cache: redis.NewClient(&redis.Options{
-			Addr: "localhost:6379", // TODO: Config
-		}),
+		DB:    &db.Cache[model.Book]{InitElements: testBooks},
+		Cache: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}),
 	}
 	bookSvc.Init()
 	defer bookSvc.DB.Close()
@@ -124,7 +178,7 @@ func TestDeleteBookHandler(t *testing.T) {
 	req, err := http.NewRequestWithContext(
 		t.Context(),
 		http.MethodDelete,
-		"/api/v1/book?id=0",
+		"/api/v1/book?id=1",
 		nil,
 	)
 	if err != nil {
@@ -151,6 +205,381 @@ func TestDeleteBookHandler(t *testing.T) {
 
 	rr = httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
-	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, http.StatusNotFound, rr.Code)
 	t.Log(rr.Body.String())
 }
+
+func TestBookCacheStaysFresh(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	books := db.NewCached[model.Book](&db.Cache[model.Book]{InitElements: testBooks}, cache, "book", time.Hour)
+	books.ListTTL = time.Hour
+	bookSvc := &BookService{
+		DB:     books,
+		Cache:  cache,
+		MaxAge: 5 * time.Second,
+	}
+	bookSvc.Init()
+	defer bookSvc.DB.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	bookSvc.SetupEndpoints(router)
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req, err := http.NewRequestWithContext(t.Context(), method, target, strings.NewReader(body))
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	price := func(id string) float64 {
+		t.Helper()
+		rr := serve(http.MethodGet, "/api/v1/book/"+id, "")
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var book model.Book
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &book))
+		return book.Price
+	}
+
+	cheapest := func() string {
+		t.Helper()
+		rr := serve(http.MethodGet, "/api/v1/books?sort=price&limit=1&total=exact", "")
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		require.Equal(t, "public, max-age=5", rr.Header().Get("Cache-Control"))
+		var page BookPage
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+		return page.Data[0].Title
+	}
+
+	require.Equal(t, 10.99, price("1"))
+	require.True(t, mr.Exists("book:1"))
+	require.Equal(t, "QM", cheapest())
+
+	require.Equal(t, http.StatusNoContent, serve(http.MethodPatch, "/api/v1/book?id=3", `{"price": 9.5}`).Code)
+	require.Equal(t, 9.5, price("3"))
+	require.Equal(t, "GR", cheapest())
+
+	require.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/api/v1/book?id=3", "").Code)
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/api/v1/book/3", "").Code)
+	require.Equal(t, "QM", cheapest())
+
+	// without Redis, books are served from the database
+	mr.Close()
+	require.Equal(t, 11.99, price("2"))
+}
+
+func TestBookServiceBypassesDownRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	cb := breaker.New("redis", 2, time.Hour)
+	cache.AddHook(breaker.RedisHook(cb))
+	bookSvc := &BookService{
+		DB:      db.NewCached[model.Book](&db.Cache[model.Book]{InitElements: testBooks}, cache, "book", time.Hour),
+		Cache:   cache,
+		Breaker: cb,
+	}
+	bookSvc.Init()
+	defer bookSvc.DB.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	bookSvc.SetupEndpoints(router)
+	get := func(id string) int {
+		t.Helper()
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "/api/v1/book/"+id, nil)
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	check := bookSvc.HealthChecks()["redis"]
+
+	require.NoError(t, check(t.Context()))
+	mr.Close()
+	for _, id := range []string{"1", "2", "3", "1"} {
+		require.Equal(t, http.StatusOK, get(id))
+	}
+	require.Equal(t, breaker.Open, cb.State())
+
+	// readiness reports the outage without failing
+	err := check(t.Context())
+	var cbErr *breaker.Error
+	require.ErrorAs(t, err, &cbErr)
+	require.Equal(t, breaker.Open, cbErr.State)
+	require.True(t, cbErr.Degraded())
+}
+
+func TestBookServiceRedisDegradedWithoutBreaker(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	defer cache.Close()
+	bookSvc := &BookService{
+		DB:    &db.Cache[model.Book]{InitElements: testBooks},
+		Cache: cache,
+	}
+	check := bookSvc.HealthChecks()["redis"]
+
+	require.NoError(t, check(t.Context()))
+	mr.Close()
+	err := check(t.Context())
+	require.Error(t, err)
+	var d interface{ Degraded() bool }
+	require.ErrorAs(t, err, &d)
+	require.True(t, d.Degraded())
+}
+
+func TestGetBookHandlerTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	// tracers taken from the default provider keep forwarding to the first
+	// one set: shutting it down stops them from recording
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		require.NoError(t, tp.Shutdown(context.Background()))
+	})
+
+	cache := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	require.NoError(t, tracing.InstrumentRedis(cache))
+	bookSvc := &BookService{
+		DB:    db.NewCached(db.Instrument[model.Book]("memory", &db.Cache[model.Book]{InitElements: testBooks}), cache, "book", time.Hour),
+		Cache: cache,
+	}
+	bookSvc.Init()
+	defer bookSvc.DB.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(tracing.Middleware)
+	bookSvc.SetupEndpoints(router)
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "/api/v1/book/1", nil)
+	require.NoError(t, err)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	server := spans[len(spans)-1]
+	require.Equal(t, "GET /api/v1/book/:id", server.Name)
+
+	var children []string
+	for _, s := range spans {
+		if s.Parent.SpanID() == server.SpanContext.SpanID() {
+			children = append(children, s.Name)
+		}
+	}
+	// the entry and its generation are read, and a script stores the entry
+	// unless the generation changed, loaded on first use
+	require.Equal(t, []string{"get", "get", "Database.Get", "evalsha", "eval"}, children)
+}
+
+func TestCreateBookHandlerValidation(t *testing.T) {
+	bookSvc := &BookService{
+		DB:    &db.Cache[model.Book]{InitElements: testBooks},
+		Cache: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}),
+	}
+	bookSvc.Init()
+	defer bookSvc.DB.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	bookSvc.SetupEndpoints(router)
+
+	req, err := http.NewRequestWithContext(
+		t.Context(),
+		http.MethodPost,
+		"/api/v1/book",
+		bytes.NewReader([]byte(`{"title": " ", "price": -1}`)),
+	)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	var problem apierror.Problem
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &problem))
+	require.Equal(t, []apierror.FieldError{
+		{Field: "title", Message: "must not be empty"},
+		{Field: "author", Message: "must not be empty"},
+		{Field: "price", Message: "must be >= 0"},
+	}, problem.Errors)
+}
+
+func TestGetBooksHandlerQuery(t *testing.T) {
+	bookSvc := &BookService{
+		DB:    &db.Cache[model.Book]{InitElements: testBooks},
+		Cache: redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}),
+	}
+	bookSvc.Init()
+	defer bookSvc.DB.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	bookSvc.SetupEndpoints(router)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		field  string
+	}{
+		{"Multi-column sort", "sort=-price,title", http.StatusOK, ""},
+		{"Legacy sortBy and order", "sortBy=price&order=DESC", http.StatusOK, ""},
+		{"Unknown sort field", "sort=-price,isbn", http.StatusBadRequest, "sort"},
+		{"Injected sortBy", "sortBy=title%3B%20DROP%20TABLE%20books", http.StatusBadRequest, "sort"},
+		{"Invalid order", "order=sideways", http.StatusBadRequest, "order"},
+		{"Unknown filter", "isbn=123", http.StatusBadRequest, "isbn"},
+		{"Filter operators", "price[lte]=20&author[in]=Bohr,Dirac", http.StatusOK, ""},
+		{"Unknown operator", "price[like]=20", http.StatusBadRequest, "price[like]"},
+		{"Mistyped filter value", "price[between]=10,cheap", http.StatusBadRequest, "price[between]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "/api/v1/books?"+tt.query, nil)
+			require.NoError(t, err)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			require.Equal(t, tt.status, rr.Code, rr.Body.String())
+			if tt.field == "" {
+				return
+			}
+
+			var problem apierror.Problem
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &problem))
+			require.Len(t, problem.Errors, 1)
+			require.Equal(t, tt.field, problem.Errors[0].Field)
+		})
+	}
+}
+
+func TestGetBooksHandlerPagination(t *testing.T) {
+	bookSvc := &BookService{
+		DB:       &db.Cache[model.Book]{InitElements: testBooks},
+		Cache:    redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}),
+		MaxLimit: 50,
+	}
+	bookSvc.Init()
+	defer bookSvc.DB.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	bookSvc.SetupEndpoints(router)
+
+	get := func(t *testing.T, target string) (int, BookPage) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, target, nil)
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		var page BookPage
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+		}
+		return rr.Code, page
+	}
+	titles := func(p BookPage) []string {
+		var out []string
+		for _, b := range p.Data {
+			out = append(out, b.Title)
+		}
+		return out
+	}
+
+	code, first := get(t, "/api/v1/books?limit=2&sort=-price&total=exact")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"GR", "QFT"}, titles(first))
+	require.Equal(t, int64(3), *first.Metadata.Total)
+	require.Empty(t, first.Metadata.Prev)
+	require.NotEmpty(t, first.Metadata.Next)
+
+	code, second := get(t, first.Metadata.Next)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"QM"}, titles(second))
+	require.Empty(t, second.Metadata.Next)
+	require.NotEmpty(t, second.Metadata.Prev)
+
+	code, back := get(t, second.Metadata.Prev)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"GR", "QFT"}, titles(back))
+
+	// the cursor is bound to the sort order it was issued for
+	next, err := url.Parse(first.Metadata.Next)
+	require.NoError(t, err)
+	cursor := next.Query().Get("cursor")
+	code, _ = get(t, "/api/v1/books?limit=2&sort=price&cursor="+cursor)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = get(t, "/api/v1/books?cursor=forged.token")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = get(t, "/api/v1/books?offset=1&sort=-price&cursor="+cursor)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = get(t, "/api/v1/books?limit=51")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = get(t, "/api/v1/books?total=some")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// without MaxAge, shared caches must revalidate
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "/api/v1/books", nil)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, "no-cache", rr.Header().Get("Cache-Control"))
+	req, err = http.NewRequestWithContext(t.Context(), http.MethodGet, "/api/v1/books?limit=0", nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Empty(t, rr.Header().Get("Cache-Control"), "errors are not cached")
+}
+
+func TestBookServiceOnSQLite(t *testing.T) {
+	bookSvc := &BookService{
+		DB:       &db.SQLite[model.Book]{InitElements: testBooks},
+		Cache:    redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()}),
+		MaxLimit: 50,
+	}
+	bookSvc.Init()
+	defer bookSvc.DB.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	bookSvc.SetupEndpoints(router)
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequestWithContext(t.Context(), method, target, strings.NewReader(body))
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(http.MethodPost, "/api/v1/book", `{"title": "SR", "author": "Einstein", "price": 8.5}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	rr = serve(http.MethodPost, "/api/v1/book", `{"title": "QM", "author": "Bohr", "price": 1}`)
+	require.Equal(t, http.StatusConflict, rr.Code, rr.Body.String())
+
+	// a bare string filter is a case-insensitive contains, ILIKE in Postgres
+	rr = serve(http.MethodGet, "/api/v1/books?author=einSTEIN&sort=price", "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var page BookPage
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+	require.Len(t, page.Data, 2)
+	require.Equal(t, "SR", page.Data[0].Title)
+	require.Equal(t, "GR", page.Data[1].Title)
+
+	rr = serve(http.MethodPatch, "/api/v1/book?id=4", `{"price": 9}`)
+	require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+	rr = serve(http.MethodGet, "/api/v1/book/4", "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.Contains(t, rr.Body.String(), `"price":9`)
+
+	rr = serve(http.MethodDelete, "/api/v1/book?id=4", "")
+	require.Equal(t, http.StatusNoContent, rr.Code, rr.Body.String())
+	rr = serve(http.MethodGet, "/api/v1/book/abc", "")
+	require.Equal(t, http.StatusUnprocessableEntity, rr.Code, rr.Body.String())
+}
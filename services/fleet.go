@@ -1,9 +1,11 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	db "k8s-backend/database"
 	m "k8s-backend/model"
+	"k8s-backend/server/apierror"
 	"log"
 	"log/slog"
 	"net/http"
@@ -31,6 +33,10 @@ func (f *FleetService) Init() {
 	}
 }
 
+func (f *FleetService) Shutdown(_ context.Context) error {
+	return f.DB.Close()
+}
+
 func (f *FleetService) SetupEndpoints(r *gin.Engine) {
 	// handlers can still be chained with a wrapper
 	r.GET("/fleet", f.GetFleetHandler)
@@ -38,19 +44,28 @@ func (f *FleetService) SetupEndpoints(r *gin.Engine) {
 
 // Simulate fetching data from multiple sources (e.g., external APIs) and combine the results into a single response.
 func (f *FleetService) GetFleetHandler(c *gin.Context) {
-	net := make(chan bool)
-	dc := make(chan bool)
-	k8s := make(chan bool)
+	// buffered so the checks finish even if the client has gone away
+	net := make(chan bool, 1)
+	dc := make(chan bool, 1)
+	k8s := make(chan bool, 1)
 
 	go f.CheckNetworking(net)
 	go f.CheckDataCenter(dc)
 	go f.CheckKubernetes(k8s)
 
-	c.JSON(http.StatusOK, &m.FleetHealthStatus{
-		Networking: <-net,
-		DataCenter: <-dc,
-		Kubernetes: <-k8s,
-	})
+	status := new(m.FleetHealthStatus)
+	for range 3 {
+		select {
+		case status.Networking = <-net:
+		case status.DataCenter = <-dc:
+		case status.Kubernetes = <-k8s:
+		case <-c.Request.Context().Done():
+			apierror.Abort(c, c.Request.Context().Err())
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, status)
 }
 
 func (f *FleetService) CheckNetworking(ch chan bool) {
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -9,7 +10,9 @@ import (
 	"strings"
 
 	db "k8s-backend/database"
+	"k8s-backend/logging"
 	m "k8s-backend/model"
+	"k8s-backend/server/apierror"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -26,6 +29,10 @@ func (s *UserService) Init() {
 	}
 }
 
+func (s *UserService) Shutdown(_ context.Context) error {
+	return s.DB.Close()
+}
+
 func (s *UserService) SetupEndpoints(r *gin.Engine) {
 	http.HandleFunc("/register", s.RegisterUserHandler)
 	http.HandleFunc("/users", s.GetUserHandler)
@@ -33,43 +40,48 @@ func (s *UserService) SetupEndpoints(r *gin.Engine) {
 
 func (s *UserService) RegisterUserHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "POST required", http.StatusBadRequest)
+		w.Header().Set("Allow", http.MethodPost)
+		apierror.Write(w, r, apierror.New(http.StatusMethodNotAllowed, "POST required"))
 		return
 	}
 
 	var user m.User
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "Request body must contain name, email, and age", http.StatusBadRequest)
+		apierror.Write(w, r, apierror.BadRequest("request body must contain name, email, and age"))
 		return
 	}
 
 	if err := ValidateUser(&user); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		apierror.Write(w, r, err)
 		return
 	}
 
 	userId := uuid.NewString()
-	if err := s.DB.Insert(userId, &user); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.DB.Insert(r.Context(), userId, &user); err != nil {
+		apierror.Write(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	if _, err := fmt.Fprintf(w, "User %v created successfully", userId); err != nil {
-		http.Error(w, "Error writing response", http.StatusInternalServerError)
-		return
+		// the status line is already sent, all that's left is to record it
+		logging.FromContext(r.Context()).Warn("writing response failed", "error", err)
 	}
 }
 
 func ValidateUser(user *m.User) error {
+	var errs apierror.FieldErrors
 	if len(user.Name) < 3 {
-		return fmt.Errorf("user name must have 3+ characters")
+		errs = append(errs, apierror.FieldError{Field: "name", Message: "must have 3+ characters"})
 	}
 	if !strings.Contains(user.Email, "@") {
-		return fmt.Errorf("user email must be valid")
+		errs = append(errs, apierror.FieldError{Field: "email", Message: "must be a valid email address"})
 	}
 	if user.Age <= 21 {
-		return fmt.Errorf("user age must be greater than 21")
+		errs = append(errs, apierror.FieldError{Field: "age", Message: "must be greater than 21"})
+	}
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
@@ -77,25 +89,24 @@ func ValidateUser(user *m.User) error {
 func (s *UserService) GetUserHandler(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	if id == "" {
-		http.Error(w, "Query parameter 'id' must be provided", http.StatusBadRequest)
+		apierror.Write(w, r, apierror.BadRequest("query parameter 'id' must be provided"))
 		return
 	}
 
-	user, err := s.DB.Get(id)
+	user, err := s.DB.Get(r.Context(), id)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("User %s not found", id), http.StatusNotFound)
+		apierror.Write(w, r, err)
 		return
 	}
 
 	data, err := json.MarshalIndent(user, "", "  ")
 	if err != nil {
-		http.Error(w, "Error marshaling struct into JSON", http.StatusInternalServerError)
+		apierror.Write(w, r, fmt.Errorf("encoding user: %w", err))
 		return
 	}
 
 	w.Header().Add("Content-Type", "application/json")
 	if _, err := w.Write(data); err != nil {
-		http.Error(w, "Error writing response JSON", http.StatusInternalServerError)
-		return
+		logging.FromContext(r.Context()).Warn("writing response failed", "error", err)
 	}
 }
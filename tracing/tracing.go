@@ -0,0 +1,141 @@
+// Package tracing configures the global OpenTelemetry tracer provider and
+// W3C trace-context propagation, and instruments gin and Redis.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"k8s-backend/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "k8s-backend"
+
+// Tracer returns the tracer used for spans created by this module.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup installs the global tracer provider and propagator. The returned
+// function flushes buffered spans and must be called on shutdown.
+func Setup(ctx context.Context, cfg config.Tracing) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("creating stdout exporter: %w", err)
+		}
+		exporter = exp
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("creating otlp exporter: %w", err)
+		}
+		exporter = exp
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("building trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// InstrumentRedis adds a client span to every command sent by client.
+func InstrumentRedis(client *redis.Client) error {
+	return redisotel.InstrumentTracing(client)
+}
+
+// Middleware starts a server span per request, continuing the caller's trace
+// from its traceparent header, and writes the span's traceparent back on the
+// response so callers can correlate it.
+func Middleware(c *gin.Context) {
+	propagator := otel.GetTextMapPropagator()
+	ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+	// the route template is not known until routing has run, so name the
+	// span after the method and rename it once the handler chain returns
+	ctx, span := Tracer().Start(ctx, c.Request.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Request.Method),
+			semconv.URLPath(c.Request.URL.Path),
+			semconv.ClientAddress(c.ClientIP()),
+		),
+	)
+	defer span.End()
+
+	propagator.Inject(ctx, propagation.HeaderCarrier(c.Writer.Header()))
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	if route := c.FullPath(); route != "" {
+		span.SetName(c.Request.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+	}
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+	}
+	if len(c.Errors) > 0 {
+		span.SetAttributes(attribute.String("gin.errors", c.Errors.String()))
+	}
+}
+
+// StartDatabase starts a client span for one Database[T] call.
+func StartDatabase(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, "Database."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, attribute.String("db.operation.name", method))...),
+	)
+}
+
+// End records err on span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMiddlewarePropagation(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	// tracers taken from the default provider keep forwarding to the first
+	// one set: shutting it down stops them from recording
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+		require.NoError(t, tp.Shutdown(context.Background()))
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware)
+	router.GET("/books/:id", func(c *gin.Context) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, span := StartDatabase(c.Request.Context(), "Get")
+			End(span, nil)
+		}()
+		<-done
+		c.Status(http.StatusOK)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/books/1", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	db, server := spans[0], spans[1]
+
+	require.Equal(t, "GET /books/:id", server.Name)
+	require.Equal(t, trace.SpanKindServer, server.SpanKind)
+	require.Equal(t, traceID, server.SpanContext.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID().String())
+
+	require.Equal(t, "Database.Get", db.Name)
+	require.Equal(t, server.SpanContext.SpanID(), db.Parent.SpanID())
+
+	// the response carries the server span's context back to the caller
+	require.Equal(t,
+		"00-"+traceID+"-"+server.SpanContext.SpanID().String()+"-01",
+		rr.Header().Get("traceparent"),
+	)
+}